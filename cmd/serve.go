@@ -31,12 +31,25 @@ var serveCmd = &cobra.Command{
 	DATA_DIR
 	CPU
 	RAM
+	CONFIG optional YAML config file
 	`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		err := compose.EnsureBin()
-		if err != nil {
-			return err
+		cfg := &server.Config{}
+		var err error
+		configPath := os.Getenv("CONFIG")
+		if configPath != "" {
+			cfg, err = server.LoadConfig(configPath)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cfg.Runner != server.APIRunner {
+			err = compose.UseBin(cfg.Compose)
+			if err != nil {
+				return err
+			}
 		}
 
 		dsn := os.Getenv("SENTRY_DSN")
@@ -77,7 +90,12 @@ var serveCmd = &cobra.Command{
 		cpu := 2
 		ram := 8 * 1024
 
-		s, err := server.New(addr, dataDir, authKey, cpu, ram)
+		s, err := server.New(addr, dataDir, authKey, cfg, cpu, ram)
+		if err != nil {
+			return err
+		}
+
+		err = s.Configure(cfg)
 		if err != nil {
 			return err
 		}
@@ -88,12 +106,18 @@ var serveCmd = &cobra.Command{
 		done := make(chan os.Signal, 1)
 		signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 		fmt.Println("Listening", s.Addr)
-		go s.Run(ctx)
+		stopped := make(chan bool)
+		go func() {
+			s.Run(ctx)
+			close(stopped)
+		}()
 		select {
 		case <-done:
 			fmt.Println("Bye")
 			cancel()
 		}
+		// running tasks are handled by the shutdown policy
+		<-stopped
 		return nil
 	},
 }
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/factorysh/density/scheduler"
+	"github.com/factorysh/density/server"
+)
+
+var (
+	importDryRun   bool
+	importConflict string
+)
+
+func init() {
+	storeImportCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Check the import, without writing")
+	storeImportCmd.Flags().StringVar(&importConflict, "conflict", "fail", "When an id already exists : fail, skip, replace or renew")
+	storeCmd.AddCommand(storeExportCmd, storeImportCmd, storeBackupCmd)
+	rootCmd.AddCommand(storeCmd)
+}
+
+var storeCmd = &cobra.Command{
+	Use:   "store",
+	Short: "Export, import and backup the task store",
+	Long: `
+	The store is locked by a running server, use the /api/admin endpoints instead.
+	DATA_DIR
+	CONFIG optional YAML config file, for the store engine
+	`,
+}
+
+var storeExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Export all the tasks as JSON lines, default is stdout",
+	Args:  cobra.MaximumNArgs(1),
+	// errors are not about usage
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		j, closeStore, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		w, closeOut, err := output(args)
+		if err != nil {
+			return err
+		}
+		defer closeOut()
+		n, err := j.Export(w)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%d tasks exported\n", n)
+		return nil
+	},
+}
+
+var storeImportCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Import tasks from JSON lines, default is stdin",
+	Args:  cobra.MaximumNArgs(1),
+	// errors are not about usage
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conflict, err := scheduler.ParseConflict(importConflict)
+		if err != nil {
+			return err
+		}
+		var r io.Reader = os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		j, closeStore, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		report, err := j.Import(r, scheduler.ImportOptions{
+			DryRun:   importDryRun,
+			Conflict: conflict,
+		})
+		if report != nil {
+			for _, e := range report.Errors {
+				fmt.Fprintln(os.Stderr, e)
+			}
+			fmt.Fprintf(os.Stderr, "imported: %d skipped: %d replaced: %d renewed: %d dry run: %v\n",
+				report.Imported, report.Skipped, report.Replaced, report.Renewed, report.DryRun)
+		}
+		return err
+	},
+}
+
+var storeBackupCmd = &cobra.Command{
+	Use:   "backup [file]",
+	Short: "Copy the whole store, default is stdout",
+	Args:  cobra.MaximumNArgs(1),
+	// errors are not about usage
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		j, closeStore, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+		w, closeOut, err := output(args)
+		if err != nil {
+			return err
+		}
+		defer closeOut()
+		_, err = j.Backup(w)
+		return err
+	},
+}
+
+func openStore() (*scheduler.JSONStore, func(), error) {
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "/tmp/density"
+	}
+	engine := ""
+	configPath := os.Getenv("CONFIG")
+	if configPath != "" {
+		cfg, err := server.LoadConfig(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		engine = cfg.Store
+	}
+	s, err := server.OpenStore(dataDir, engine)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open the store, is a server running ? %v", err)
+	}
+	return scheduler.NewJSONStore(s), func() {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}, nil
+}
+
+func output(args []string) (io.Writer, func(), error) {
+	if len(args) == 0 {
+		return os.Stdout, func() {}, nil
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
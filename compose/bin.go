@@ -2,38 +2,164 @@ package compose
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
 )
 
-var composeIsHere bool = false
+// Bin is the compose command, docker-compose or the docker compose plugin
+type Bin struct {
+	Path    string   // Executable
+	Args    []string // Arguments before the compose ones, compose for the plugin
+	Version string   // Like 2.5.0, without the v
+}
 
-// EnsureBin will ensure that docker-compose is found in $PATH
-func EnsureBin() error {
-	var name = "docker-compose"
-	var out bytes.Buffer
-	var stderr bytes.Buffer
+// MinVersion is the oldest docker-compose v1 accepted, for the flags used by Up, like --no-start and --detach
+const MinVersion = "1.25.0"
 
-	cmd := exec.Command("which", name)
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+// Command returns the compose command with these arguments
+func (b *Bin) Command(args ...string) *exec.Cmd {
+	return exec.Command(b.Path, append(append([]string{}, b.Args...), args...)...)
+}
 
-	err := cmd.Run()
+// Plugin tells if it's the docker compose plugin
+func (b *Bin) Plugin() bool {
+	return len(b.Args) > 0
+}
+
+func (b *Bin) String() string {
+	return strings.Join(append([]string{b.Path}, b.Args...), " ")
+}
+
+// versionOf a compose, major, minor and patch, the suffixes are ignored
+func versionOf(version string) ([3]int, error) {
+	var v [3]int
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return v, fmt.Errorf("bad compose version %s", version)
+	}
+	for i, part := range parts {
+		// 2.20.2-desktop.1 or 1.29.0-rc1
+		n := strings.IndexFunc(part, func(r rune) bool { return r < '0' || r > '9' })
+		if n >= 0 {
+			part = part[:n]
+		}
+		var err error
+		v[i], err = strconv.Atoi(part)
+		if err != nil {
+			return v, fmt.Errorf("bad compose version %s", version)
+		}
+	}
+	return v, nil
+}
+
+// supported version, v2 and later, or a v1 from MinVersion
+func (b *Bin) supported() error {
+	v, err := versionOf(b.Version)
+	if err != nil {
+		return err
+	}
+	min, err := versionOf(MinVersion)
 	if err != nil {
-		print(stderr.String())
-		return fmt.Errorf("%s not found: %s", name, err.Error())
+		return err
+	}
+	for i := range v {
+		if v[i] != min[i] {
+			if v[i] < min[i] {
+				return fmt.Errorf("compose %s is older than %s", b.Version, MinVersion)
+			}
+			return nil
+		}
 	}
 	return nil
 }
 
-func lazyEnsureBin() error {
-	if composeIsHere {
-		return nil
+var (
+	bin     *Bin
+	binLock sync.Mutex
+)
+
+// DetectBin finds the compose command. The path is docker-compose, or docker for the plugin.
+// Without path, the docker compose plugin is looked for in $PATH, then docker-compose.
+func DetectBin(path string) (*Bin, error) {
+	candidates := make([]*Bin, 0, 2)
+	if path != "" {
+		b := &Bin{Path: path}
+		if filepath.Base(path) == "docker" {
+			b.Args = []string{"compose"}
+		}
+		candidates = append(candidates, b)
+	} else {
+		if docker, err := exec.LookPath("docker"); err == nil {
+			candidates = append(candidates, &Bin{Path: docker, Args: []string{"compose"}})
+		}
+		if compose, err := exec.LookPath("docker-compose"); err == nil {
+			candidates = append(candidates, &Bin{Path: compose})
+		}
 	}
-	err := EnsureBin()
+	errs := make([]string, 0, len(candidates))
+	for _, b := range candidates {
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		cmd := b.Command("version", "--short")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s : %v %s", b, err, strings.TrimSpace(stderr.String())))
+			continue
+		}
+		b.Version = strings.TrimPrefix(strings.TrimSpace(stdout.String()), "v")
+		err = b.supported()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s : %v", b, err))
+			continue
+		}
+		return b, nil
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("neither docker compose nor docker-compose found in $PATH")
+	}
+	return nil, fmt.Errorf("compose not found: %s", strings.Join(errs, ", "))
+}
+
+// UseBin sets the compose command, see DetectBin
+func UseBin(path string) error {
+	b, err := DetectBin(path)
 	if err != nil {
 		return err
 	}
-	composeIsHere = true
+	log.WithField("compose", b.String()).WithField("version", b.Version).Info("Compose")
+	binLock.Lock()
+	defer binLock.Unlock()
+	bin = b
 	return nil
 }
+
+// EnsureBin will ensure that a compose command is found in $PATH
+func EnsureBin() error {
+	return UseBin("")
+}
+
+// lazyBin returns the compose command, detected once
+func lazyBin() (*Bin, error) {
+	binLock.Lock()
+	b := bin
+	binLock.Unlock()
+	if b != nil {
+		return b, nil
+	}
+	err := EnsureBin()
+	if err != nil {
+		return nil, err
+	}
+	binLock.Lock()
+	defer binLock.Unlock()
+	return bin, nil
+}
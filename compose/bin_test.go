@@ -0,0 +1,83 @@
+package compose
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBins writes fake docker and docker-compose commands
+func fakeBins(t *testing.T, dir string, plugin bool) {
+	fakeCompose(t, dir, "1.29.2")
+	docker := "#!/bin/sh\nexit 1\n"
+	if plugin {
+		docker = "#!/bin/sh\n[ \"$1 $2 $3\" = \"compose version --short\" ] && echo v2.5.0 && exit 0\nexit 1\n"
+	}
+	err := ioutil.WriteFile(path.Join(dir, "docker"), []byte(docker), 0755)
+	assert.NoError(t, err)
+}
+
+// fakeCompose writes a fake docker-compose, of this version
+func fakeCompose(t *testing.T, dir, version string) {
+	err := ioutil.WriteFile(path.Join(dir, "docker-compose"),
+		[]byte("#!/bin/sh\n[ \"$1 $2\" = \"version --short\" ] && echo "+version+" && exit 0\nexit 1\n"), 0755)
+	assert.NoError(t, err)
+}
+
+func TestDetectBin(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "bin-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir)
+
+	fakeBins(t, dir, true)
+	b, err := DetectBin("")
+	assert.NoError(t, err)
+	assert.True(t, b.Plugin())
+	assert.Equal(t, "2.5.0", b.Version)
+	assert.Equal(t, []string{path.Join(dir, "docker"), "compose", "--project-name", "p", "up"},
+		b.Command("--project-name", "p", "up").Args)
+
+	// no plugin
+	fakeBins(t, dir, false)
+	b, err = DetectBin("")
+	assert.NoError(t, err)
+	assert.False(t, b.Plugin())
+	assert.Equal(t, "1.29.2", b.Version)
+
+	// explicit path
+	b, err = DetectBin(path.Join(dir, "docker"))
+	assert.Error(t, err)
+	b, err = DetectBin(path.Join(dir, "docker-compose"))
+	assert.NoError(t, err)
+	assert.Equal(t, path.Join(dir, "docker-compose"), b.Path)
+
+	// too old for the flags of up
+	fakeCompose(t, dir, "1.17.1")
+	_, err = DetectBin(path.Join(dir, "docker-compose"))
+	assert.Error(t, err)
+
+	os.Setenv("PATH", "")
+	_, err = DetectBin("")
+	assert.Error(t, err)
+}
+
+func TestBinVersion(t *testing.T) {
+	for version, ok := range map[string]bool{
+		"2.20.2-desktop.1": true,
+		"v2.5.0":           true,
+		"1.29.0-rc1":       true,
+		"1.25.0":           true,
+		"1.24.1":           false,
+		"1.17.1":           false,
+		"garbage":          false,
+	} {
+		err := (&Bin{Version: version}).supported()
+		assert.Equal(t, ok, err == nil, version)
+	}
+}
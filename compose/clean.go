@@ -0,0 +1,73 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Cleaner removes the stopped containers and the networks of a project.
+// Running containers are kept, and the network with them, the lease of a removed network is released.
+func Cleaner(docker *client.Client, ledger *Ledger) func(project string) ([]string, error) {
+	return func(project string) ([]string, error) {
+		removed := make([]string, 0)
+		label := filters.KeyValuePair{Key: "label", Value: fmt.Sprintf("batch=%s", project)}
+		containers, err := docker.ContainerList(context.TODO(), types.ContainerListOptions{
+			All:     true,
+			Filters: filters.NewArgs(label),
+		})
+		if err != nil {
+			return removed, err
+		}
+		running := 0
+		for _, container := range containers {
+			if container.State == "running" || container.State == "restarting" {
+				running++
+				continue
+			}
+			err = docker.ContainerRemove(context.TODO(), container.ID, types.ContainerRemoveOptions{
+				RemoveVolumes: true,
+			})
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, fmt.Sprintf("container %s", containerName(container)))
+		}
+		if running > 0 {
+			return removed, fmt.Errorf("%d containers of %s are still running", running, project)
+		}
+		networks, err := docker.NetworkList(context.TODO(), types.NetworkListOptions{
+			Filters: filters.NewArgs(label),
+		})
+		if err != nil {
+			return removed, err
+		}
+		for _, network := range networks {
+			err = releaseEgress(network)
+			if err != nil {
+				return removed, err
+			}
+			err = docker.NetworkRemove(context.TODO(), network.ID)
+			if err != nil {
+				return removed, err
+			}
+			err = releaseLease(ledger, network)
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, fmt.Sprintf("network %s", network.Name))
+		}
+		return removed, nil
+	}
+}
+
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
+}
@@ -7,9 +7,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,17 +17,21 @@ import (
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	_run "github.com/factorysh/density/task/run"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
 // Compose is a docker-compose project
-// FIXME there is more first level keys, like volume or networks
 type Compose struct {
 	Networks map[string]interface{} `json:"networks,omitempty"`
 	Volumes  map[string]interface{} `json:"volumes,omitempty"`
+	Secrets  map[string]interface{} `json:"secrets,omitempty"`
+	Configs  map[string]interface{} `json:"configs,omitempty"`
 	Version  string                 `json:"version"` // Compose version
 	Services map[string]interface{} `json:"services"`
 	X        map[string]interface{} `json:"X,omitempty"` // The x-stuff on top level, just for aliasing
+	Resolved bool                   `json:"-"`           // Without variables, extends and profiles, see Resolve. Never read from the clients
+	engine   *Engine                // Runs the project with the Docker API, set by the recomposator
 }
 
 // NewCompose inits a compose struct
@@ -57,8 +61,7 @@ func (c *Compose) UnmarshalYAML(value *yaml.Node) error {
 		case k.Value == "version":
 			v.Decode(&c.Version)
 		case k.Value == "services":
-			var services map[string]interface{}
-			err := v.Decode(&services)
+			services, err := decodeMap(v)
 			if err != nil {
 				return err
 			}
@@ -70,21 +73,81 @@ func (c *Compose) UnmarshalYAML(value *yaml.Node) error {
 				}
 				c.Services[key.String()] = service
 			}
+		case k.Value == "networks":
+			var err error
+			c.Networks, err = decodeMap(v)
+			if err != nil {
+				return err
+			}
+		case k.Value == "volumes":
+			var err error
+			c.Volumes, err = decodeMap(v)
+			if err != nil {
+				return err
+			}
+		case k.Value == "secrets":
+			var err error
+			c.Secrets, err = decodeMap(v)
+			if err != nil {
+				return err
+			}
+		case k.Value == "configs":
+			var err error
+			c.Configs, err = decodeMap(v)
+			if err != nil {
+				return err
+			}
 		case strings.HasPrefix(k.Value, "x-"):
-			var xs map[string]interface{}
-			err := v.Decode(&xs)
+			xs, err := decodeMap(v)
 			if err != nil {
 				return err
 			}
 
 			c.X[k.Value] = xs
 
+		default:
+			// other keys are ignored, like name, the project is the task
 		}
 	}
 
 	return nil
 }
 
+// decodeMap decodes a YAML map, maps with merge keys are map[interface{}]interface{} for the parser
+func decodeMap(node *yaml.Node) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	err := node.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, nil
+	}
+	return stringKeys(m).(map[string]interface{}), nil
+}
+
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			v[k] = stringKeys(vv)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[fmt.Sprint(k)] = stringKeys(vv)
+		}
+		return m
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = stringKeys(vv)
+		}
+		return v
+	}
+	return value
+}
+
 func (c *Compose) WalkServices(fn func(name string, value map[string]interface{}) error) error {
 	for k, v := range c.Services {
 		if !strings.HasPrefix(k, "x-") {
@@ -144,6 +207,27 @@ func (c Compose) MarshalYAML() (interface{}, error) {
 		"version":  c.Version,
 		"services": c.Services,
 	}
+	for k, v := range map[string]map[string]interface{}{
+		"networks": c.Networks,
+		"volumes":  c.Volumes,
+		"secrets":  c.Secrets,
+		"configs":  c.Configs,
+	} {
+		if len(v) > 0 {
+			acc[k] = v
+		}
+	}
+	if c.Resolved {
+		for _, k := range []string{"services", "networks", "volumes", "secrets", "configs"} {
+			if v, ok := acc[k]; ok {
+				escaped, err := walkStrings(v, escape)
+				if err != nil {
+					return nil, err
+				}
+				acc[k] = escaped
+			}
+		}
+	}
 
 	for k, v := range c.X {
 		acc[k] = v
@@ -152,12 +236,31 @@ func (c Compose) MarshalYAML() (interface{}, error) {
 	return acc, nil
 }
 
-// Validate compose content
+// Validate compose content, resolved without the environments, with the compose command when there is one
 func (c Compose) Validate() error {
-	err := lazyEnsureBin()
+	resolved, err := c.resolve(nil, false)
+	if err != nil {
+		return err
+	}
+	c = *resolved
+	_, err = c.guessMainContainer()
+	if err != nil {
+		return err
+	}
+	_, err = c.startTimeout()
+	if err != nil {
+		return err
+	}
+	_, err = c.egress()
 	if err != nil {
 		return err
 	}
+	bin, err := lazyBin()
+	if err != nil {
+		// the API runner has no compose command, its engine validates with the validator
+		log.WithError(err).Debug("Validated without compose")
+		return nil
+	}
 	p := path.Join(os.TempDir(), "validator")
 	os.MkdirAll(p, 0750)
 	file, err := ioutil.TempFile(p, "validate-")
@@ -173,7 +276,7 @@ func (c Compose) Validate() error {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	cmd := exec.Command("docker-compose", "-f", file.Name(), "config", "-q")
+	cmd := bin.Command("-f", file.Name(), "config", "-q")
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
@@ -185,22 +288,104 @@ func (c Compose) Validate() error {
 	return err
 }
 
+// guessMainContainer returns the service followed by the task, the other ones are sidecars.
+// It's the x-batch.main service, or the leader of the dependency graph.
 func (c Compose) guessMainContainer() (string, error) {
 	if len(c.Services) == 0 {
 		return "", fmt.Errorf("'services' is not a an empty map : %p", &c.Services)
 	}
+	if x, ok := c.X["x-batch"].(map[string]interface{}); ok {
+		if raw, ok := x["main"]; ok {
+			main, ok := raw.(string)
+			if !ok {
+				return "", fmt.Errorf("x-batch.main is not a string : %v", raw)
+			}
+			if _, ok := c.Services[main]; !ok {
+				return "", fmt.Errorf("x-batch.main is an unknown service : %s", main)
+			}
+			return main, nil
+		}
+	}
 	if len(c.Services) == 1 { // Easy, there is only one service
 		for k := range c.Services {
 			return k, nil
 		}
 	}
-	//TODO build a DAG with depends_on, or watch for an annotation
-	return "", errors.New("Multiple services handling is not yet implemented")
+	main, err := c.NewServiceGraph().ByServiceDepth().findLeader()
+	if err != nil {
+		return "", fmt.Errorf("can't guess the main service, set x-batch.main : %v", err)
+	}
+	return main, nil
+}
+
+// DefaultStartTimeout is the time given to the dependencies to be healthy
+const DefaultStartTimeout = 2 * time.Minute
+
+// healthDeps are the dependencies which must be healthy before the service starts :
+// the service_healthy ones, and the ones with a healthcheck, without condition.
+func (c Compose) healthDeps(name string) []string {
+	health := make([]string, 0)
+	for dep, condition := range dependsOn(c.Services[name]) {
+		if condition == ServiceHealthy || (condition == "" && hasHealthcheck(c.Services[dep])) {
+			health = append(health, dep)
+		}
+	}
+	sort.Strings(health)
+	return health
 }
 
-// Up compose action
-func (c Compose) Up(workingDirectory string, environments map[string]string, runID int) (_run.Run, error) {
-	err := lazyEnsureBin()
+func hasHealthcheck(value interface{}) bool {
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	healthcheck, ok := data["healthcheck"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	disable, _ := healthcheck["disable"].(bool)
+	return !disable
+}
+
+// startTimeout is the x-batch.start_timeout, or the default one
+func (c Compose) startTimeout() (time.Duration, error) {
+	x, ok := c.X["x-batch"].(map[string]interface{})
+	if !ok {
+		return DefaultStartTimeout, nil
+	}
+	raw, ok := x["start_timeout"]
+	if !ok {
+		return DefaultStartTimeout, nil
+	}
+	txt, ok := raw.(string)
+	if !ok {
+		return 0, fmt.Errorf("x-batch.start_timeout is not a string : %v", raw)
+	}
+	timeout, err := time.ParseDuration(txt)
+	if err != nil {
+		return 0, fmt.Errorf("x-batch.start_timeout : %v", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("x-batch.start_timeout must be > 0 : %v", timeout)
+	}
+	return timeout, nil
+}
+
+// Up compose action, the project is the task.
+// A recomposed compose is already resolved, the other ones are resolved here.
+func (c Compose) Up(project, workingDirectory string, environments map[string]string, runID int) (_run.Run, error) {
+	engine := c.engine
+	if !c.Resolved {
+		resolved, err := c.Resolve(environments)
+		if err != nil {
+			return nil, err
+		}
+		c = *resolved
+	}
+	if engine != nil {
+		return engine.Up(&c, project, workingDirectory, environments, runID)
+	}
+	bin, err := lazyBin()
 	if err != nil {
 		return nil, err
 	}
@@ -208,6 +393,10 @@ func (c Compose) Up(workingDirectory string, environments map[string]string, run
 	if err != nil {
 		return nil, err
 	}
+	startTimeout, err := c.startTimeout()
+	if err != nil {
+		return nil, err
+	}
 	f, err := os.OpenFile(path.Join(workingDirectory, "docker-compose.yml"),
 		os.O_RDWR|os.O_CREATE, 0640)
 	if err != nil {
@@ -233,25 +422,43 @@ func (c Compose) Up(workingDirectory string, environments map[string]string, run
 	}
 	f.Close()
 
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
+	compose := func(args ...string) error {
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		cmd := bin.Command(append([]string{"--project-name", project}, args...)...)
+		cmd.Dir = workingDirectory
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		fmt.Println(stdout.String())
+		fmt.Println(stderr.String())
+		return err
+	}
 	start := time.Now()
-	cmd := exec.Command("docker-compose", "up", "--remove-orphans", "--detach")
-	cmd.Dir = workingDirectory
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err = cmd.Run()
-	fmt.Println(stdout.String())
-	fmt.Println(stderr.String())
-	if err != nil {
-		return nil, err
+	health := c.healthDeps(main)
+	if len(health) == 0 {
+		err = compose("up", "--remove-orphans", "--detach")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// the main container is started by Wait, when its dependencies are healthy
+		err = compose("up", "--remove-orphans", "--no-start")
+		if err != nil {
+			return nil, err
+		}
+		others := make([]string, 0, len(c.Services)-1)
+		for name := range c.Services {
+			if name != main {
+				others = append(others, name)
+			}
+		}
+		sort.Strings(others)
+		err = compose(append([]string{"start"}, others...)...)
+		if err != nil {
+			return nil, err
+		}
 	}
-	fmt.Println(cmd.ProcessState.ExitCode())
-
-	// FIXME, use docker API, not the cli
-	dir := strings.Split(workingDirectory, "/")
 
 	cli, err := client.NewEnvClient()
 	if err != nil {
@@ -260,6 +467,7 @@ func (c Compose) Up(workingDirectory string, environments map[string]string, run
 
 	containers, err := cli.ContainerList(context.Background(),
 		types.ContainerListOptions{
+			All: true,
 			Filters: filters.NewArgs(
 				filters.KeyValuePair{
 					Key:   "label",
@@ -267,18 +475,24 @@ func (c Compose) Up(workingDirectory string, environments map[string]string, run
 				},
 				filters.KeyValuePair{
 					Key:   "label",
-					Value: fmt.Sprintf("com.docker.compose.project=%s", dir[len(dir)-1]),
+					Value: fmt.Sprintf("com.docker.compose.project=%s", project),
 				}),
 		})
 	if err != nil {
 		return nil, err
 	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("no container for the service %s of %s", main, project)
+	}
 
 	return &DockerRun{
-		Path:    workingDirectory,
-		ID:      runID,
-		RID:     containers[0].ID,
-		Start:   start,
-		Running: true,
+		Path:         workingDirectory,
+		Project:      project,
+		ID:           runID,
+		RID:          containers[0].ID,
+		Start:        start,
+		Running:      true,
+		Health:       health,
+		StartTimeout: startTimeout,
 	}, err
 }
@@ -155,7 +155,7 @@ func TestRunCompose(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "compose-")
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
-	run, err := c.Up(dir, nil, 0)
+	run, err := c.Up("compose", dir, nil, 0)
 	assert.NoError(t, err)
 	fmt.Println(run)
 	ctx := context.TODO()
@@ -171,7 +171,7 @@ func TestRunComposeTimeout(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "compose-")
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
-	run, err := c.Up(dir, nil, 0)
+	run, err := c.Up("compose", dir, nil, 0)
 	assert.NoError(t, err)
 	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
 	defer cancel()
@@ -187,7 +187,7 @@ func TestRunComposeCancel(t *testing.T) {
 	dir, err := ioutil.TempDir(os.TempDir(), "compose-")
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
-	run, err := c.Up(dir, nil, 0)
+	run, err := c.Up("compose", dir, nil, 0)
 	assert.NoError(t, err)
 	ctx, cancel := context.WithCancel(context.TODO())
 	go func() {
@@ -227,6 +227,61 @@ func TestUnmarshal(t *testing.T) {
 	assert.Equal(t, "value", xv)
 }
 
+const withTopLevel = `
+version: '3.7'
+services:
+  hello:
+    image: "busybox:latest"
+    networks:
+      back:
+        aliases: [greetings]
+    volumes:
+      - cache:/cache
+    secrets:
+      - token
+    configs:
+      - source: settings
+        target: /etc/settings.ini
+networks:
+  back:
+volumes:
+  cache:
+secrets:
+  token:
+    file: ./token.txt
+configs:
+  settings:
+    file: ./settings.ini
+`
+
+func TestTopLevel(t *testing.T) {
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(withTopLevel), c)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"back": nil}, c.Networks)
+	assert.Equal(t, map[string]interface{}{"cache": nil}, c.Volumes)
+	assert.Equal(t, map[string]interface{}{"token": map[string]interface{}{"file": "./token.txt"}}, c.Secrets)
+	assert.Equal(t, map[string]interface{}{"settings": map[string]interface{}{"file": "./settings.ini"}}, c.Configs)
+
+	out, err := yaml.Marshal(c)
+	assert.NoError(t, err)
+	cc := NewCompose()
+	err = yaml.Unmarshal(out, cc)
+	assert.NoError(t, err)
+	assert.Equal(t, c, cc)
+
+	// other keys are ignored
+	cc = NewCompose()
+	err = yaml.Unmarshal([]byte(`
+name: hello
+services:
+  hello:
+    image: "busybox:latest"
+`), cc)
+	assert.NoError(t, err)
+	assert.Len(t, cc.Services, 1)
+}
+
 func TestByServiceDepth(t *testing.T) {
 	c := NewCompose()
 	err := yaml.Unmarshal([]byte(withDependsCompose), &c)
@@ -257,6 +312,28 @@ func TestFindMain(t *testing.T) {
 	assert.Equal(t, "hello", main)
 }
 
+func TestGuessMainContainer(t *testing.T) {
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(withALotOfDeps), c)
+	assert.NoError(t, err)
+	main, err := c.guessMainContainer()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", main)
+
+	c = NewCompose()
+	err = yaml.Unmarshal([]byte(withAmbiguousDeps), c)
+	assert.NoError(t, err)
+	_, err = c.guessMainContainer()
+	assert.Error(t, err)
+	c.X["x-batch"] = map[string]interface{}{"main": "sidekiq"}
+	main, err = c.guessMainContainer()
+	assert.NoError(t, err)
+	assert.Equal(t, "sidekiq", main)
+	c.X["x-batch"] = map[string]interface{}{"main": "worker"}
+	_, err = c.guessMainContainer()
+	assert.Error(t, err)
+}
+
 func TestUnfindableMain(t *testing.T) {
 	cc := NewCompose()
 	err := yaml.Unmarshal([]byte(withAmbiguousDeps), &cc)
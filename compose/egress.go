@@ -0,0 +1,350 @@
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Egress modes of a task network
+const (
+	EgressOpen    = "open"    // Unrestricted, the default
+	EgressOffline = "offline" // Internal network, nothing goes outside
+	EgressAllow   = "allow"   // Only to the allowed CIDRs and hosts
+)
+
+// Labels of a task network, with its egress policy
+const (
+	EgressLabel      = "batch.egress"
+	EgressAllowLabel = "batch.egress.allow"
+)
+
+// EgressPolicy of a task network
+type EgressPolicy struct {
+	Mode  string   `json:"mode" yaml:"mode"`
+	Allow []string `json:"allow,omitempty" yaml:"allow,omitempty"` // CIDRs or hosts, resolved when the network is created
+}
+
+// egressPolicyOf a config, a mode, or a map with the mode and the allow list
+func egressPolicyOf(raw interface{}) (*EgressPolicy, error) {
+	p := &EgressPolicy{}
+	switch v := raw.(type) {
+	case string:
+		p.Mode = v
+	case map[string]interface{}:
+		p.Mode, _ = v["mode"].(string)
+		if allow, ok := v["allow"]; ok {
+			var err error
+			p.Allow, err = stringList(allow)
+			if err != nil {
+				return nil, fmt.Errorf("egress allow : %v", err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("egress is a mode or a map : %v", raw)
+	}
+	switch p.Mode {
+	case EgressOpen, EgressOffline:
+		if len(p.Allow) > 0 {
+			return nil, fmt.Errorf("egress %s doesn't allow anything", p.Mode)
+		}
+	case EgressAllow:
+		for _, a := range p.Allow {
+			if strings.Contains(a, "/") {
+				if _, _, err := net.ParseCIDR(a); err != nil {
+					return nil, fmt.Errorf("egress allow : %v", err)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown egress mode %s", p.Mode)
+	}
+	return p, nil
+}
+
+// egressPolicies by owner, * for the others, or a policy for all
+func egressPolicies(raw interface{}) (map[string]*EgressPolicy, error) {
+	if m, ok := raw.(map[string]interface{}); ok {
+		if _, ok := m["mode"]; !ok {
+			policies := make(map[string]*EgressPolicy)
+			for owner, v := range m {
+				p, err := egressPolicyOf(v)
+				if err != nil {
+					return nil, fmt.Errorf("egress of %s : %v", owner, err)
+				}
+				policies[owner] = p
+			}
+			return policies, nil
+		}
+	}
+	p, err := egressPolicyOf(raw)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]*EgressPolicy{"*": p}, nil
+}
+
+// egress asked by the compose, with x-batch.egress
+func (c *Compose) egress() (*EgressPolicy, error) {
+	x, ok := c.X["x-batch"].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	raw, ok := x["egress"]
+	if !ok {
+		return nil, nil
+	}
+	p, err := egressPolicyOf(raw)
+	if err != nil {
+		return nil, fmt.Errorf("x-batch.egress : %v", err)
+	}
+	return p, nil
+}
+
+// within tells if the policy is as strict as another one, a task can only narrow the policy of its owner
+func (p *EgressPolicy) within(other *EgressPolicy) bool {
+	if other == nil || other.Mode == EgressOpen || p.Mode == EgressOffline {
+		return true
+	}
+	if p.Mode != other.Mode {
+		return false
+	}
+	for _, a := range p.Allow {
+		if !other.allows(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// allows an entry, the same host, or a CIDR inside an allowed one
+func (p *EgressPolicy) allows(entry string) bool {
+	_, cidr, err := net.ParseCIDR(entry)
+	for _, a := range p.Allow {
+		if a == entry {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		_, allowed, err := net.ParseCIDR(a)
+		if err != nil {
+			continue
+		}
+		ones, _ := cidr.Mask.Size()
+		allowedOnes, _ := allowed.Mask.Size()
+		if allowed.Contains(cidr.IP) && ones >= allowedOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupIP resolves the allowed hosts
+var lookupIP = net.LookupIP
+
+// networks of the allow list, the hosts are resolved now, IPv6 addresses only for dual stack networks
+func (p *EgressPolicy) networks(ipv6 bool) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(p.Allow))
+	for _, a := range p.Allow {
+		if strings.Contains(a, "/") {
+			_, cidr, err := net.ParseCIDR(a)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, cidr)
+			continue
+		}
+		ips, err := lookupIP(a)
+		if err != nil {
+			return nil, fmt.Errorf("egress allow %s : %v", a, err)
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				networks = append(networks, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else if ipv6 {
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+		}
+	}
+	return networks, nil
+}
+
+// labels of the network with this policy
+func (p *EgressPolicy) labels() map[string]string {
+	if p == nil {
+		return map[string]string{EgressLabel: EgressOpen}
+	}
+	labels := map[string]string{EgressLabel: p.Mode}
+	if p.Mode == EgressAllow {
+		labels[EgressAllowLabel] = strings.Join(p.Allow, ",")
+	}
+	return labels
+}
+
+// Firewall restricts what goes out of a bridge, IPv6 too for a dual stack bridge
+type Firewall interface {
+	Restrict(bridge string, allowed []*net.IPNet, ipv6 bool) error
+	Release(bridge string) error
+}
+
+var (
+	firewall     Firewall = &IPTables{Path: "iptables", Path6: "ip6tables"}
+	firewallLock sync.Mutex
+)
+
+// UseFirewall sets the firewall of the allow egress policies
+func UseFirewall(f Firewall) {
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+	firewall = f
+}
+
+func currentFirewall() Firewall {
+	firewallLock.Lock()
+	defer firewallLock.Unlock()
+	return firewall
+}
+
+// bridgeOf a Docker network, named from its id
+func bridgeOf(id string) string {
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return "br-" + id
+}
+
+// releaseEgress removes the firewall rules of a network, before removing it
+func releaseEgress(network types.NetworkResource) error {
+	if network.Labels[EgressLabel] != EgressAllow {
+		return nil
+	}
+	err := currentFirewall().Release(bridgeOf(network.ID))
+	if err != nil {
+		return fmt.Errorf("egress of %s : %v", network.Name, err)
+	}
+	return nil
+}
+
+// IPTables firewall, each bridge has its chain, jumped to from DOCKER-USER and INPUT.
+// Established connections, and the allowed networks return, everything else is rejected.
+// ip6tables rules are jumped to from FORWARD, Docker doesn't always have an IPv6 DOCKER-USER chain.
+type IPTables struct {
+	Path  string
+	Path6 string
+}
+
+func runIPTables(path string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, append([]string{"-w"}, args...)...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s %s : %v %s", path, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func chainOf(bridge string) string {
+	return "DENSITY-" + strings.TrimPrefix(bridge, "br-")
+}
+
+// jumps to the chain of the bridge, the containers of the bridge can talk together
+func jumps(bridge string, ipv6 bool) [][]string {
+	forward := "DOCKER-USER"
+	if ipv6 {
+		forward = "FORWARD"
+	}
+	return [][]string{
+		{forward, "-i", bridge, "!", "-o", bridge, "-j", chainOf(bridge)},
+		{"INPUT", "-i", bridge, "-j", chainOf(bridge)},
+	}
+}
+
+// Restrict the bridge to the allowed networks
+func (i *IPTables) Restrict(bridge string, allowed []*net.IPNet, ipv6 bool) error {
+	err := i.restrict(i.Path, bridge, allowed, false)
+	if err != nil || !ipv6 {
+		return err
+	}
+	err = i.restrict(i.Path6, bridge, allowed, true)
+	if err != nil {
+		i.release(i.Path, bridge, false)
+	}
+	return err
+}
+
+func (i *IPTables) restrict(path, bridge string, allowed []*net.IPNet, ipv6 bool) error {
+	chain := chainOf(bridge)
+	rules := [][]string{
+		{"-N", chain},
+		{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	for _, a := range allowed {
+		if (a.IP.To4() == nil) == ipv6 {
+			rules = append(rules, []string{"-A", chain, "-d", a.String(), "-j", "RETURN"})
+		}
+	}
+	rules = append(rules, []string{"-A", chain, "-j", "REJECT"})
+	for _, jump := range jumps(bridge, ipv6) {
+		rules = append(rules, append([]string{"-I"}, jump...))
+	}
+	for _, rule := range rules {
+		err := runIPTables(path, rule...)
+		if err != nil {
+			i.release(path, bridge, ipv6)
+			return err
+		}
+	}
+	return nil
+}
+
+// Release the bridge, its chains are removed
+func (i *IPTables) Release(bridge string) error {
+	err := i.release(i.Path, bridge, false)
+	if err != nil || i.Path6 == "" {
+		return err
+	}
+	return i.release(i.Path6, bridge, true)
+}
+
+func (i *IPTables) release(path, bridge string, ipv6 bool) error {
+	chain := chainOf(bridge)
+	if runIPTables(path, "-n", "-L", chain) != nil {
+		// nothing to release
+		return nil
+	}
+	for _, jump := range jumps(bridge, ipv6) {
+		// a jump can be missing, after a failed restriction
+		runIPTables(path, append([]string{"-D"}, jump...)...)
+	}
+	err := runIPTables(path, "-F", chain)
+	if err != nil {
+		return err
+	}
+	return runIPTables(path, "-X", chain)
+}
+
+// restrictEgress applies the policy to a new network, the offline one is already internal
+func restrictEgress(id string, policy *EgressPolicy, ipv6 bool) error {
+	if policy == nil || policy.Mode != EgressAllow {
+		return nil
+	}
+	allowed, err := policy.networks(ipv6)
+	if err != nil {
+		return err
+	}
+	bridge := bridgeOf(id)
+	err = currentFirewall().Restrict(bridge, allowed, ipv6)
+	if err != nil {
+		return err
+	}
+	log.WithField("bridge", bridge).WithField("allowed", allowed).Info("Egress restricted")
+	return nil
+}
@@ -0,0 +1,217 @@
+package compose
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/factorysh/density/store"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+type fakeFirewall struct {
+	restricted map[string][]string
+	released   []string
+	fail       error
+}
+
+func (f *fakeFirewall) Restrict(bridge string, allowed []*net.IPNet, ipv6 bool) error {
+	if f.fail != nil {
+		return f.fail
+	}
+	nets := make([]string, len(allowed))
+	for i, a := range allowed {
+		nets[i] = a.String()
+	}
+	f.restricted[bridge] = nets
+	return nil
+}
+
+func (f *fakeFirewall) Release(bridge string) error {
+	f.released = append(f.released, bridge)
+	return nil
+}
+
+func TestEgressPolicy(t *testing.T) {
+	owner, err := egressPolicyOf(map[string]interface{}{
+		"mode":  "allow",
+		"allow": []interface{}{"10.0.0.0/8", "pypi.org"},
+	})
+	assert.NoError(t, err)
+	for raw, within := range map[string]bool{
+		"{mode: offline}":                                 true,
+		"{mode: allow, allow: [pypi.org]}":                true,
+		"{mode: allow, allow: [10.1.0.0/16]}":             true,
+		"{mode: allow, allow: [0.0.0.0/0]}":               false,
+		"{mode: allow, allow: [github.com]}":              false,
+		"{mode: open}":                                    false,
+		"{mode: allow, allow: [10.0.0.0/8, 10.2.3.4/32]}": true,
+	} {
+		var v interface{}
+		assert.NoError(t, yaml.Unmarshal([]byte(raw), &v))
+		p, err := egressPolicyOf(v)
+		assert.NoError(t, err, raw)
+		assert.Equal(t, within, p.within(owner), raw)
+		assert.True(t, p.within(nil), raw)
+	}
+	for _, raw := range []interface{}{
+		"closed",
+		42,
+		map[string]interface{}{"mode": "offline", "allow": []interface{}{"pypi.org"}},
+		map[string]interface{}{"mode": "allow", "allow": []interface{}{"10.0.0.0/42"}},
+	} {
+		_, err := egressPolicyOf(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestRecomposeEgress(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	fw := &fakeFirewall{restricted: make(map[string][]string)}
+	UseFirewall(fw)
+	defer UseFirewall(&IPTables{Path: "iptables", Path6: "ip6tables"})
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "pypi.org" {
+			return []net.IP{net.ParseIP("151.101.0.223"), net.ParseIP("2a04:4e42::223")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	r, err := NewRecomposator(docker, map[string]interface{}{
+		"Egress": map[string]interface{}{
+			"alice": map[string]interface{}{
+				"mode":  "allow",
+				"allow": []interface{}{"10.0.0.0/8", "pypi.org"},
+			},
+			"*": "offline",
+		},
+	})
+	assert.NoError(t, err)
+	c := NewCompose()
+	c.Services["hello"] = map[string]interface{}{"image": "busybox:1.33"}
+
+	_, err = r.Recompose("bob", "alice", c)
+	assert.NoError(t, err)
+	assert.Len(t, fake.networks, 1)
+	assert.False(t, fake.networks[0].Internal)
+	assert.Equal(t, "allow", fake.networks[0].Labels[EgressLabel])
+	assert.Equal(t, "10.0.0.0/8,pypi.org", fake.networks[0].Labels[EgressAllowLabel])
+	assert.Equal(t, map[string][]string{"br-network": {"10.0.0.0/8", "151.101.0.223/32"}}, fw.restricted)
+
+	_, err = r.Recompose("bob", "carol", c)
+	assert.NoError(t, err)
+	assert.True(t, fake.networks[1].Internal)
+	assert.Equal(t, "offline", fake.networks[1].Labels[EgressLabel])
+
+	// a task can narrow the policy of its owner, not widen it
+	c.X["x-batch"] = map[string]interface{}{"egress": "offline"}
+	_, err = r.Recompose("bob", "alice", c)
+	assert.NoError(t, err)
+	assert.True(t, fake.networks[2].Internal)
+	c.X["x-batch"] = map[string]interface{}{"egress": "open"}
+	_, err = r.Recompose("bob", "carol", c)
+	assert.Error(t, err)
+	assert.Len(t, fake.networks, 3)
+
+	ledger := NewLedger(store.NewMemoryStore())
+	err = Remove(docker, ledger, Resource{Kind: NetworkResource, ID: "network", Egress: EgressAllow})
+	assert.NoError(t, err)
+	err = Remove(docker, ledger, Resource{Kind: NetworkResource, ID: "other", Egress: EgressOffline})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"br-network"}, fw.released)
+}
+
+func TestRestrictEgressFailure(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	UseFirewall(&fakeFirewall{restricted: make(map[string][]string), fail: errors.New("no iptables")})
+	defer UseFirewall(&IPTables{Path: "iptables", Path6: "ip6tables"})
+
+	ledger := NewLedger(store.NewMemoryStore())
+	n := NewNetworks(docker, ledger)
+	_, err := n.New("bob", &EgressPolicy{Mode: EgressAllow, Allow: []string{"10.0.0.0/8"}})
+	assert.Error(t, err)
+	assert.Contains(t, fake.calls, "DELETE /networks/network")
+	// the network is removed, its subnets are free again
+	lease, err := ledger.Get("bob")
+	assert.NoError(t, err)
+	assert.Nil(t, lease)
+}
+
+func TestIPTables(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "iptables-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	calls := path.Join(dir, "calls")
+	bin := path.Join(dir, "iptables")
+	// the chain doesn't exist before being created
+	err = ioutil.WriteFile(bin, []byte(fmt.Sprintf(`#!/bin/sh
+echo "$@" >> %s
+if [ "$2" = "-n" ] && [ ! -f %s/created ]; then exit 1; fi
+if [ "$2" = "-N" ]; then touch %s/created; fi
+`, calls, dir, dir)), 0755)
+	assert.NoError(t, err)
+	ipt := &IPTables{Path: bin}
+
+	assert.NoError(t, ipt.Release("br-0123456789ab"))
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/8")
+	assert.NoError(t, ipt.Restrict("br-0123456789ab", []*net.IPNet{cidr}, false))
+	assert.NoError(t, ipt.Release("br-0123456789ab"))
+	out, err := ioutil.ReadFile(calls)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-w -n -L DENSITY-0123456789ab",
+		"-w -N DENSITY-0123456789ab",
+		"-w -A DENSITY-0123456789ab -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-w -A DENSITY-0123456789ab -d 10.0.0.0/8 -j RETURN",
+		"-w -A DENSITY-0123456789ab -j REJECT",
+		"-w -I DOCKER-USER -i br-0123456789ab ! -o br-0123456789ab -j DENSITY-0123456789ab",
+		"-w -I INPUT -i br-0123456789ab -j DENSITY-0123456789ab",
+		"-w -n -L DENSITY-0123456789ab",
+		"-w -D DOCKER-USER -i br-0123456789ab ! -o br-0123456789ab -j DENSITY-0123456789ab",
+		"-w -D INPUT -i br-0123456789ab -j DENSITY-0123456789ab",
+		"-w -F DENSITY-0123456789ab",
+		"-w -X DENSITY-0123456789ab",
+	}, strings.Split(strings.TrimSpace(string(out)), "\n"))
+}
+
+func TestRecomposePools(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	r, err := NewRecomposator(docker, map[string]interface{}{
+		"Pools": []interface{}{
+			map[string]interface{}{"range": "10.200.0.0/16", "size": 26},
+			"fd12:3456:789a::/48",
+		},
+	})
+	assert.NoError(t, err)
+	c := NewCompose()
+	c.Services["hello"] = map[string]interface{}{"image": "busybox:1.33"}
+	_, err = r.Recompose("bob", "alice", c)
+	assert.NoError(t, err)
+	assert.Len(t, fake.networks, 1)
+	assert.True(t, fake.networks[0].EnableIPv6)
+	subnets := make([]string, 0)
+	for _, config := range fake.networks[0].IPAM.Config {
+		subnets = append(subnets, config.Subnet)
+	}
+	assert.Equal(t, []string{"10.200.0.0/26", "fd12:3456:789a::/64"}, subnets)
+
+	for _, pools := range []interface{}{
+		"10.200.0.0/16",
+		[]interface{}{"fd12:3456:789a::/48"},
+		[]interface{}{map[string]interface{}{"range": "10.200.0.0/16", "size": "24"}},
+		[]interface{}{"10.200.0.0/16", "10.200.0.0/24"},
+	} {
+		_, err = NewRecomposator(docker, map[string]interface{}{"Pools": pools})
+		assert.Error(t, err, pools)
+	}
+}
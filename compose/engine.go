@@ -0,0 +1,695 @@
+package compose
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// Engine steps
+const (
+	ConfigStep  = "config"
+	PullStep    = "pull"
+	NetworkStep = "network"
+	VolumeStep  = "volume"
+	CreateStep  = "create"
+	StartStep   = "start"
+)
+
+// EngineError is a failed step of the engine, for a service or for the project
+type EngineError struct {
+	Step    string
+	Service string
+	Err     error
+}
+
+func (e *EngineError) Error() string {
+	if e.Service == "" {
+		return fmt.Sprintf("%s : %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("%s of service %s : %v", e.Step, e.Service, e.Err)
+}
+
+func (e *EngineError) Unwrap() error {
+	return e.Err
+}
+
+// engineKeys are the service keys handled by the engine
+var engineKeys = map[string]bool{
+	"image":        true,
+	"command":      true,
+	"entrypoint":   true,
+	"environment":  true,
+	"working_dir":  true,
+	"user":         true,
+	"labels":       true,
+	"volumes":      true,
+	"depends_on":   true,
+	"healthcheck":  true,
+	"read_only":    true,
+	"tmpfs":        true,
+	"security_opt": true,
+	"cap_drop":     true,
+	"networks":     true,
+}
+
+// Engine turns a Compose into Docker API calls
+type Engine struct {
+	docker    *client.Client
+	upTimeout time.Duration
+}
+
+// DefaultUpTimeout bounds the pulls, and the creations, of an up
+const DefaultUpTimeout = 10 * time.Minute
+
+// NewEngine returns an engine using this Docker client
+func NewEngine(docker *client.Client) *Engine {
+	return &Engine{
+		docker:    docker,
+		upTimeout: DefaultUpTimeout,
+	}
+}
+
+// UseUpTimeout bounds the ups, a stuck registry doesn't block the scheduler
+func (e *Engine) UseUpTimeout(timeout time.Duration) {
+	e.upTimeout = timeout
+}
+
+// service is a service, ready to be created
+type service struct {
+	name    string
+	config  *container.Config
+	host    *container.HostConfig
+	aliases []string // On the network of the project, with the name
+}
+
+// Validate that the engine can run this project
+func (e *Engine) Validate(c *Compose) error {
+	_, err := e.order(c)
+	if err != nil {
+		return err
+	}
+	return c.WalkServices(func(name string, value map[string]interface{}) error {
+		_, err := e.service("validate", name, value, "/")
+		return err
+	})
+}
+
+// order of the services, dependencies first
+func (e *Engine) order(c *Compose) ([]string, error) {
+	names := make([]string, 0, len(c.Services))
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	order, err := c.NewServiceGraph().Order(names)
+	if err != nil {
+		return nil, &EngineError{Step: ConfigStep, Err: err}
+	}
+	return order, nil
+}
+
+// Up creates the network, the volumes and the containers of the project, then starts them,
+// dependencies first. A failure rolls back the containers, the network and the volumes it created,
+// the pulled images are kept, other projects may use them.
+// The compose is resolved, by the recomposator or by Compose.Up.
+func (e *Engine) Up(c *Compose, project, workingDirectory string, environments map[string]string, runID int) (*DockerRun, error) {
+	if !c.Resolved {
+		return nil, &EngineError{Step: ConfigStep, Err: errors.New("the compose is not resolved")}
+	}
+	main, err := c.guessMainContainer()
+	if err != nil {
+		return nil, &EngineError{Step: ConfigStep, Err: err}
+	}
+	startTimeout, err := c.startTimeout()
+	if err != nil {
+		return nil, &EngineError{Step: ConfigStep, Err: err}
+	}
+	// the main container is started by Wait, when its dependencies are healthy
+	health := c.healthDeps(main)
+	order, err := e.order(c)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*service, len(order))
+	for i, name := range order {
+		value, ok := c.Services[name].(map[string]interface{})
+		if !ok {
+			return nil, &EngineError{Step: ConfigStep, Service: name, Err: fmt.Errorf("not a map %v", c.Services[name])}
+		}
+		services[i], err = e.service(project, name, value, workingDirectory)
+		if err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), e.upTimeout)
+	defer cancel()
+	networkName, err := e.network(ctx, project, c)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := e.volumes(ctx, project, c)
+	if err != nil {
+		e.rollback(project, volumes)
+		return nil, err
+	}
+	ids := make(map[string]string)
+	for _, s := range services {
+		err := e.pull(ctx, s)
+		if err != nil {
+			e.rollback(project, volumes)
+			return nil, err
+		}
+		created, err := e.docker.ContainerCreate(ctx, s.config, s.host, &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				networkName: {
+					Aliases: append([]string{s.name}, s.aliases...),
+				},
+			},
+		}, fmt.Sprintf("%s_%s_1", project, s.name))
+		if err != nil {
+			e.rollback(project, volumes)
+			return nil, &EngineError{Step: CreateStep, Service: s.name, Err: err}
+		}
+		ids[s.name] = created.ID
+		if s.name == main && len(health) > 0 {
+			continue
+		}
+		err = e.docker.ContainerStart(ctx, created.ID, types.ContainerStartOptions{})
+		if err != nil {
+			e.rollback(project, volumes)
+			return nil, &EngineError{Step: StartStep, Service: s.name, Err: err}
+		}
+	}
+	return &DockerRun{
+		Path:         workingDirectory,
+		Project:      project,
+		ID:           runID,
+		RID:          ids[main],
+		Start:        start,
+		Running:      true,
+		Engine:       true,
+		Health:       health,
+		StartTimeout: startTimeout,
+	}, nil
+}
+
+// service translates a compose service to a container config
+func (e *Engine) service(project, name string, value map[string]interface{}, workingDirectory string) (*service, error) {
+	fail := func(err error) (*service, error) {
+		return nil, &EngineError{Step: ConfigStep, Service: name, Err: err}
+	}
+	unknown := make([]string, 0)
+	for k := range value {
+		if !engineKeys[k] && !strings.HasPrefix(k, "x-") {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fail(fmt.Errorf("unsupported keys %s", strings.Join(unknown, ", ")))
+	}
+	image, ok := value["image"].(string)
+	if !ok || image == "" {
+		return fail(fmt.Errorf("an image is mandatory"))
+	}
+	config := &container.Config{
+		Image: image,
+		Labels: map[string]string{
+			"com.docker.compose.project":          project,
+			"com.docker.compose.service":          name,
+			"com.docker.compose.container-number": "1",
+			"com.docker.compose.oneoff":           "False",
+		},
+	}
+	var err error
+	if raw, ok := value["command"]; ok {
+		config.Cmd, err = commandOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("command : %v", err))
+		}
+	}
+	if raw, ok := value["entrypoint"]; ok {
+		config.Entrypoint, err = commandOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("entrypoint : %v", err))
+		}
+	}
+	if raw, ok := value["environment"]; ok {
+		env, err := mapOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("environment : %v", err))
+		}
+		for k, v := range env {
+			config.Env = append(config.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(config.Env)
+	}
+	if raw, ok := value["labels"]; ok {
+		labels, err := mapOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("labels : %v", err))
+		}
+		for k, v := range labels {
+			config.Labels[k] = v
+		}
+	}
+	if raw, ok := value["working_dir"]; ok {
+		config.WorkingDir = fmt.Sprint(raw)
+	}
+	if raw, ok := value["user"]; ok {
+		config.User = fmt.Sprint(raw)
+	}
+	if raw, ok := value["healthcheck"]; ok {
+		config.Healthcheck, err = healthcheckOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("healthcheck : %v", err))
+		}
+	}
+	host := &container.HostConfig{}
+	if raw, ok := value["volumes"]; ok {
+		volumes, ok := raw.([]string)
+		if !ok {
+			volumes, err = castVolumes(raw)
+			if err != nil {
+				return fail(err)
+			}
+		}
+		for _, volume := range volumes {
+			slugs := strings.Split(volume, ":")
+			if len(slugs) < 2 || len(slugs) > 3 {
+				return fail(fmt.Errorf("wrong volume format : %s", volume))
+			}
+			src := slugs[0]
+			if strings.HasPrefix(src, ".") {
+				src = filepath.Join(workingDirectory, src)
+			} else if !strings.HasPrefix(src, "/") {
+				// a named volume, of the project
+				src = fmt.Sprintf("%s_%s", project, src)
+			}
+			slugs[0] = src
+			host.Binds = append(host.Binds, strings.Join(slugs, ":"))
+		}
+	}
+	if raw, ok := value["read_only"]; ok {
+		host.ReadonlyRootfs, ok = raw.(bool)
+		if !ok {
+			return fail(fmt.Errorf("read_only is a boolean : %v", raw))
+		}
+	}
+	if raw, ok := value["tmpfs"]; ok {
+		tmpfs, err := oneOrMany(raw)
+		if err != nil {
+			return fail(fmt.Errorf("tmpfs : %v", err))
+		}
+		host.Tmpfs = make(map[string]string)
+		for _, t := range tmpfs {
+			slugs := strings.SplitN(t, ":", 2)
+			if len(slugs) == 1 {
+				slugs = append(slugs, "")
+			}
+			host.Tmpfs[slugs[0]] = slugs[1]
+		}
+	}
+	if raw, ok := value["cap_drop"]; ok {
+		host.CapDrop, err = oneOrMany(raw)
+		if err != nil {
+			return fail(fmt.Errorf("cap_drop : %v", err))
+		}
+	}
+	if raw, ok := value["security_opt"]; ok {
+		opts, err := oneOrMany(raw)
+		if err != nil {
+			return fail(fmt.Errorf("security_opt : %v", err))
+		}
+		for _, opt := range opts {
+			opt, err = securityOpt(opt, workingDirectory)
+			if err != nil {
+				return fail(fmt.Errorf("security_opt : %v", err))
+			}
+			if opt != "" {
+				host.SecurityOpt = append(host.SecurityOpt, opt)
+			}
+		}
+	}
+	aliases := make([]string, 0)
+	if raw, ok := value["networks"]; ok {
+		// all the networks are the one of the project, like the recomposator does
+		networks, err := networksOf(raw)
+		if err != nil {
+			return fail(fmt.Errorf("networks : %v", err))
+		}
+		for _, a := range networks {
+			aliases = append(aliases, a...)
+		}
+		sort.Strings(aliases)
+	}
+	return &service{
+		name:    name,
+		config:  config,
+		host:    host,
+		aliases: aliases,
+	}, nil
+}
+
+// network of the project, the external default network, or a new one
+func (e *Engine) network(ctx context.Context, project string, c *Compose) (string, error) {
+	if name := externalDefault(c); name != "" {
+		return name, nil
+	}
+	name := fmt.Sprintf("%s_default", project)
+	_, err := e.docker.NetworkCreate(ctx, name, types.NetworkCreate{
+		CheckDuplicate: true,
+		Driver:         "bridge",
+		Labels: map[string]string{
+			"com.docker.compose.project": project,
+			"com.docker.compose.network": "default",
+		},
+	})
+	if err != nil {
+		return "", &EngineError{Step: NetworkStep, Err: err}
+	}
+	return name, nil
+}
+
+// externalDefault is the name of the external default network, if any
+func externalDefault(c *Compose) string {
+	def, ok := c.Networks["default"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	external, ok := def["external"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	name, _ := external["name"].(string)
+	return name
+}
+
+// volumes of the project, named after it, the created ones are returned, the existing ones are kept
+func (e *Engine) volumes(ctx context.Context, project string, c *Compose) ([]string, error) {
+	created := make([]string, 0)
+	for _, name := range sortedKeys(c.Volumes) {
+		volume := fmt.Sprintf("%s_%s", project, name)
+		_, err := e.docker.VolumeInspect(ctx, volume)
+		if err == nil {
+			continue
+		}
+		if !client.IsErrNotFound(err) {
+			return created, &EngineError{Step: VolumeStep, Err: fmt.Errorf("%s : %v", name, err)}
+		}
+		_, err = e.docker.VolumeCreate(ctx, volumetypes.VolumesCreateBody{
+			Name: volume,
+			Labels: map[string]string{
+				"com.docker.compose.project": project,
+				"com.docker.compose.volume":  name,
+			},
+		})
+		if err != nil {
+			return created, &EngineError{Step: VolumeStep, Err: fmt.Errorf("%s : %v", name, err)}
+		}
+		created = append(created, volume)
+	}
+	return created, nil
+}
+
+// pull the image of a service, if it's missing
+func (e *Engine) pull(ctx context.Context, s *service) error {
+	_, _, err := e.docker.ImageInspectWithRaw(ctx, s.config.Image)
+	if err == nil {
+		return nil
+	}
+	if !client.IsErrNotFound(err) {
+		return &EngineError{Step: PullStep, Service: s.name, Err: err}
+	}
+	progress, err := e.docker.ImagePull(ctx, s.config.Image, types.ImagePullOptions{})
+	if err != nil {
+		return &EngineError{Step: PullStep, Service: s.name, Err: err}
+	}
+	defer progress.Close()
+	_, err = io.Copy(ioutil.Discard, progress)
+	if err != nil {
+		return &EngineError{Step: PullStep, Service: s.name, Err: err}
+	}
+	return nil
+}
+
+// rollback a failed up : its containers and its network, then the volumes it created
+func (e *Engine) rollback(project string, volumes []string) {
+	l := log.WithField("project", project)
+	err := e.Down(project)
+	if err != nil {
+		l.WithError(err).Error("Engine rollback")
+	}
+	ctx := context.TODO()
+	for _, volume := range volumes {
+		err = e.docker.VolumeRemove(ctx, volume, true)
+		if err != nil {
+			l.WithError(err).WithField("volume", volume).Error("Engine rollback")
+		}
+	}
+}
+
+// Down removes the containers and the network of a project, like `docker-compose down`
+func (e *Engine) Down(project string) error {
+	ctx := context.TODO()
+	label := filters.KeyValuePair{Key: "label", Value: fmt.Sprintf("com.docker.compose.project=%s", project)}
+	containers, err := e.docker.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(label),
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range containers {
+		err = e.docker.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return err
+		}
+	}
+	// the external network is not labeled with the project
+	networks, err := e.docker.NetworkList(ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(label),
+	})
+	if err != nil {
+		return err
+	}
+	for _, n := range networks {
+		err = e.docker.NetworkRemove(ctx, n.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandOf a string, split like a shell does, or a list
+func commandOf(raw interface{}) ([]string, error) {
+	switch value := raw.(type) {
+	case string:
+		return splitCommand(value)
+	case []interface{}:
+		cmd := make([]string, len(value))
+		for i, v := range value {
+			cmd[i] = fmt.Sprint(v)
+		}
+		return cmd, nil
+	case []string:
+		return value, nil
+	}
+	return nil, fmt.Errorf("not a string or a list : %v", raw)
+}
+
+// healthcheckOf translates a compose healthcheck
+func healthcheckOf(raw interface{}) (*container.HealthConfig, error) {
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a map %v", raw)
+	}
+	if disable, _ := data["disable"].(bool); disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+	health := &container.HealthConfig{}
+	switch test := data["test"].(type) {
+	case nil:
+	case string:
+		health.Test = []string{"CMD-SHELL", test}
+	case []interface{}:
+		for _, t := range test {
+			health.Test = append(health.Test, fmt.Sprint(t))
+		}
+	default:
+		return nil, fmt.Errorf("test is not a string or a list %v", test)
+	}
+	for key, d := range map[string]*time.Duration{
+		"interval":     &health.Interval,
+		"timeout":      &health.Timeout,
+		"start_period": &health.StartPeriod,
+	} {
+		raw, ok := data[key]
+		if !ok {
+			continue
+		}
+		duration, err := time.ParseDuration(fmt.Sprint(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s : %v", key, err)
+		}
+		*d = duration
+	}
+	if raw, ok := data["retries"]; ok {
+		retries, err := intOf(raw)
+		if err != nil {
+			return nil, fmt.Errorf("retries : %v", err)
+		}
+		health.Retries = retries
+	}
+	return health, nil
+}
+
+// intOf a number, or a string, like an interpolated one
+func intOf(raw interface{}) (int, error) {
+	switch value := raw.(type) {
+	case int:
+		return value, nil
+	case float64:
+		// from JSON
+		if value != float64(int(value)) {
+			return 0, fmt.Errorf("not an int %v", value)
+		}
+		return int(value), nil
+	case string:
+		return strconv.Atoi(strings.TrimSpace(value))
+	}
+	return 0, fmt.Errorf("not an int %v", raw)
+}
+
+// mapOf a map, or a list of key=value
+func mapOf(raw interface{}) (map[string]string, error) {
+	m := make(map[string]string)
+	switch value := raw.(type) {
+	case map[string]string:
+		return value, nil
+	case map[string]interface{}:
+		for k, v := range value {
+			if v == nil {
+				m[k] = ""
+			} else {
+				m[k] = fmt.Sprint(v)
+			}
+		}
+		return m, nil
+	case []interface{}:
+		for _, v := range value {
+			kv := strings.SplitN(fmt.Sprint(v), "=", 2)
+			if len(kv) == 1 {
+				m[kv[0]] = ""
+			} else {
+				m[kv[0]] = kv[1]
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("not a map or a list : %v", raw)
+}
+
+// oneOrMany strings, a string or a list
+func oneOrMany(raw interface{}) ([]string, error) {
+	if txt, ok := raw.(string); ok {
+		return []string{txt}, nil
+	}
+	return stringList(raw)
+}
+
+// securityOpt translates a compose security option to the API one, a seccomp profile is read like the CLI does
+func securityOpt(opt, workingDirectory string) (string, error) {
+	kv := strings.SplitN(opt, ":", 2)
+	if len(kv) == 1 {
+		kv = strings.SplitN(opt, "=", 2)
+	}
+	switch {
+	case kv[0] == "no-new-privileges":
+		if len(kv) == 2 && kv[1] == "false" {
+			return "", nil
+		}
+		return "no-new-privileges", nil
+	case len(kv) == 1:
+		return "", fmt.Errorf("wrong security option %s", opt)
+	case kv[0] == "seccomp" && kv[1] != "unconfined":
+		path := kv[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workingDirectory, path)
+		}
+		profile, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		var compact bytes.Buffer
+		err = json.Compact(&compact, profile)
+		if err != nil {
+			return "", fmt.Errorf("seccomp profile %s : %v", kv[1], err)
+		}
+		return "seccomp=" + compact.String(), nil
+	}
+	return kv[0] + "=" + kv[1], nil
+}
+
+// splitCommand splits words like a shell, with quotes and backslashes
+func splitCommand(cmd string) ([]string, error) {
+	words := make([]string, 0)
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated command : %s", cmd)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,483 @@
+package compose
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+// fakeDocker is a Docker API, enough for the engine
+type fakeDocker struct {
+	lock       sync.Mutex
+	calls      []string
+	configs    map[string]container.Config
+	images     map[string]bool
+	failStart  string
+	failPull   string
+	stuckPull  string // Waits for the client to give up
+	containers []string
+	started    map[string]bool
+	health     map[string]string
+	networks   []types.NetworkCreateRequest
+	existing   []types.NetworkResource // Networks listed without filter
+	overlaps   map[string]bool         // Subnets used outside of Docker
+}
+
+var apiVersion = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	p := apiVersion.ReplaceAllString(r.URL.Path, "")
+	f.calls = append(f.calls, fmt.Sprintf("%s %s", r.Method, p))
+	w.Header().Set("content-type", "application/json")
+	switch {
+	case p == "/networks/create":
+		var create types.NetworkCreateRequest
+		err := json.NewDecoder(r.Body).Decode(&create)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if create.IPAM != nil {
+			for _, config := range create.IPAM.Config {
+				if f.overlaps[config.Subnet] {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(w, `{"message": "Pool overlaps with other one on this address space"}`)
+					return
+				}
+			}
+		}
+		f.networks = append(f.networks, create)
+		fmt.Fprint(w, `{"Id": "network"}`)
+	case strings.HasPrefix(p, "/networks/") && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case p == "/networks" && r.Method == http.MethodGet:
+		if r.URL.Query().Get("filters") != "" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		json.NewEncoder(w).Encode(f.existing)
+	case p == "/volumes/create":
+		fmt.Fprint(w, `{"Name": "volume"}`)
+	case strings.HasPrefix(p, "/volumes/") && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasPrefix(p, "/images/") && r.Method == http.MethodGet:
+		image := strings.TrimSuffix(strings.TrimPrefix(p, "/images/"), "/json")
+		if !f.images[image] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "no such image"}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	case p == "/images/create":
+		if r.URL.Query().Get("fromImage") == f.failPull {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"message": "no way"}`)
+			return
+		}
+		if r.URL.Query().Get("fromImage") == f.stuckPull {
+			<-r.Context().Done()
+			return
+		}
+		f.images[r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag")] = true
+		fmt.Fprint(w, `{"status": "pulled"}`)
+	case p == "/containers/create":
+		var config container.Config
+		err := json.NewDecoder(r.Body).Decode(&config)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		f.configs[name] = config
+		f.containers = append(f.containers, name)
+		fmt.Fprintf(w, `{"Id": "%s"}`, name)
+	case strings.HasSuffix(p, "/start"):
+		if strings.Contains(p, f.failStart) && f.failStart != "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"message": "no way"}`)
+			return
+		}
+		f.started[strings.TrimSuffix(strings.TrimPrefix(p, "/containers/"), "/start")] = true
+		w.WriteHeader(http.StatusNoContent)
+	case strings.HasSuffix(p, "/stop"):
+		w.WriteHeader(http.StatusNoContent)
+	case p == "/containers/json":
+		args, err := filters.FromParam(r.URL.Query().Get("filters"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		list := make([]string, 0, len(f.containers))
+		for _, c := range f.containers {
+			if args.MatchKVList("label", f.configs[c].Labels) {
+				list = append(list, fmt.Sprintf(`{"Id": "%s"}`, c))
+			}
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(list, ","))
+	case strings.HasPrefix(p, "/containers/") && strings.HasSuffix(p, "/json"):
+		name := strings.TrimSuffix(strings.TrimPrefix(p, "/containers/"), "/json")
+		state := types.ContainerState{Status: "created"}
+		if f.started[name] {
+			state.Status = "running"
+			state.Running = true
+		}
+		if health, ok := f.health[name]; ok {
+			state.Health = &types.Health{
+				Status: health,
+				Log:    []*types.HealthcheckResult{{Output: "nope\n"}},
+			}
+		}
+		json.NewEncoder(w).Encode(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{ID: name, State: &state},
+		})
+	case strings.HasPrefix(p, "/containers/") && r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"message": "unknown %s"}`, p)
+	}
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, *client.Client, func()) {
+	fake := &fakeDocker{
+		calls:   make([]string, 0),
+		configs: make(map[string]container.Config),
+		images:  map[string]bool{"busybox:latest": true},
+		started: make(map[string]bool),
+		health:  make(map[string]string),
+	}
+	ts := httptest.NewServer(fake)
+	docker, err := client.NewClient("tcp://"+strings.TrimPrefix(ts.URL, "http://"), "1.35", nil, nil)
+	assert.NoError(t, err)
+	return fake, docker, ts.Close
+}
+
+const engineCompose = `
+version: '3'
+services:
+  hello:
+    image: "alpine:${TAG}"
+    command: "sh -c 'sleep 5 && echo $$HOME'"
+    environment:
+      NAME: "$NAME"
+    volumes:
+      - ./data:/data:ro
+      - cache:/cache
+volumes:
+  cache:
+`
+
+// resolved compose, as the recomposator gives it to the engine
+func resolved(t *testing.T, c *Compose, environments map[string]string) *Compose {
+	r, err := c.Resolve(environments)
+	assert.NoError(t, err)
+	return r
+}
+
+func TestEngineUp(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(engineCompose), c)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir(os.TempDir(), "engine-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	project := path.Base(dir)
+
+	environments := map[string]string{"TAG": "3.14", "NAME": "bob"}
+	run, err := NewEngine(docker).Up(resolved(t, c, environments), path.Base(dir), dir, environments, 3)
+	assert.NoError(t, err)
+	name := fmt.Sprintf("%s_hello_1", project)
+	assert.Equal(t, name, run.RID)
+	assert.Equal(t, 3, run.ID)
+	assert.True(t, run.Engine)
+	assert.Equal(t, []string{
+		"POST /networks/create",
+		"GET /volumes/" + project + "_cache",
+		"POST /volumes/create",
+		"GET /images/alpine:3.14/json",
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/" + name + "/start",
+	}, fake.calls)
+	config := fake.configs[name]
+	assert.Equal(t, "alpine:3.14", config.Image)
+	assert.Equal(t, []string{"sh", "-c", "sleep 5 && echo $HOME"}, []string(config.Cmd))
+	assert.Equal(t, []string{"NAME=bob"}, config.Env)
+	assert.Equal(t, project, config.Labels["com.docker.compose.project"])
+	assert.Equal(t, "hello", config.Labels["com.docker.compose.service"])
+}
+
+func TestEngineUpTimeout(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	fake.stuckPull = "alpine"
+	c := NewCompose()
+	c.Services["hello"] = map[string]interface{}{
+		"image": "alpine:3.14",
+	}
+	engine := NewEngine(docker)
+	engine.UseUpTimeout(100 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		_, err := engine.Up(resolved(t, c, nil), "stuck", "/tmp/stuck", nil, 1)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var engineErr *EngineError
+		assert.True(t, errors.As(err, &engineErr))
+		assert.Equal(t, PullStep, engineErr.Step)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stuck registry blocks the up")
+	}
+}
+
+func TestEngineFailure(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	fake.failStart = "hello"
+	c := NewCompose()
+	c.Services["hello"] = map[string]interface{}{
+		"image": "busybox:latest",
+	}
+	c.Networks = map[string]interface{}{
+		"default": map[string]interface{}{
+			"external": map[string]interface{}{
+				"name": "batch-bob-0-0",
+			},
+		},
+	}
+	_, err := NewEngine(docker).Up(resolved(t, c, nil), "failure", "/tmp/failure", nil, 1)
+	var engineErr *EngineError
+	assert.True(t, errors.As(err, &engineErr))
+	assert.Equal(t, StartStep, engineErr.Step)
+	assert.Equal(t, "hello", engineErr.Service)
+	// no network to create, and rolled back
+	assert.Equal(t, []string{
+		"GET /images/busybox:latest/json",
+		"POST /containers/create",
+		"POST /containers/failure_hello_1/start",
+		"GET /containers/json",
+		"DELETE /containers/failure_hello_1",
+		"GET /networks",
+	}, fake.calls)
+
+	// a failed pull rolls back the volumes, the pulled images are kept
+	fake.calls = make([]string, 0)
+	fake.containers = nil
+	fake.failPull = "alpine"
+	c.Services["hello"] = map[string]interface{}{
+		"image":      "alpine:3.14",
+		"volumes":    []interface{}{"cache:/cache"},
+		"depends_on": []interface{}{"db"},
+	}
+	c.Services["db"] = map[string]interface{}{
+		"image": "postgres:13",
+	}
+	c.Volumes = map[string]interface{}{"cache": nil}
+	c.X["x-batch"] = map[string]interface{}{"main": "hello"}
+	_, err = NewEngine(docker).Up(resolved(t, c, nil), "failure", "/tmp/failure", nil, 1)
+	assert.True(t, errors.As(err, &engineErr))
+	assert.Equal(t, PullStep, engineErr.Step)
+	assert.Equal(t, "hello", engineErr.Service)
+	assert.Equal(t, []string{
+		"GET /volumes/failure_cache",
+		"POST /volumes/create",
+		"GET /images/postgres:13/json",
+		"POST /images/create",
+		"POST /containers/create",
+		"POST /containers/failure_db_1/start",
+		"GET /images/alpine:3.14/json",
+		"POST /images/create",
+		"GET /containers/json",
+		"DELETE /containers/failure_db_1",
+		"GET /networks",
+		"DELETE /volumes/failure_cache",
+	}, fake.calls)
+	delete(c.Services, "db")
+	delete(c.X, "x-batch")
+	c.Volumes = nil
+
+	c.Services["hello"] = map[string]interface{}{
+		"image":      "busybox:latest",
+		"privileged": true,
+	}
+	err = NewEngine(docker).Validate(c)
+	assert.True(t, errors.As(err, &engineErr))
+	assert.Equal(t, ConfigStep, engineErr.Step)
+	assert.Contains(t, err.Error(), "privileged")
+
+	// the networks are the one of the project, with their aliases
+	s, err := NewEngine(docker).service("failure", "hello", map[string]interface{}{
+		"image": "busybox:latest",
+		"networks": map[string]interface{}{
+			"default": map[string]interface{}{"aliases": []string{"greetings"}},
+			"back":    map[string]interface{}{"aliases": []string{"hi"}},
+		},
+	}, "/tmp/failure")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"greetings", "hi"}, s.aliases)
+	_, err = NewEngine(docker).service("failure", "hello", map[string]interface{}{
+		"image":    "busybox:latest",
+		"networks": map[string]interface{}{"back": map[string]interface{}{"ipv4_address": "10.0.0.1"}},
+	}, "/tmp/failure")
+	assert.Error(t, err)
+}
+
+func TestEngineSidecars(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	c := NewCompose()
+	c.Services["app"] = map[string]interface{}{
+		"image":      "busybox:latest",
+		"depends_on": []interface{}{"db"},
+	}
+	c.Services["db"] = map[string]interface{}{
+		"image": "busybox:latest",
+	}
+	run, err := NewEngine(docker).Up(resolved(t, c, nil), "sidecars", "/tmp/sidecars", nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "sidecars_app_1", run.RID)
+
+	fake.calls = make([]string, 0)
+	err = run.stopSidecars(docker)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"GET /containers/json",
+		"POST /containers/sidecars_db_1/stop",
+	}, fake.calls)
+}
+
+func TestEngineHealth(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	healthPoll = 10 * time.Millisecond
+	c := NewCompose()
+	c.Services["app"] = map[string]interface{}{
+		"image": "busybox:latest",
+		"depends_on": map[string]interface{}{
+			"db":    map[string]interface{}{"condition": "service_healthy"},
+			"cache": map[string]interface{}{"condition": "service_started"},
+		},
+	}
+	c.Services["db"] = map[string]interface{}{
+		"image": "busybox:latest",
+		"healthcheck": map[string]interface{}{
+			"test":     "pg_isready",
+			"interval": "1s",
+			"retries":  3,
+		},
+	}
+	c.Services["cache"] = map[string]interface{}{
+		"image": "busybox:latest",
+	}
+	run, err := NewEngine(docker).Up(resolved(t, c, nil), "health", "/tmp/health", nil, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db"}, run.Health)
+	assert.Equal(t, DefaultStartTimeout, run.StartTimeout)
+	assert.Equal(t, map[string]bool{"health_cache_1": true, "health_db_1": true}, fake.started)
+	assert.Equal(t, &container.HealthConfig{
+		Test:     []string{"CMD-SHELL", "pg_isready"},
+		Interval: time.Second,
+		Retries:  3,
+	}, fake.configs["health_db_1"].Healthcheck)
+
+	// never healthy
+	run.StartTimeout = 50 * time.Millisecond
+	fake.health["health_db_1"] = types.Starting
+	err = run.startMain(context.TODO(), docker)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"service db : not healthy after 50ms"}, run.Errors)
+
+	// canceled while waiting, it's not unhealthy
+	run.Errors = nil
+	run.StartTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = run.startMain(ctx, docker)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, run.Errors)
+
+	run.Errors = nil
+	fake.health["health_db_1"] = types.Unhealthy
+	err = run.startMain(context.TODO(), docker)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"service db : unhealthy : nope"}, run.Errors)
+	assert.Equal(t, run.Errors, run.Data().Errors)
+	assert.False(t, fake.started["health_app_1"])
+
+	run.Errors = nil
+	fake.health["health_db_1"] = types.Healthy
+	err = run.startMain(context.TODO(), docker)
+	assert.NoError(t, err)
+	assert.True(t, fake.started["health_app_1"])
+}
+
+func TestServiceOrder(t *testing.T) {
+	graph := ServiceGraph{
+		"app":    {"db", "cache"},
+		"worker": {"db"},
+	}
+	order, err := graph.Order([]string{"worker", "app", "db", "cache"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cache", "db", "app", "worker"}, order)
+
+	_, err = ServiceGraph{"app": {"db"}}.Order([]string{"app"})
+	assert.Error(t, err)
+	_, err = ServiceGraph{"a": {"b"}, "b": {"a"}}.Order([]string{"a", "b"})
+	assert.Error(t, err)
+}
+
+func TestSplitCommand(t *testing.T) {
+	for cmd, words := range map[string][]string{
+		"echo world":                 {"echo", "world"},
+		`sh -c 'sleep 1 && echo $A'`: {"sh", "-c", "sleep 1 && echo $A"},
+		`echo "a \"b\"" c\ d`:        {"echo", `a "b"`, "c d"},
+		"  ":                         {},
+	} {
+		split, err := splitCommand(cmd)
+		assert.NoError(t, err)
+		assert.Equal(t, words, split)
+	}
+	_, err := splitCommand(`echo "oops`)
+	assert.Error(t, err)
+}
+
+func TestHealthcheckRetries(t *testing.T) {
+	for raw, retries := range map[interface{}]int{
+		3:          3,
+		"3":        3,
+		" 3":       3,
+		float64(3): 3, // from JSON
+	} {
+		health, err := healthcheckOf(map[string]interface{}{"test": "true", "retries": raw})
+		assert.NoError(t, err, raw)
+		assert.Equal(t, retries, health.Retries, raw)
+	}
+	for _, raw := range []interface{}{"three", 2.5, true} {
+		_, err := healthcheckOf(map[string]interface{}{"test": "true", "retries": raw})
+		assert.Error(t, err, raw)
+	}
+}
@@ -3,8 +3,43 @@ package compose
 import (
 	"fmt"
 	"sort"
+	"strings"
 )
 
+// Conditions of a dependency, the short syntax has no condition
+const (
+	ServiceStarted = "service_started"
+	ServiceHealthy = "service_healthy"
+)
+
+// dependsOn returns the dependencies of a service, with their condition
+func dependsOn(value interface{}) map[string]string {
+	deps := make(map[string]string)
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return deps
+	}
+	switch raw := data["depends_on"].(type) {
+	case []interface{}:
+		for _, v := range raw {
+			if dep, ok := v.(string); ok {
+				deps[dep] = ""
+			}
+		}
+	case map[string]interface{}:
+		for dep, v := range raw {
+			condition := ServiceStarted
+			if m, ok := v.(map[string]interface{}); ok {
+				if c, ok := m["condition"].(string); ok {
+					condition = c
+				}
+			}
+			deps[dep] = condition
+		}
+	}
+	return deps
+}
+
 // NewServiceGraph generates a graph of deps from a compose description
 func (c Compose) NewServiceGraph() ServiceGraph {
 	// init graph
@@ -12,24 +47,14 @@ func (c Compose) NewServiceGraph() ServiceGraph {
 
 	// range over all services and populate the graph
 	for service, value := range c.Services {
-		data, ok := value.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		deps, ok := data["depends_on"].([]interface{})
-		if !ok {
+		deps := dependsOn(value)
+		if len(deps) == 0 {
 			continue
 		}
-
-		for _, value := range deps {
-			dep, ok := value.(string)
-			if !ok {
-				continue
-			}
+		for dep := range deps {
 			graph[service] = append(graph[service], dep)
 		}
-
+		sort.Strings(graph[service])
 	}
 
 	return graph
@@ -117,3 +142,49 @@ func (s ServiceGraph) serviceDepth(index string, memory ServiceDepth) int {
 
 	return childs
 }
+
+// Order the services, dependencies first, then by name
+func (s ServiceGraph) Order(services []string) ([]string, error) {
+	known := make(map[string]bool, len(services))
+	for _, service := range services {
+		known[service] = true
+	}
+	sorted := make([]string, len(services))
+	copy(sorted, services)
+	sort.Strings(sorted)
+	order := make([]string, 0, len(services))
+	// 0 unseen, 1 visiting, 2 done
+	state := make(map[string]int)
+	var visit func(service string, path []string) error
+	visit = func(service string, path []string) error {
+		switch state[service] {
+		case 1:
+			return fmt.Errorf("dependency cycle %s -> %s", strings.Join(path, " -> "), service)
+		case 2:
+			return nil
+		}
+		if !known[service] {
+			return fmt.Errorf("unknown service %s, a dependency of %s", service, path[len(path)-1])
+		}
+		state[service] = 1
+		deps := make([]string, len(s[service]))
+		copy(deps, s[service])
+		sort.Strings(deps)
+		for _, dep := range deps {
+			err := visit(dep, append(path, service))
+			if err != nil {
+				return err
+			}
+		}
+		state[service] = 2
+		order = append(order, service)
+		return nil
+	}
+	for _, service := range sorted {
+		err := visit(service, []string{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,125 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+)
+
+// appendList adds values to a list of a service, values already there are kept once
+func appendList(service map[string]interface{}, key string, values ...string) error {
+	list := make([]string, 0)
+	if raw, ok := service[key]; ok {
+		// tmpfs, cap_drop or security_opt can be a single string
+		if txt, ok := raw.(string); ok {
+			list = append(list, txt)
+		} else {
+			var err error
+			list, err = stringList(raw)
+			if err != nil {
+				return fmt.Errorf("%s : %v", key, err)
+			}
+			list = append([]string{}, list...)
+		}
+	}
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	service[key] = list
+	return nil
+}
+
+// PatchReadOnly makes the root filesystem read-only, these paths are writable tmpfs
+func PatchReadOnly(tmpfs []string) ServicePatcher {
+	return func(service map[string]interface{}) error {
+		service["read_only"] = true
+		return appendList(service, "tmpfs", tmpfs...)
+	}
+}
+
+// PatchNoNewPrivileges forbids gaining privileges, with setuid binaries
+func PatchNoNewPrivileges(service map[string]interface{}) error {
+	return appendList(service, "security_opt", "no-new-privileges:true")
+}
+
+// PatchCapDrop drops these capabilities, ALL for all of them
+func PatchCapDrop(caps []string) ServicePatcher {
+	return func(service map[string]interface{}) error {
+		return appendList(service, "cap_drop", caps...)
+	}
+}
+
+// PatchSecurityProfile forces a seccomp or apparmor profile, replacing the one of the service
+func PatchSecurityProfile(kind, profile string) (ServicePatcher, error) {
+	if kind != "seccomp" && kind != "apparmor" {
+		return nil, fmt.Errorf("unknown security profile %s", kind)
+	}
+	if profile == "" || profile == "unconfined" {
+		return nil, fmt.Errorf("a %s profile is mandatory", kind)
+	}
+	return func(service map[string]interface{}) error {
+		err := appendList(service, "security_opt")
+		if err != nil {
+			return err
+		}
+		opts := service["security_opt"].([]string)
+		kept := make([]string, 0, len(opts)+1)
+		for _, opt := range opts {
+			if !strings.HasPrefix(opt, kind+":") && !strings.HasPrefix(opt, kind+"=") {
+				kept = append(kept, opt)
+			}
+		}
+		service["security_opt"] = append(kept, fmt.Sprintf("%s:%s", kind, profile))
+		return nil
+	}, nil
+}
+
+// isRoot tells if a compose user, name or uid, with an optional group, is root
+func isRoot(user string) bool {
+	u := strings.SplitN(user, ":", 2)[0]
+	return u == "" || u == "root" || u == "0"
+}
+
+// patchUser forces the user of the owner, or the default one "*", when the service runs as root
+func (r *Recomposator) patchUser(owner string, service map[string]interface{}) error {
+	if len(r.users) == 0 {
+		return nil
+	}
+	if raw, ok := service["user"]; ok && !isRoot(fmt.Sprint(raw)) {
+		return nil
+	}
+	user, ok := r.users[owner]
+	if !ok {
+		user, ok = r.users["*"]
+	}
+	if !ok {
+		return fmt.Errorf("no user for the owner %s", owner)
+	}
+	service["user"] = user
+	return nil
+}
+
+// usersOf the User patch, a user for all, or users by owner
+func usersOf(v interface{}) (map[string]string, error) {
+	if user, ok := v.(string); ok {
+		v = map[string]interface{}{"*": user}
+	}
+	users, err := mapOf(v)
+	if err != nil {
+		return nil, fmt.Errorf("User is a user, or users by owner : %v", err)
+	}
+	for owner, user := range users {
+		if isRoot(user) {
+			return nil, fmt.Errorf("the user of %s is root", owner)
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,100 @@
+package compose
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecomposeHardening(t *testing.T) {
+	_, docker, stop := newFakeDocker(t)
+	defer stop()
+	r, err := NewRecomposator(docker, map[string]interface{}{
+		"ReadOnly":        true,
+		"NoNewPrivileges": true,
+		"CapDrop":         []interface{}{"ALL"},
+		"Seccomp":         "/etc/density/seccomp.json",
+		"User": map[string]interface{}{
+			"alice": "1001:1001",
+			"*":     "nobody",
+		},
+	})
+	assert.NoError(t, err)
+	c := NewCompose()
+	c.Services["root"] = map[string]interface{}{
+		"image":        "busybox:1.33",
+		"user":         "0:0",
+		"tmpfs":        "/run",
+		"security_opt": []interface{}{"seccomp:unconfined"},
+	}
+	c.Services["worker"] = map[string]interface{}{
+		"image":    "busybox:1.33",
+		"user":     "www-data",
+		"cap_drop": []interface{}{"ALL"},
+	}
+	prod, err := r.Recompose("bob", "alice", c)
+	assert.NoError(t, err)
+	root := prod.Services["root"].(map[string]interface{})
+	assert.Equal(t, true, root["read_only"])
+	assert.Equal(t, []string{"/run", "/tmp"}, root["tmpfs"])
+	assert.Equal(t, []string{"ALL"}, root["cap_drop"])
+	assert.Equal(t, []string{"no-new-privileges:true", "seccomp:/etc/density/seccomp.json"}, root["security_opt"])
+	assert.Equal(t, "1001:1001", root["user"])
+	worker := prod.Services["worker"].(map[string]interface{})
+	assert.Equal(t, "www-data", worker["user"])
+	assert.Equal(t, []string{"ALL"}, worker["cap_drop"])
+	// the original is untouched
+	assert.Equal(t, "0:0", c.Services["root"].(map[string]interface{})["user"])
+
+	prod, err = r.Recompose("bob", "carol", c)
+	assert.NoError(t, err)
+	assert.Equal(t, "nobody", prod.Services["root"].(map[string]interface{})["user"])
+
+	for _, cfg := range []map[string]interface{}{
+		{"User": "root"},
+		{"User": map[string]interface{}{"alice": "0"}},
+		{"Seccomp": "unconfined"},
+		{"CapDrop": "ALL"},
+		{"NoNewPrivileges": "yes"},
+	} {
+		_, err = NewRecomposator(docker, cfg)
+		assert.Error(t, err, cfg)
+	}
+
+	r, err = NewRecomposator(docker, map[string]interface{}{
+		"User": map[string]interface{}{"alice": "1001"},
+	})
+	assert.NoError(t, err)
+	_, err = r.Recompose("bob", "carol", c)
+	assert.Error(t, err)
+}
+
+func TestEngineHardening(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "engine-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, "seccomp.json"), []byte(`{
+  "defaultAction": "SCMP_ACT_ERRNO"
+}`), 0600)
+	assert.NoError(t, err)
+	s, err := NewEngine(nil).service("bob", "hello", map[string]interface{}{
+		"image":        "busybox:1.33",
+		"read_only":    true,
+		"tmpfs":        []interface{}{"/tmp", "/run:size=64m"},
+		"cap_drop":     []interface{}{"ALL"},
+		"security_opt": []interface{}{"no-new-privileges:true", "seccomp:./seccomp.json", "apparmor:docker-default"},
+	}, dir)
+	assert.NoError(t, err)
+	assert.True(t, s.host.ReadonlyRootfs)
+	assert.Equal(t, map[string]string{"/tmp": "", "/run": "size=64m"}, s.host.Tmpfs)
+	assert.Equal(t, strslice.StrSlice{"ALL"}, s.host.CapDrop)
+	assert.Equal(t, []string{
+		"no-new-privileges",
+		`seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`,
+		"apparmor=docker-default",
+	}, s.host.SecurityOpt)
+}
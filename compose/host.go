@@ -0,0 +1,234 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// hostKeys are the service keys giving access to the host, by validator name, with how to read their values
+var hostKeys = map[string]struct {
+	key    string
+	values func(raw interface{}) ([]string, error)
+}{
+	"NetworkModes": {"network_mode", scalarValue},
+	"PidModes":     {"pid", scalarValue},
+	"UsernsModes":  {"userns_mode", scalarValue},
+	"Devices":      {"devices", firstSlugs(":")},
+	"SecurityOpts": {"security_opt", listValues},
+	"Sysctls":      {"sysctls", keyValues},
+	"ExtraHosts":   {"extra_hosts", hostNames},
+	"VolumesFrom":  {"volumes_from", containers},
+}
+
+func scalarValue(raw interface{}) ([]string, error) {
+	return []string{fmt.Sprint(raw)}, nil
+}
+
+func listValues(raw interface{}) ([]string, error) {
+	return stringList(raw)
+}
+
+// firstSlugs are the first parts of the values, the host part of a device
+func firstSlugs(sep string) func(raw interface{}) ([]string, error) {
+	return func(raw interface{}) ([]string, error) {
+		values, err := stringList(raw)
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			values[i] = strings.SplitN(v, sep, 2)[0]
+		}
+		return values, nil
+	}
+}
+
+// keyValues are the keys of a map, or of a key=value list
+func keyValues(raw interface{}) ([]string, error) {
+	m, err := mapOf(raw)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// hostNames of extra_hosts, a host:ip list, or a map
+func hostNames(raw interface{}) ([]string, error) {
+	if _, ok := raw.(map[string]interface{}); ok {
+		return keyValues(raw)
+	}
+	values, err := stringList(raw)
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		values[i] = strings.SplitN(strings.SplitN(v, "=", 2)[0], ":", 2)[0]
+	}
+	return values, nil
+}
+
+// containers of volumes_from, services of the project are always allowed
+func containers(raw interface{}) ([]string, error) {
+	values, err := stringList(raw)
+	if err != nil {
+		return nil, err
+	}
+	cc := make([]string, 0)
+	for _, v := range values {
+		if strings.HasPrefix(v, "container:") {
+			cc = append(cc, strings.SplitN(strings.TrimPrefix(v, "container:"), ":", 2)[0])
+		}
+	}
+	return cc, nil
+}
+
+// ValidateHostKey allows the values of a key giving access to the host, NetworkModes allows the network_mode values
+func ValidateHostKey(name string, patterns []string) (ServiceValidator, error) {
+	host, ok := hostKeys[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown host validator: %s", name)
+	}
+	allowed, err := newGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return func(service string, value map[string]interface{}) error {
+		raw, ok := value[host.key]
+		if !ok {
+			return nil
+		}
+		values, err := host.values(raw)
+		if err != nil {
+			return fmt.Errorf("%s of %s : %v", host.key, service, err)
+		}
+		refused := make([]string, 0)
+		for _, v := range values {
+			if !allowed.match(v) {
+				refused = append(refused, v)
+			}
+		}
+		if len(refused) > 0 {
+			return fmt.Errorf("the %s %s of %s is not allowed", host.key, strings.Join(refused, ", "), service)
+		}
+		return nil
+	}, nil
+}
+
+// portRanges are ranges of host ports, 8000-8099 or 8080
+type portRanges [][2]int
+
+func parsePortRange(txt string) ([2]int, error) {
+	slugs := strings.SplitN(txt, "-", 2)
+	start, err := strconv.Atoi(slugs[0])
+	if err != nil {
+		return [2]int{}, fmt.Errorf("bad port %s", txt)
+	}
+	end := start
+	if len(slugs) == 2 {
+		end, err = strconv.Atoi(slugs[1])
+		if err != nil {
+			return [2]int{}, fmt.Errorf("bad port %s", txt)
+		}
+	}
+	if start <= 0 || end > 65535 || start > end {
+		return [2]int{}, fmt.Errorf("bad port range %s", txt)
+	}
+	return [2]int{start, end}, nil
+}
+
+func (p portRanges) contains(r [2]int) bool {
+	for _, allowed := range p {
+		if r[0] >= allowed[0] && r[1] <= allowed[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// publishedPorts of a service, the host ports as written, empty for a random port
+func publishedPorts(raw interface{}) ([]string, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list %v", raw)
+	}
+	ports := make([]string, 0, len(list))
+	for _, p := range list {
+		switch port := p.(type) {
+		case int:
+			ports = append(ports, "")
+		case string:
+			port = strings.SplitN(port, "/", 2)[0]
+			// an IPv6 host ip is between brackets
+			if strings.HasPrefix(port, "[") {
+				end := strings.Index(port, "]:")
+				if end == -1 {
+					return nil, fmt.Errorf("bad port %s", port)
+				}
+				port = "ip" + port[end+1:]
+			}
+			slugs := strings.Split(port, ":")
+			switch len(slugs) {
+			case 1:
+				ports = append(ports, "")
+			case 2, 3:
+				ports = append(ports, slugs[len(slugs)-2])
+			default:
+				return nil, fmt.Errorf("bad port %s", port)
+			}
+		case map[string]interface{}:
+			published, ok := port["published"]
+			if !ok {
+				ports = append(ports, "")
+			} else {
+				ports = append(ports, fmt.Sprint(published))
+			}
+		default:
+			return nil, fmt.Errorf("bad port %v", p)
+		}
+	}
+	return ports, nil
+}
+
+// ValidatePorts allows published ports in these ranges, random ports are refused
+func ValidatePorts(ranges []string) (ServiceValidator, error) {
+	allowed := make(portRanges, len(ranges))
+	for i, r := range ranges {
+		var err error
+		allowed[i], err = parsePortRange(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(service string, value map[string]interface{}) error {
+		raw, ok := value["ports"]
+		if !ok {
+			return nil
+		}
+		ports, err := publishedPorts(raw)
+		if err != nil {
+			return fmt.Errorf("ports of %s : %v", service, err)
+		}
+		refused := make([]string, 0)
+		for _, port := range ports {
+			if port == "" {
+				refused = append(refused, "random")
+				continue
+			}
+			r, err := parsePortRange(port)
+			if err != nil {
+				return fmt.Errorf("ports of %s : %v", service, err)
+			}
+			if !allowed.contains(r) {
+				refused = append(refused, port)
+			}
+		}
+		if len(refused) > 0 {
+			return fmt.Errorf("the ports %s of %s are not allowed", strings.Join(refused, ", "), service)
+		}
+		return nil
+	}, nil
+}
@@ -0,0 +1,132 @@
+package compose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestHostValidators(t *testing.T) {
+	validator, err := NewComposeValidtor(map[string]interface{}{
+		"Ports":        []interface{}{"8000-8099", "9000"},
+		"NetworkModes": []interface{}{"none"},
+		"PidModes":     nil,
+		"Devices":      []interface{}{"/dev/fuse"},
+		"Sysctls":      []interface{}{"net.ipv4.*"},
+		"ExtraHosts":   []interface{}{"*.example.com"},
+		"VolumesFrom":  []interface{}{},
+		"SecurityOpts": []interface{}{"no-new-privileges*"},
+	})
+	assert.NoError(t, err)
+	for _, tc := range []struct {
+		input string
+		errs  []string
+	}{
+		{
+			input: `
+services:
+  ok:
+    image: busybox:1.33
+    ports:
+      - "8080:80"
+      - "127.0.0.1:8000-8009:80-89/udp"
+      - target: 80
+        published: 9000
+    network_mode: none
+    devices:
+      - /dev/fuse:/dev/fuse
+    sysctls:
+      net.ipv4.ip_forward: 1
+    extra_hosts:
+      - "db.example.com:10.0.0.2"
+    volumes_from:
+      - other:ro
+    security_opt:
+      - no-new-privileges:true
+`,
+		},
+		{
+			input: `
+services:
+  bad:
+    image: busybox:1.33
+    ports:
+      - "80:80"
+      - 3000
+      - "[::1]::22"
+`,
+			errs: []string{"the ports 80, random, random of bad are not allowed"},
+		},
+		{
+			input: `
+services:
+  bad:
+    image: busybox:1.33
+    network_mode: host
+    pid: host
+    devices:
+      - /dev/sda:/dev/sda
+    sysctls:
+      - kernel.shmmax=1
+    extra_hosts:
+      bank.com: 10.0.0.2
+    volumes_from:
+      - container:vault
+    security_opt:
+      - seccomp:unconfined
+`,
+			errs: []string{
+				"the network_mode host of bad is not allowed",
+				"the pid host of bad is not allowed",
+				"the devices /dev/sda of bad is not allowed",
+				"the sysctls kernel.shmmax of bad is not allowed",
+				"the extra_hosts bank.com of bad is not allowed",
+				"the volumes_from vault of bad is not allowed",
+				"the security_opt seccomp:unconfined of bad is not allowed",
+			},
+		},
+	} {
+		c := NewCompose()
+		err := yaml.Unmarshal([]byte(tc.input), c)
+		assert.NoError(t, err)
+		msgs := make([]string, 0)
+		for _, err := range validator.Validate(c, nil) {
+			msgs = append(msgs, err.Error())
+		}
+		if tc.errs == nil {
+			assert.Empty(t, msgs, tc.input)
+		} else {
+			assert.ElementsMatch(t, tc.errs, msgs, tc.input)
+		}
+	}
+
+	_, err = NewComposeValidtor(map[string]interface{}{"Ports": []interface{}{"80-20"}})
+	assert.Error(t, err)
+
+	c := NewCompose()
+	c.Services["web"] = map[string]interface{}{
+		"image": "nginx:1.21",
+		"ports": []interface{}{"80:80"},
+	}
+	// the host is open by default
+	assert.Len(t, StandardValidtator.Validate(c, nil), 0)
+	closed, err := NewComposeValidtor(map[string]interface{}{"ClosedHost": nil})
+	assert.NoError(t, err)
+	assert.Len(t, closed.Validate(c, nil), 1)
+	c.Services["web"] = map[string]interface{}{
+		"image":        "nginx:1.21",
+		"ports":        []interface{}{"80:80"},
+		"network_mode": "host",
+	}
+	assert.Len(t, closed.Validate(c, nil), 2)
+	closed, err = NewComposeValidtor(map[string]interface{}{
+		"ClosedHost": true,
+		"Ports":      []interface{}{"80"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, closed.Validate(c, nil), 1)
+	open, err := NewComposeValidtor(map[string]interface{}{"ClosedHost": false})
+	assert.NoError(t, err)
+	assert.Len(t, open.Validate(c, nil), 0)
+}
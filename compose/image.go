@@ -0,0 +1,89 @@
+package compose
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution/reference"
+)
+
+// imageOf a service, normalized like Docker does : busybox is docker.io/library/busybox:latest.
+// A service without image has nothing to validate.
+func imageOf(name string, service map[string]interface{}) (reference.Named, error) {
+	raw, ok := service["image"]
+	if !ok {
+		return nil, nil
+	}
+	image, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("the image of %s is not a string : %v", name, raw)
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("the image %s of %s : %v", image, name, err)
+	}
+	return reference.TagNameOnly(named), nil
+}
+
+// ValidateImageRegistries allows images from these registries, docker.io is the Docker Hub
+func ValidateImageRegistries(patterns []string) (ServiceValidator, error) {
+	registries, err := newGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string, service map[string]interface{}) error {
+		image, err := imageOf(name, service)
+		if err != nil || image == nil {
+			return err
+		}
+		if !registries.match(reference.Domain(image)) {
+			return fmt.Errorf("Registry %s of the image of %s is not allowed", reference.Domain(image), name)
+		}
+		return nil
+	}, nil
+}
+
+// ValidateImageRepositories allows images from these repositories, like docker.io/library/*
+func ValidateImageRepositories(patterns []string) (ServiceValidator, error) {
+	repositories, err := newGlobs(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string, service map[string]interface{}) error {
+		image, err := imageOf(name, service)
+		if err != nil || image == nil {
+			return err
+		}
+		if !repositories.match(image.Name()) {
+			return fmt.Errorf("Repository %s of the image of %s is not allowed", image.Name(), name)
+		}
+		return nil
+	}, nil
+}
+
+// ValidateNoLatestImage refuses the latest tag, explicit or not, unless the image has a digest
+func ValidateNoLatestImage(name string, service map[string]interface{}) error {
+	image, err := imageOf(name, service)
+	if err != nil || image == nil {
+		return err
+	}
+	if _, ok := image.(reference.Digested); ok {
+		return nil
+	}
+	if tagged, ok := image.(reference.Tagged); ok && tagged.Tag() == "latest" {
+		return fmt.Errorf("Latest image of %s : %s", name, reference.FamiliarString(image))
+	}
+	return nil
+}
+
+// ValidateImageDigest wants an image pinned with its sha256 digest
+func ValidateImageDigest(name string, service map[string]interface{}) error {
+	image, err := imageOf(name, service)
+	if err != nil || image == nil {
+		return err
+	}
+	digested, ok := image.(reference.Digested)
+	if !ok || digested.Digest().Algorithm() != "sha256" {
+		return fmt.Errorf("Image of %s without sha256 digest : %s", name, reference.FamiliarString(image))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package compose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageValidators(t *testing.T) {
+	validator, err := NewComposeValidtor(map[string]interface{}{
+		"ImageRegistries":   []interface{}{"docker.io", "*.example.com"},
+		"ImageRepositories": []interface{}{"docker.io/library/*", "registry.example.com/batch/**"},
+		"NoLatestImage":     nil,
+	})
+	assert.NoError(t, err)
+	const digest = "@sha256:6b3a2e6e8a1e6ad41e6e9e6e1e4e17d7b4f22d1ef7e1df6c06e6b4e2e1d8c0ab"
+	for image, errs := range map[string][]string{
+		"busybox:1.33":                           nil,
+		"library/busybox:1.33":                   nil,
+		"busybox" + digest:                       nil,
+		"registry.example.com/batch/team/job:v1": nil,
+		"busybox":                                {"Latest image of hello : busybox:latest"},
+		"busybox:latest":                         {"Latest image of hello : busybox:latest"},
+		"bob/miner:1.0":                          {"Repository docker.io/bob/miner of the image of hello is not allowed"},
+		"quay.io/coreos/etcd:v3": {
+			"Registry quay.io of the image of hello is not allowed",
+			"Repository quay.io/coreos/etcd of the image of hello is not allowed",
+		},
+		"Busybox": {
+			"the image Busybox of hello : invalid reference format: repository name must be lowercase",
+			"the image Busybox of hello : invalid reference format: repository name must be lowercase",
+			"the image Busybox of hello : invalid reference format: repository name must be lowercase",
+		},
+	} {
+		c := NewCompose()
+		c.Services["hello"] = map[string]interface{}{
+			"image": image,
+		}
+		msgs := make([]string, 0)
+		for _, err := range validator.Validate(c, nil) {
+			msgs = append(msgs, err.Error())
+		}
+		if errs == nil {
+			assert.Empty(t, msgs, image)
+		} else {
+			assert.ElementsMatch(t, errs, msgs, image)
+		}
+	}
+
+	err = ValidateImageDigest("hello", map[string]interface{}{"image": "busybox" + digest})
+	assert.NoError(t, err)
+	err = ValidateImageDigest("hello", map[string]interface{}{"image": "busybox:1.33"})
+	assert.EqualError(t, err, "Image of hello without sha256 digest : busybox:1.33")
+
+	_, err = NewComposeValidtor(map[string]interface{}{"ImageRegistries": []interface{}{"[docker.io"}})
+	assert.Error(t, err)
+	_, err = NewComposeValidtor(map[string]interface{}{"ImageRegistries": "docker.io"})
+	assert.Error(t, err)
+}
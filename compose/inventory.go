@@ -0,0 +1,92 @@
+package compose
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// Resource kinds
+const (
+	ContainerResource = "container"
+	NetworkResource   = "network"
+)
+
+// Resource is a container or a network of a batch project
+type Resource struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Project string `json:"project"`
+	Running bool   `json:"running,omitempty"`
+	Egress  string `json:"egress,omitempty"` // Egress policy of a network
+}
+
+// Inventory lists the containers labeled batch, and the batch-* networks
+func Inventory(docker *client.Client) ([]Resource, error) {
+	resources := make([]Resource, 0)
+	containers, err := docker.ContainerList(context.TODO(), types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.KeyValuePair{Key: "label", Value: "batch"}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		resources = append(resources, Resource{
+			Kind:    ContainerResource,
+			ID:      container.ID,
+			Name:    containerName(container),
+			Project: container.Labels["batch"],
+			Running: container.State == "running" || container.State == "restarting",
+		})
+	}
+	networks, err := docker.NetworkList(context.TODO(), types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.KeyValuePair{Key: "name", Value: "batch-"}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		// the name filter matches anywhere in the name
+		if !strings.HasPrefix(network.Name, "batch-") {
+			continue
+		}
+		resources = append(resources, Resource{
+			Kind:    NetworkResource,
+			ID:      network.ID,
+			Name:    network.Name,
+			Project: network.Labels["batch"],
+			Egress:  network.Labels[EgressLabel],
+		})
+	}
+	return resources, nil
+}
+
+// Remove a resource, a container is killed first, the lease of a network is released
+func Remove(docker *client.Client, ledger *Ledger, r Resource) error {
+	if r.Kind == NetworkResource {
+		err := releaseEgress(types.NetworkResource{
+			ID:     r.ID,
+			Name:   r.Name,
+			Labels: map[string]string{EgressLabel: r.Egress},
+		})
+		if err != nil {
+			return err
+		}
+		err = docker.NetworkRemove(context.TODO(), r.ID)
+		if err != nil {
+			return err
+		}
+		return releaseLease(ledger, types.NetworkResource{
+			Labels: map[string]string{"batch": r.Project},
+		})
+	}
+	return docker.ContainerRemove(context.TODO(), r.ID, types.ContainerRemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+}
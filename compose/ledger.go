@@ -0,0 +1,251 @@
+package compose
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/factorysh/density/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// LedgerBucket holds the subnet leases
+const LedgerBucket = "subnets"
+
+// leaseGrace keeps a new lease whose network is not created yet, from a reconciliation
+const leaseGrace = time.Minute
+
+// Lease of subnets, by a project, or by a network density doesn't own
+type Lease struct {
+	Project string    `json:"project,omitempty"` // Task id, empty for a foreign network
+	Network string    `json:"network,omitempty"`
+	Subnets []string  `json:"subnets"`
+	Since   time.Time `json:"since"`
+}
+
+func (l *Lease) key() []byte {
+	if l.Project == "" {
+		return []byte("foreign/" + l.Network)
+	}
+	return []byte(l.Project)
+}
+
+// Foreign tells if the subnets are used by a network density doesn't own
+func (l *Lease) Foreign() bool {
+	return l.Project == ""
+}
+
+// Ledger of the subnets, the allocations don't scan Docker
+type Ledger struct {
+	lock  sync.Mutex
+	store store.Store
+}
+
+// NewLedger stores its leases in a store
+func NewLedger(s store.Store) *Ledger {
+	return &Ledger{store: s}
+}
+
+func (l *Ledger) get(key []byte) (*Lease, error) {
+	value, err := l.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// a missing key is empty, or nil
+	if len(value) == 0 {
+		return nil, nil
+	}
+	var lease Lease
+	err = json.Unmarshal(value, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("lease %s : %v", string(key), err)
+	}
+	return &lease, nil
+}
+
+func (l *Ledger) put(lease *Lease) error {
+	value, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	return l.store.Put(lease.key(), value)
+}
+
+// leases of the ledger
+func (l *Ledger) leases() ([]*Lease, error) {
+	leases := make([]*Lease, 0, l.store.Length())
+	err := l.store.ForEach(func(k, v []byte) error {
+		var lease Lease
+		err := json.Unmarshal(v, &lease)
+		if err != nil {
+			return fmt.Errorf("lease %s : %v", string(k), err)
+		}
+		leases = append(leases, &lease)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// Leases of the ledger, foreign ones too
+func (l *Ledger) Leases() ([]*Lease, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.leases()
+}
+
+// Get the lease of a project, or nil
+func (l *Ledger) Get(project string) (*Lease, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.get([]byte(project))
+}
+
+// Lease subnets for a project, the project keeps its lease.
+// The allocation gets the leased subnets, foreign ones too.
+func (l *Ledger) Lease(project string, allocate func(used []*net.IPNet) ([]*net.IPNet, error)) (*Lease, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, err := l.get([]byte(project))
+	if err != nil || lease != nil {
+		return lease, err
+	}
+	leases, err := l.leases()
+	if err != nil {
+		return nil, err
+	}
+	used := make([]*net.IPNet, 0, len(leases))
+	for _, lease := range leases {
+		for _, s := range lease.Subnets {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("lease of %s : %v", lease.Network, err)
+			}
+			used = append(used, subnet)
+		}
+	}
+	subnets, err := allocate(used)
+	if err != nil {
+		return nil, err
+	}
+	lease = &Lease{
+		Project: project,
+		Subnets: make([]string, len(subnets)),
+		Since:   time.Now(),
+	}
+	for i, s := range subnets {
+		lease.Subnets[i] = s.String()
+	}
+	return lease, l.put(lease)
+}
+
+// Name the network of a lease
+func (l *Ledger) Name(project, network string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, err := l.get([]byte(project))
+	if err != nil || lease == nil {
+		return err
+	}
+	lease.Network = network
+	return l.put(lease)
+}
+
+// Reserve subnets used by a network density doesn't know yet, until the next reconciliation
+func (l *Ledger) Reserve(network string, subnets []string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.put(&Lease{
+		Network: network,
+		Subnets: subnets,
+		Since:   time.Now(),
+	})
+}
+
+// Release the lease of a project
+func (l *Ledger) Release(project string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lease, err := l.get([]byte(project))
+	if err != nil || lease == nil {
+		return err
+	}
+	log.WithField("project", project).WithField("subnets", lease.Subnets).Info("Lease released")
+	return l.store.Delete(lease.key())
+}
+
+// Sync the ledger with the networks of Docker, it's the only Docker scan, done by the reconciliation.
+// The networks labeled batch are leased by their project, the others are foreign,
+// the leases without network are released.
+func (l *Ledger) Sync(docker *client.Client) error {
+	networks, err := docker.NetworkList(context.TODO(), types.NetworkListOptions{})
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	leases, err := l.leases()
+	if err != nil {
+		return err
+	}
+	found := make(map[string]bool)
+	for _, network := range networks {
+		subnets := make([]string, 0, len(network.IPAM.Config))
+		for _, config := range network.IPAM.Config {
+			if config.Subnet != "" {
+				subnets = append(subnets, config.Subnet)
+			}
+		}
+		if len(subnets) == 0 {
+			continue
+		}
+		lease := &Lease{
+			Project: network.Labels["batch"],
+			Network: network.Name,
+			Subnets: subnets,
+			Since:   network.Created,
+		}
+		old, err := l.get(lease.key())
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			lease.Since = old.Since
+		}
+		found[string(lease.key())] = true
+		err = l.put(lease)
+		if err != nil {
+			return err
+		}
+	}
+	released := make([]string, 0)
+	for _, lease := range leases {
+		if found[string(lease.key())] || time.Since(lease.Since) < leaseGrace {
+			continue
+		}
+		err = l.store.Delete(lease.key())
+		if err != nil {
+			return err
+		}
+		released = append(released, string(lease.key()))
+	}
+	log.WithField("networks", len(found)).WithField("released", strings.Join(released, ", ")).Info("Ledger synced")
+	return nil
+}
+
+// releaseLease of a removed network
+func releaseLease(ledger *Ledger, network types.NetworkResource) error {
+	project := network.Labels["batch"]
+	if project == "" {
+		return nil
+	}
+	return ledger.Release(project)
+}
@@ -0,0 +1,97 @@
+package compose
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/factorysh/density/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	ledger := NewLedger(store.NewMemoryStore())
+	n := NewNetworks(docker, ledger)
+
+	name, err := n.New("bob", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "batch-bob-0-0", name)
+	lease, err := ledger.Get("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"172.18.0.0/24"}, lease.Subnets)
+	assert.Equal(t, name, lease.Network)
+
+	// the next one doesn't scan Docker, a network outside of the ledger is an overlap
+	fake.overlaps = map[string]bool{"172.18.1.0/24": true}
+	name, err = n.New("alice", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "batch-alice-2-0", name)
+	leases, err := ledger.Leases()
+	assert.NoError(t, err)
+	assert.Len(t, leases, 3)
+	for _, call := range fake.calls {
+		assert.NotContains(t, call, "prune")
+	}
+
+	// the reconciliation syncs the ledger with Docker
+	fake.existing = []types.NetworkResource{
+		{
+			Name:   "batch-bob-0-0",
+			Labels: map[string]string{"batch": "bob"},
+			IPAM:   network.IPAM{Config: []network.IPAMConfig{{Subnet: "172.18.0.0/24"}}},
+		},
+		{
+			Name: "vpn",
+			IPAM: network.IPAM{Config: []network.IPAMConfig{{Subnet: "172.18.1.0/24"}}},
+		},
+		{
+			Name: "host",
+		},
+	}
+	// alice's network is gone, and its lease is old enough
+	lease, err = ledger.Get("alice")
+	assert.NoError(t, err)
+	lease.Since = time.Now().Add(-time.Hour)
+	assert.NoError(t, ledger.put(lease))
+	assert.NoError(t, ledger.Sync(docker))
+	leases, err = ledger.Leases()
+	assert.NoError(t, err)
+	networks := make(map[string]bool)
+	for _, lease := range leases {
+		networks[lease.Network] = lease.Foreign()
+	}
+	// the reserved subnet is young, it's kept until the next sync
+	assert.Equal(t, map[string]bool{
+		"batch-bob-0-0":         false,
+		"vpn":                   true,
+		"unknown-172.18.1.0/24": true,
+	}, networks)
+
+	assert.NoError(t, Remove(docker, ledger, Resource{Kind: NetworkResource, ID: "network", Project: "bob"}))
+	lease, err = ledger.Get("bob")
+	assert.NoError(t, err)
+	assert.Nil(t, lease)
+}
+
+func TestRecomposeFailureLeasesNothing(t *testing.T) {
+	fake, docker, stop := newFakeDocker(t)
+	defer stop()
+	r, err := NewRecomposator(docker, map[string]interface{}{})
+	assert.NoError(t, err)
+	ledger := NewLedger(store.NewMemoryStore())
+	r.UseLedger(ledger)
+	c := NewCompose()
+	c.Services["hello"] = map[string]interface{}{
+		"image":  "busybox:1.33",
+		"labels": "not a map",
+	}
+	_, err = r.Recompose("bob", "alice", c)
+	assert.Error(t, err)
+	assert.Len(t, fake.networks, 0)
+	leases, err := ledger.Leases()
+	assert.NoError(t, err)
+	assert.Empty(t, leases)
+}
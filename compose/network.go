@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,57 +17,78 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func SubnetFromDocker(docker *client.Client) ([]*net.IPNet, error) {
-	args := filters.NewArgs()
-	args.Add("driver", "bridge")
-	networks, err := docker.NetworkList(context.TODO(), types.NetworkListOptions{
-		Filters: args,
-	})
-	if err != nil {
-		return nil, err
-	}
-	subnets := make([]*net.IPNet, 0)
-	for _, network := range networks {
-		if network.Name == "bridge" { // It's the default bridge network
-			continue
-		}
-		for _, config := range network.IPAM.Config {
-			_, subnet, err := net.ParseCIDR(config.Subnet)
-			if err != nil {
-				return nil, err
-			}
-			subnets = append(subnets, subnet)
-
-		}
-	}
-	return subnets, nil
-}
-
 type Networks struct {
 	docker *client.Client
+	ledger *Ledger
 	lock   *sync.Mutex
-	min    *net.IPNet
-	max    *net.IPNet
-	mask   net.IPMask
+	pools  _network.Pools
 }
 
-func NewNetworks(docker *client.Client) *Networks {
+// NewNetworks leases the subnets of its networks in a ledger
+func NewNetworks(docker *client.Client, ledger *Ledger) *Networks {
 	return &Networks{
 		docker: docker,
+		ledger: ledger,
 		lock:   &sync.Mutex{},
-		min: &net.IPNet{
-			IP:   net.IPv4(172, 18, 0, 0),
-			Mask: net.IPv4Mask(255, 255, 255, 0),
-		},
-		max: &net.IPNet{
-			IP:   net.IPv4(172, 24, 32, 0),
-			Mask: net.IPv4Mask(255, 255, 255, 0),
-		},
-		mask: net.IPv4Mask(255, 255, 255, 0),
+		pools:  _network.Pools{_network.DefaultPool()},
 	}
 }
 
-func (n *Networks) New(project string) (string, error) {
+// UseLedger leases the subnets in this ledger, shared with the cleaners
+func (n *Networks) UseLedger(ledger *Ledger) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.ledger = ledger
+}
+
+// UsePools allocates the subnets from these pools, in order, an IPv6 pool makes dual stack networks
+func (n *Networks) UsePools(pools _network.Pools) error {
+	err := pools.Validate()
+	if err != nil {
+		return err
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.pools = pools
+	return nil
+}
+
+// poolsOf a config, a list of CIDRs, or of maps with the range and the size of the subnets
+func poolsOf(raw interface{}) (_network.Pools, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Pools is a list : %v", raw)
+	}
+	pools := make(_network.Pools, len(list))
+	for i, v := range list {
+		var cidr string
+		size := 0
+		switch p := v.(type) {
+		case string:
+			cidr = p
+		case map[string]interface{}:
+			cidr, _ = p["range"].(string)
+			if raw, ok := p["size"]; ok {
+				size, ok = raw.(int)
+				if !ok {
+					return nil, fmt.Errorf("the size of a pool is a number : %v", raw)
+				}
+			}
+		}
+		if cidr == "" {
+			return nil, fmt.Errorf("a pool is a CIDR, or a range and a size : %v", v)
+		}
+		pool, err := _network.NewPool(cidr, size)
+		if err != nil {
+			return nil, err
+		}
+		pools[i] = pool
+	}
+	return pools, pools.Validate()
+}
+
+// New network for a project, with its egress policy, nil is open
+func (n *Networks) New(project string, policy *EgressPolicy) (string, error) {
 	n.lock.Lock()
 	defer n.lock.Unlock()
 	l := log.WithField("project", project)
@@ -87,52 +109,90 @@ func (n *Networks) New(project string) (string, error) {
 		return networkName, nil
 	}
 
-	now := time.Now()
-	subnets, err := SubnetFromDocker(n.docker)
-	l = l.WithField("find_subnets", time.Since(now))
-	if err != nil {
-		return "", err
-	}
-	for i := 0; i < 2; i++ {
-		now = time.Now()
-		subnet, err := _network.NextAvailableNetwork(subnets, n.min, n.max, n.mask)
+	ledger := n.ledger
+	// an overlap is a network unknown to the ledger, its subnets are reserved, and the next ones are tried
+	for i := 0; i < 3; i++ {
+		now := time.Now()
+		lease, err := ledger.Lease(project, func(used []*net.IPNet) ([]*net.IPNet, error) {
+			subnet, err := n.pools.Next(used, false)
+			if err != nil {
+				return nil, err
+			}
+			subnet6, err := n.pools.Next(used, true)
+			if err != nil {
+				return nil, err
+			}
+			if subnet6 == nil {
+				return []*net.IPNet{subnet}, nil
+			}
+			return []*net.IPNet{subnet, subnet6}, nil
+		})
 		if err != nil {
 			return "", err
 		}
+		l = l.WithField("lease", time.Since(now)).WithField("subnets", lease.Subnets)
+		ipam := make([]network.IPAMConfig, len(lease.Subnets))
+		for i, subnet := range lease.Subnets {
+			ipam[i] = network.IPAMConfig{
+				Subnet: subnet,
+			}
+		}
+		ip, _, err := net.ParseCIDR(lease.Subnets[0])
+		if err != nil {
+			return "", err
+		}
+		ip = ip.To4()
+		networkName := fmt.Sprintf("batch-%s-%d-%d", project, ip[2], ip[3])
+		ipv6 := len(lease.Subnets) > 1
 
-		l = l.WithField("find_next_network", time.Since(now)).WithField("subnet", subnet)
-		networkName := fmt.Sprintf("batch-%s-%d-%d", project, subnet.IP[2], subnet.IP[3])
-
+		labels := policy.labels()
+		labels["batch"] = project
 		now = time.Now()
-		_, err = n.docker.NetworkCreate(context.TODO(), networkName, types.NetworkCreate{
+		created, err := n.docker.NetworkCreate(context.TODO(), networkName, types.NetworkCreate{
 			CheckDuplicate: true,
-			EnableIPv6:     false,
+			EnableIPv6:     ipv6,
 			Scope:          "local",
 			Driver:         "bridge",
-			Labels: map[string]string{
-				"batch": project,
-			},
-			Attachable: true,
+			Labels:         labels,
+			Internal:       policy != nil && policy.Mode == EgressOffline,
+			Attachable:     true,
 			IPAM: &network.IPAM{
 				Driver: "default",
-				Config: []network.IPAMConfig{
-					{
-						Subnet: subnet.String(),
-					},
-				},
+				Config: ipam,
 			},
 		})
 		l = l.WithField("create_network", time.Since(now))
 		if err == nil {
-			l.Info()
+			err = ledger.Name(project, networkName)
+			if err != nil {
+				return "", err
+			}
+			err = restrictEgress(created.ID, policy, ipv6)
+			if err != nil {
+				n.docker.NetworkRemove(context.TODO(), created.ID)
+				l.WithError(err).Error()
+				errRelease := ledger.Release(project)
+				if errRelease != nil {
+					l.WithError(errRelease).Error("Lease release")
+				}
+				return "", err
+			}
+			l.WithField("egress", labels[EgressLabel]).Info()
 			return networkName, nil
 		}
-		l = l.WithError(err)
-		pruned, err := n.docker.NetworksPrune(context.TODO(), filters.NewArgs())
+		errRelease := ledger.Release(project)
+		if errRelease != nil {
+			return "", errRelease
+		}
+		if !strings.Contains(err.Error(), "overlaps") {
+			l.WithError(err).Error()
+			return "", err
+		}
+		l.WithError(err).Warn("Network overlap, looking if next subnet is ok")
+		err = ledger.Reserve(fmt.Sprintf("unknown-%s", lease.Subnets[0]), lease.Subnets)
 		if err != nil {
 			return "", err
 		}
-		l.WithField("pruned", pruned.NetworksDeleted).Warn("Network overlap, looking if next subnet is ok")
 	}
 	l.Error()
 	return "", errors.New("can't add a network")
@@ -152,9 +212,13 @@ func (n *Networks) Remove(network string) error {
 	if len(networks) != 1 {
 		return fmt.Errorf("one network should be found, not %d", len(networks))
 	}
+	err = releaseEgress(networks[0])
+	if err != nil {
+		return err
+	}
 	err = n.docker.NetworkRemove(context.TODO(), network)
 	if err != nil {
 		return err
 	}
-	return nil
+	return releaseLease(n.ledger, networks[0])
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/docker/docker/client"
+	"github.com/factorysh/density/store"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,8 +16,8 @@ func TestNetworkNew(t *testing.T) {
 	}
 	docker, err := client.NewEnvClient()
 	assert.NoError(t, err)
-	networks := NewNetworks(docker)
-	n, err := networks.New("bob")
+	networks := NewNetworks(docker, NewLedger(store.NewMemoryStore()))
+	n, err := networks.New("bob", nil)
 	assert.NoError(t, err)
 	fmt.Println(n)
 	err = networks.Remove(n)
@@ -2,9 +2,11 @@ package compose
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/docker/docker/client"
+	"github.com/factorysh/density/store"
 )
 
 func StandardRecomposator(docker *client.Client) (*Recomposator, error) {
@@ -21,6 +23,9 @@ type Recomposator struct {
 	networks        *Networks
 	volumePatchers  []VolumePatcher
 	servicePatchers []ServicePatcher
+	users           map[string]string        // Forced users, by owner, * for the others
+	egress          map[string]*EgressPolicy // Egress policies, by owner, * for the others
+	engine          *Engine                  // Runs the recomposed projects, or the compose command
 }
 
 func (r *Recomposator) UseVolumePatcher(p VolumePatcher) {
@@ -31,6 +36,16 @@ func (r *Recomposator) UseServicePatcher(p ServicePatcher) {
 	r.servicePatchers = append(r.servicePatchers, p)
 }
 
+// UseLedger leases the subnets of the networks in this ledger, the one of the cleaners
+func (r *Recomposator) UseLedger(ledger *Ledger) {
+	r.networks.UseLedger(ledger)
+}
+
+// UseEngine runs the recomposed projects with the Docker API, without the compose command
+func (r *Recomposator) UseEngine(engine *Engine) {
+	r.engine = engine
+}
+
 func PatchVolumeInVolumes(target string) (VolumePatcher, error) {
 	if !strings.HasPrefix(target, "./") {
 		return nil, fmt.Errorf("Target must be relative: %s", target)
@@ -48,19 +63,22 @@ func PatchVolumeInVolumes(target string) (VolumePatcher, error) {
 		if !strings.HasPrefix(src, fmt.Sprintf("%s/", target)) {
 			return fmt.Sprintf("%s/%s:%s%s", target, src[2:], slugs[1], ro), nil
 		}
-		return src, nil
+		return volume, nil
 	}, nil
 }
 
+// NewRecomposator leases the subnets of its networks in memory, see UseLedger
 func NewRecomposator(docker *client.Client, cfg map[string]interface{}) (*Recomposator, error) {
-	n := NewNetworks(docker)
+	n := NewNetworks(docker, NewLedger(store.NewMemoryStore()))
 	r := &Recomposator{
 		docker:          docker,
 		networks:        n,
 		volumePatchers:  make([]VolumePatcher, 0),
 		servicePatchers: make([]ServicePatcher, 0),
 	}
-	for k, v := range cfg {
+	// patchers are applied in a stable order
+	for _, k := range sortedKeys(cfg) {
+		v := cfg[k]
 		switch k {
 		case "VolumeInVolumes":
 			path, ok := v.(string)
@@ -72,6 +90,66 @@ func NewRecomposator(docker *client.Client, cfg map[string]interface{}) (*Recomp
 				return nil, err
 			}
 			r.UseVolumePatcher(patcher)
+		case "ReadOnly":
+			// true for a writable /tmp, or the writable paths
+			tmpfs := []string{"/tmp"}
+			if b, ok := v.(bool); ok {
+				if !b {
+					continue
+				}
+			} else {
+				var err error
+				tmpfs, err = stringList(v)
+				if err != nil {
+					return nil, fmt.Errorf("ReadOnly argument is a boolean or a list of tmpfs : %v", err)
+				}
+			}
+			r.UseServicePatcher(PatchReadOnly(tmpfs))
+		case "NoNewPrivileges":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("NoNewPrivileges argument is a boolean: %v", v)
+			}
+			if b {
+				r.UseServicePatcher(PatchNoNewPrivileges)
+			}
+		case "CapDrop":
+			caps, err := stringList(v)
+			if err != nil {
+				return nil, fmt.Errorf("CapDrop argument is a list of capabilities : %v", err)
+			}
+			r.UseServicePatcher(PatchCapDrop(caps))
+		case "Seccomp", "AppArmor":
+			profile, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s argument is a string: %v", k, v)
+			}
+			patcher, err := PatchSecurityProfile(strings.ToLower(k), profile)
+			if err != nil {
+				return nil, err
+			}
+			r.UseServicePatcher(patcher)
+		case "User":
+			users, err := usersOf(v)
+			if err != nil {
+				return nil, err
+			}
+			r.users = users
+		case "Egress":
+			policies, err := egressPolicies(v)
+			if err != nil {
+				return nil, err
+			}
+			r.egress = policies
+		case "Pools":
+			pools, err := poolsOf(v)
+			if err != nil {
+				return nil, err
+			}
+			err = n.UsePools(pools)
+			if err != nil {
+				return nil, err
+			}
 		default:
 			return nil, fmt.Errorf("unknown patch: %s", k)
 		}
@@ -79,9 +157,9 @@ func NewRecomposator(docker *client.Client, cfg map[string]interface{}) (*Recomp
 	return r, nil
 }
 
-// Recompose take a naive and validated Compose and return a Compose as it will be run
-func (r *Recomposator) Recompose(name string, c *Compose) (*Compose, error) {
-	networkName, err := r.networks.New(name)
+// Recompose take a naive and validated Compose of an owner and return a Compose as it will be run
+func (r *Recomposator) Recompose(name, owner string, c *Compose) (*Compose, error) {
+	policy, err := r.egressOf(owner, c)
 	if err != nil {
 		return nil, err
 	}
@@ -89,15 +167,34 @@ func (r *Recomposator) Recompose(name string, c *Compose) (*Compose, error) {
 		Services: copyMap(c.Services),
 		Version:  c.Version,
 		X:        copyMap(c.X),
-		Networks: map[string]interface{}{
-			"default": map[string]interface{}{
-				"external": map[string]interface{}{
-					"name": networkName,
-				},
-			},
-		},
+		Volumes:  copyMap(c.Volumes),
+		Secrets:  copyMap(c.Secrets),
+		Configs:  copyMap(c.Configs),
+		Resolved: c.Resolved,
+		engine:   r.engine,
+	}
+	// files of secrets and configs are patched like volumes
+	for target, files := range map[string]map[string]interface{}{
+		"/run/secrets/": prod.Secrets,
+		"/":             prod.Configs,
+	} {
+		for k, v := range files {
+			file, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not a map %v", k, v)
+			}
+			src, ok := file["file"].(string)
+			if !ok {
+				continue
+			}
+			patched, err := r.patchVolume(fmt.Sprintf("%s:%s%s", src, target, k))
+			if err != nil {
+				return nil, err
+			}
+			file["file"] = strings.SplitN(patched, ":", 2)[0]
+		}
 	}
-	prod.WalkServices(func(name string, service map[string]interface{}) error {
+	err = prod.WalkServices(func(_ string, service map[string]interface{}) error {
 		volumesRaw, ok := service["volumes"]
 		if ok {
 			volumes, err := castVolumes(volumesRaw)
@@ -106,17 +203,53 @@ func (r *Recomposator) Recompose(name string, c *Compose) (*Compose, error) {
 			}
 			vv := make([]string, len(volumes))
 			for i, volume := range volumes {
-				v := volume
-				for _, patcher := range r.volumePatchers {
-					v, err = patcher(v)
-					if err != nil {
-						return err
-					}
+				if isNamedVolume(strings.Split(volume, ":")[0]) {
+					vv[i] = volume
+					continue
+				}
+				vv[i], err = r.patchVolume(volume)
+				if err != nil {
+					return err
 				}
-				vv[i] = v
 			}
 			service["volumes"] = vv
 		}
+		if raw, ok := service["networks"]; ok {
+			// the declared networks are merged into the network of the task, the aliases are kept
+			networks, err := networksOf(raw)
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]bool)
+			aliases := make([]string, 0)
+			for _, a := range networks {
+				for _, alias := range a {
+					if !seen[alias] {
+						seen[alias] = true
+						aliases = append(aliases, alias)
+					}
+				}
+			}
+			sort.Strings(aliases)
+			delete(service, "networks")
+			if len(aliases) > 0 {
+				service["networks"] = map[string]interface{}{
+					"default": map[string]interface{}{
+						"aliases": aliases,
+					},
+				}
+			}
+		}
+		for _, patcher := range r.servicePatchers {
+			err := patcher(service)
+			if err != nil {
+				return err
+			}
+		}
+		err := r.patchUser(owner, service)
+		if err != nil {
+			return err
+		}
 		labelsRaw, ok := service["labels"]
 		if !ok {
 			service["labels"] = map[string]string{
@@ -124,20 +257,67 @@ func (r *Recomposator) Recompose(name string, c *Compose) (*Compose, error) {
 			}
 			return nil
 		}
-		labels, ok := labelsRaw.(map[string]string)
-		if !ok {
-			return fmt.Errorf("labels is not a map %v", labelsRaw)
+		labels, err := mapOf(labelsRaw)
+		if err != nil {
+			return fmt.Errorf("labels : %v", err)
 		}
 		labels["batch"] = name
+		service["labels"] = labels
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	// Inject cache volume after checks
 	prod.InjectCacheVolume()
 
+	// the network is leased last, nothing can fail after it
+	networkName, err := r.networks.New(name, policy)
+	if err != nil {
+		return nil, err
+	}
+	prod.Networks = map[string]interface{}{
+		"default": map[string]interface{}{
+			"external": map[string]interface{}{
+				"name": networkName,
+			},
+		},
+	}
 	return prod, nil
 }
 
+// egressOf a compose, the policy of its owner, narrowed by the compose
+func (r *Recomposator) egressOf(owner string, c *Compose) (*EgressPolicy, error) {
+	policy, ok := r.egress[owner]
+	if !ok {
+		policy = r.egress["*"]
+	}
+	asked, err := c.egress()
+	if err != nil {
+		return nil, err
+	}
+	if asked == nil {
+		return policy, nil
+	}
+	if !asked.within(policy) {
+		return nil, fmt.Errorf("x-batch.egress %s is wider than the %s policy of %s", asked.Mode, policy.Mode, owner)
+	}
+	return asked, nil
+}
+
+// patchVolume applies the volume patchers
+func (r *Recomposator) patchVolume(volume string) (string, error) {
+	var err error
+	for _, patcher := range r.volumePatchers {
+		volume, err = patcher(volume)
+		if err != nil {
+			return "", err
+		}
+	}
+	return volume, nil
+}
+
 func copyMap(m map[string]interface{}) map[string]interface{} {
 	cp := make(map[string]interface{})
 	for k, v := range m {
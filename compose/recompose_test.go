@@ -33,7 +33,7 @@ x-batch:
 	assert.NoError(t, err)
 	composator, err := StandardRecomposator(docker)
 	assert.NoError(t, err)
-	prod, err := composator.Recompose("bob", c)
+	prod, err := composator.Recompose("bob", "alice", c)
 	assert.NoError(t, err)
 	out, err := yaml.Marshal(prod)
 	assert.NoError(t, err)
@@ -42,3 +42,28 @@ x-batch:
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"./volumes/tmp:/plop:ro", "./cache:/density/cache"}, volumes)
 }
+
+func TestRecomposeFiles(t *testing.T) {
+	_, docker, stop := newFakeDocker(t)
+	defer stop()
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(withTopLevel), c)
+	assert.NoError(t, err)
+	composator, err := StandardRecomposator(docker)
+	assert.NoError(t, err)
+	prod, err := composator.Recompose("bob", "alice", c)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"cache": nil}, prod.Volumes)
+	assert.Equal(t, "./volumes/token.txt", prod.Secrets["token"].(map[string]interface{})["file"])
+	assert.Equal(t, "./volumes/settings.ini", prod.Configs["settings"].(map[string]interface{})["file"])
+	// the original is untouched
+	assert.Equal(t, "./token.txt", c.Secrets["token"].(map[string]interface{})["file"])
+	hello := prod.Services["hello"].(map[string]interface{})
+	assert.Equal(t, []string{"cache:/cache", "./cache:/density/cache"}, hello["volumes"])
+	assert.Equal(t, map[string]string{"batch": "bob"}, hello["labels"])
+	// the declared networks are merged into the network of the task, with their aliases
+	assert.Equal(t, []string{"default"}, sortedKeys(prod.Networks))
+	assert.Equal(t, map[string]interface{}{
+		"default": map[string]interface{}{"aliases": []string{"greetings"}},
+	}, hello["networks"])
+}
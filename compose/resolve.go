@@ -0,0 +1,425 @@
+package compose
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Resolve returns the compose as it will run : variables are interpolated with the environments,
+// services are extended, and only the services of the active profiles are kept.
+// Anchors and merge keys are already resolved by the YAML parser.
+func (c *Compose) Resolve(environments map[string]string) (*Compose, error) {
+	return c.resolve(environments, true)
+}
+
+// resolve, a lax resolution doesn't fail on missing mandatory variables, for validating before the run
+func (c *Compose) resolve(environments map[string]string, strict bool) (*Compose, error) {
+	if c.Resolved {
+		return c, nil
+	}
+	i := &interpolator{
+		environments: environments,
+		strict:       strict,
+	}
+	resolved := &Compose{
+		Version:  c.Version,
+		X:        copyMap(c.X),
+		Resolved: true,
+	}
+	for _, part := range []struct {
+		key string
+		src map[string]interface{}
+		dst *map[string]interface{}
+	}{
+		{"services", c.Services, &resolved.Services},
+		{"networks", c.Networks, &resolved.Networks},
+		{"volumes", c.Volumes, &resolved.Volumes},
+		{"secrets", c.Secrets, &resolved.Secrets},
+		{"configs", c.Configs, &resolved.Configs},
+	} {
+		if part.src == nil {
+			continue
+		}
+		v, err := walkStrings(part.src, i.interpolate)
+		if err != nil {
+			return nil, fmt.Errorf("%s : %v", part.key, err)
+		}
+		*part.dst = v.(map[string]interface{})
+	}
+	if resolved.Services == nil {
+		resolved.Services = make(map[string]interface{})
+	}
+	err := extendServices(resolved.Services)
+	if err != nil {
+		return nil, err
+	}
+	err = activeProfiles(resolved.Services, environments["COMPOSE_PROFILES"])
+	if err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+// walkStrings returns a copy of the value, with its strings replaced, map keys are untouched
+func walkStrings(value interface{}, fn func(string) (string, error)) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			w, err := walkStrings(vv, fn)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = w
+		}
+		return m, nil
+	case map[string]string:
+		m := make(map[string]string, len(v))
+		for k, vv := range v {
+			w, err := fn(vv)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = w
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, vv := range v {
+			w, err := walkStrings(vv, fn)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = w
+		}
+		return l, nil
+	case []string:
+		l := make([]string, len(v))
+		for i, vv := range v {
+			w, err := fn(vv)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = w
+		}
+		return l, nil
+	}
+	return value, nil
+}
+
+// escape the $ of a resolved value, docker-compose interpolates the file again
+func escape(txt string) (string, error) {
+	return strings.ReplaceAll(txt, "$", "$$"), nil
+}
+
+// interpolator replaces $VAR, ${VAR} and ${VAR:-default} like docker-compose, $$ is a $
+type interpolator struct {
+	environments map[string]string
+	strict       bool
+}
+
+func isNameStart(r byte) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isName(r byte) bool {
+	return isNameStart(r) || (r >= '0' && r <= '9')
+}
+
+func (i *interpolator) interpolate(txt string) (string, error) {
+	if !strings.Contains(txt, "$") {
+		return txt, nil
+	}
+	var out strings.Builder
+	for n := 0; n < len(txt); n++ {
+		if txt[n] != '$' {
+			out.WriteByte(txt[n])
+			continue
+		}
+		if n+1 == len(txt) {
+			return "", fmt.Errorf("invalid interpolation format for %q", txt)
+		}
+		switch next := txt[n+1]; {
+		case next == '$':
+			out.WriteByte('$')
+			n++
+		case next == '{':
+			// find the closing brace, defaults can be interpolated too
+			depth := 0
+			end := -1
+			for m := n + 1; m < len(txt); m++ {
+				if txt[m] == '{' {
+					depth++
+				} else if txt[m] == '}' {
+					depth--
+					if depth == 0 {
+						end = m
+						break
+					}
+				}
+			}
+			if end == -1 {
+				return "", fmt.Errorf("invalid interpolation format for %q", txt)
+			}
+			value, err := i.braced(txt[n+2 : end])
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(value)
+			n = end
+		case isNameStart(next):
+			m := n + 1
+			for m < len(txt) && isName(txt[m]) {
+				m++
+			}
+			out.WriteString(i.environments[txt[n+1:m]])
+			n = m - 1
+		default:
+			return "", fmt.Errorf("invalid interpolation format for %q", txt)
+		}
+	}
+	return out.String(), nil
+}
+
+// braced is the content of ${}, a name with an optional modifier
+func (i *interpolator) braced(expr string) (string, error) {
+	m := 0
+	for m < len(expr) && isName(expr[m]) {
+		m++
+	}
+	name := expr[:m]
+	if name == "" || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+	}
+	value, set := i.environments[name]
+	if m == len(expr) {
+		return value, nil
+	}
+	modifier := expr[m : m+1]
+	arg := expr[m+1:]
+	// with a colon, an empty variable is unset
+	if modifier == ":" {
+		if m+1 == len(expr) {
+			return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+		}
+		modifier = expr[m+1 : m+2]
+		arg = expr[m+2:]
+		set = set && value != ""
+	}
+	switch modifier {
+	case "-":
+		if set {
+			return value, nil
+		}
+		return i.interpolate(arg)
+	case "+":
+		if set {
+			return i.interpolate(arg)
+		}
+		return "", nil
+	case "?":
+		if set {
+			return value, nil
+		}
+		if !i.strict {
+			return "", nil
+		}
+		msg, err := i.interpolate(arg)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("required variable %s is missing a value : %s", name, msg)
+	}
+	return "", fmt.Errorf("invalid interpolation format for ${%s}", expr)
+}
+
+// keys of a service whose lists are added to the extended ones, the other lists are replaced
+var appendedKeys = map[string]bool{
+	"volumes":        true,
+	"ports":          true,
+	"expose":         true,
+	"dns":            true,
+	"dns_search":     true,
+	"tmpfs":          true,
+	"devices":        true,
+	"secrets":        true,
+	"configs":        true,
+	"external_links": true,
+	"cap_add":        true,
+	"cap_drop":       true,
+}
+
+// extendServices merges the extended services into the extending ones
+func extendServices(services map[string]interface{}) error {
+	done := make(map[string]bool)
+	var extend func(name string, path []string) error
+	extend = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		for _, p := range path {
+			if p == name {
+				return fmt.Errorf("extends cycle %s -> %s", strings.Join(path, " -> "), name)
+			}
+		}
+		service, ok := services[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("service %s is not a map %v", name, services[name])
+		}
+		raw, ok := service["extends"]
+		if !ok {
+			done[name] = true
+			return nil
+		}
+		var base string
+		switch e := raw.(type) {
+		case string:
+			base = e
+		case map[string]interface{}:
+			if _, ok := e["file"]; ok {
+				return fmt.Errorf("service %s extends another file, it's not available", name)
+			}
+			base, _ = e["service"].(string)
+		}
+		if base == "" {
+			return fmt.Errorf("service %s has a wrong extends %v", name, raw)
+		}
+		if _, ok := services[base]; !ok {
+			return fmt.Errorf("service %s extends an unknown service %s", name, base)
+		}
+		err := extend(base, append(path, name))
+		if err != nil {
+			return err
+		}
+		merged, _ := walkStrings(services[base], func(txt string) (string, error) { return txt, nil })
+		m := merged.(map[string]interface{})
+		// profiles are not inherited, a base service can be in an inactive profile
+		delete(m, "profiles")
+		for k, v := range service {
+			if k == "extends" {
+				continue
+			}
+			m[k] = mergeValue(k, m[k], v)
+		}
+		services[name] = m
+		done[name] = true
+		return nil
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := extend(name, []string{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeValue merges the value of a service key over the extended one
+func mergeValue(key string, base, value interface{}) interface{} {
+	if base == nil {
+		return value
+	}
+	if key == "environment" || key == "labels" {
+		b, errB := mapOf(base)
+		v, errV := mapOf(value)
+		if errB == nil && errV == nil {
+			for k, vv := range v {
+				b[k] = vv
+			}
+			return b
+		}
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return value
+		}
+		for k, vv := range v {
+			b[k] = mergeValue(k, b[k], vv)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !appendedKeys[key] {
+			return value
+		}
+		merged := append([]interface{}{}, b...)
+		for _, vv := range v {
+			found := false
+			for _, bb := range b {
+				if fmt.Sprint(bb) == fmt.Sprint(vv) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				merged = append(merged, vv)
+			}
+		}
+		return merged
+	}
+	return value
+}
+
+// activeProfiles removes the services of inactive profiles, profiles are comma separated
+func activeProfiles(services map[string]interface{}, profiles string) error {
+	active := make(map[string]bool)
+	for _, p := range strings.Split(profiles, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			active[p] = true
+		}
+	}
+	disabled := make(map[string]bool)
+	for name, raw := range services {
+		service, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ps, ok := service["profiles"]
+		if !ok {
+			continue
+		}
+		list, ok := ps.([]interface{})
+		if !ok {
+			return fmt.Errorf("profiles of %s is not a list %v", name, ps)
+		}
+		enabled := false
+		for _, p := range list {
+			if active[fmt.Sprint(p)] {
+				enabled = true
+				break
+			}
+		}
+		if enabled {
+			delete(service, "profiles")
+		} else {
+			disabled[name] = true
+		}
+	}
+	for name := range disabled {
+		delete(services, name)
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for dep := range dependsOn(services[name]) {
+			if disabled[dep] {
+				return fmt.Errorf("service %s depends on %s, disabled by its profiles", name, dep)
+			}
+		}
+	}
+	return nil
+}
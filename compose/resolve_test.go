@@ -0,0 +1,189 @@
+package compose
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestInterpolate(t *testing.T) {
+	i := &interpolator{
+		environments: map[string]string{
+			"NAME":  "bob",
+			"EMPTY": "",
+		},
+		strict: true,
+	}
+	for txt, out := range map[string]string{
+		"hello":                  "hello",
+		"$NAME-$$NAME":           "bob-$NAME",
+		"${NAME}s":               "bobs",
+		"${MISSING}":             "",
+		"${MISSING:-alice}":      "alice",
+		"${EMPTY:-alice}":        "alice",
+		"${EMPTY-alice}":         "",
+		"${MISSING-${NAME}}":     "bob",
+		"${NAME:+set}":           "set",
+		"${EMPTY:+set}":          "",
+		"${EMPTY+set}":           "set",
+		"${NAME:?where is bob}":  "bob",
+		"price: $$5 for ${NAME}": "price: $5 for bob",
+	} {
+		v, err := i.interpolate(txt)
+		assert.NoError(t, err, txt)
+		assert.Equal(t, out, v, txt)
+	}
+	for _, txt := range []string{"$", "${", "${NAME", "${1A}", "${NAME/a}", "$-", "${MISSING:?where}"} {
+		_, err := i.interpolate(txt)
+		assert.Error(t, err, txt)
+	}
+	i.strict = false
+	v, err := i.interpolate("${MISSING:?where}")
+	assert.NoError(t, err)
+	assert.Equal(t, "", v)
+}
+
+const withSpecFeatures = `
+version: '3.7'
+x-common: &common
+  image: "busybox:${TAG:-latest}"
+  environment:
+    LEVEL: info
+services:
+  base:
+    <<: *common
+    command: "echo $$HOME"
+    volumes:
+      - ./data:/data
+    profiles: [base]
+  app:
+    extends: base
+    environment:
+      NAME: "${NAME}"
+    volumes:
+      - ./${DIR:-cache}:/cache
+    depends_on:
+      - db
+  db:
+    <<: *common
+  debug:
+    extends:
+      service: app
+    profiles: [debug]
+`
+
+func TestResolve(t *testing.T) {
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(withSpecFeatures), c)
+	assert.NoError(t, err)
+	r, err := c.Resolve(map[string]string{"NAME": "bob", "TAG": "1.33"})
+	assert.NoError(t, err)
+	assert.True(t, r.Resolved)
+	assert.False(t, c.Resolved)
+	// base and debug are in inactive profiles
+	assert.Len(t, r.Services, 2)
+	assert.Equal(t, map[string]interface{}{
+		"image":       "busybox:1.33",
+		"command":     "echo $HOME",
+		"environment": map[string]string{"LEVEL": "info", "NAME": "bob"},
+		"volumes":     []interface{}{"./data:/data", "./cache:/cache"},
+		"depends_on":  []interface{}{"db"},
+	}, r.Services["app"])
+	assert.Equal(t, "busybox:1.33", r.Services["db"].(map[string]interface{})["image"])
+	// the original is untouched
+	assert.Equal(t, "busybox:${TAG:-latest}", c.Services["db"].(map[string]interface{})["image"])
+
+	// docker-compose will interpolate again
+	out, err := yaml.Marshal(r)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "echo $$HOME")
+
+	r, err = c.Resolve(map[string]string{"COMPOSE_PROFILES": "debug, base"})
+	assert.NoError(t, err)
+	assert.Len(t, r.Services, 4)
+	assert.Equal(t, "busybox:latest", r.Services["debug"].(map[string]interface{})["image"])
+	_, ok := r.Services["debug"].(map[string]interface{})["profiles"]
+	assert.False(t, ok)
+}
+
+func TestResolveErrors(t *testing.T) {
+	for _, services := range []map[string]interface{}{
+		{
+			"a": map[string]interface{}{"extends": "b"},
+			"b": map[string]interface{}{"extends": "a"},
+		},
+		{
+			"a": map[string]interface{}{"extends": "c"},
+		},
+		{
+			"a": map[string]interface{}{"extends": map[string]interface{}{"file": "other.yml", "service": "b"}},
+		},
+		{
+			"a": map[string]interface{}{"depends_on": []interface{}{"b"}},
+			"b": map[string]interface{}{"profiles": []interface{}{"debug"}},
+		},
+		{
+			"a": map[string]interface{}{"image": "${TAG:?a tag is mandatory}"},
+		},
+	} {
+		c := NewCompose()
+		c.Services = services
+		_, err := c.Resolve(nil)
+		assert.Error(t, err, services)
+	}
+}
+
+func TestValidatorResolved(t *testing.T) {
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(`
+version: "3.6"
+services:
+  bob:
+    volumes:
+      - ${DIR:-/etc}:/plop
+`), c)
+	assert.NoError(t, err)
+	errs := StandardValidtator.Validate(c, nil)
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "Relative volume only /etc")
+}
+
+func TestValidatorEnvironments(t *testing.T) {
+	c := NewCompose()
+	err := yaml.Unmarshal([]byte(`
+version: "3.6"
+services:
+  bob:
+    image: busybox
+    volumes:
+      - ${DIR:-./data}:/plop
+  debug:
+    image: busybox
+    profiles: ["debug"]
+    privileged: true
+`), c)
+	assert.NoError(t, err)
+	assert.Len(t, StandardValidtator.Validate(c, nil), 0)
+	// the environments of the run change the volume
+	errs := StandardValidtator.Validate(c, map[string]string{"DIR": "/etc"})
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "Relative volume only /etc")
+	// and activate the profile
+	errs = StandardValidtator.Validate(c, map[string]string{"COMPOSE_PROFILES": "debug"})
+	assert.Len(t, errs, 1)
+}
+
+func TestResolvedIsNotForClients(t *testing.T) {
+	c := NewCompose()
+	err := json.Unmarshal([]byte(`{"services": {"hello": {"image": "busybox:${TAG}"}}, "resolved": true}`), c)
+	assert.NoError(t, err)
+	assert.False(t, c.Resolved)
+	r, err := c.Resolve(map[string]string{"TAG": "1.33"})
+	assert.NoError(t, err)
+	assert.Equal(t, "busybox:1.33", r.Services["hello"].(map[string]interface{})["image"])
+	out, err := json.Marshal(r)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "resolved")
+}
@@ -3,8 +3,10 @@ package compose
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -12,6 +14,7 @@ import (
 	"github.com/docker/docker/client"
 	_run "github.com/factorysh/density/task/run"
 	_status "github.com/factorysh/density/task/status"
+	log "github.com/sirupsen/logrus"
 )
 
 func init() {
@@ -22,12 +25,18 @@ var _ _run.Run = &DockerRun{}
 // DockerRun implements task.Run for Docker
 type DockerRun struct {
 	Path     string    `json:"path"`
-	RID      string    `json:"runner_id"` // RID is internal ID used by the docker runner
-	ID       int       `json:"id"`        // ID is the density run ID for this task
+	Project  string    `json:"project,omitempty"` // Compose project name
+	RID      string    `json:"runner_id"`         // RID is internal ID used by the docker runner
+	ID       int       `json:"id"`                // ID is the density run ID for this task
 	Start    time.Time `json:"start"`
 	Finish   time.Time `json:"down"`
 	ExitCode int       `json:"exit_code"`
 	Running  bool      `json:"running"`
+	Engine   bool      `json:"engine,omitempty"` // Started with the Docker API, not docker-compose
+	// Health are the dependencies of the main container, it starts when they are healthy
+	Health       []string      `json:"health,omitempty"`
+	StartTimeout time.Duration `json:"start_timeout,omitempty"`
+	Errors       []string      `json:"errors,omitempty"`
 }
 
 // Data returns all the data that should be exposed to the outside world
@@ -39,6 +48,7 @@ func (d *DockerRun) Data() _run.Data {
 		Runner:   d.RegisteredName(),
 		ExitCode: d.ExitCode,
 		Running:  d.Running,
+		Errors:   d.Errors,
 	}
 }
 
@@ -92,6 +102,14 @@ func (d *DockerRun) Status() (_run.Status, int, error) {
 	return status, inspect.State.ExitCode, nil
 }
 
+// project name, older runs used the directory name
+func (d *DockerRun) project() string {
+	if d.Project != "" {
+		return d.Project
+	}
+	return path.Base(d.Path)
+}
+
 // RunnerID will return the Docker container ID of the main container for this run
 func (d *DockerRun) RunnerID() (string, error) {
 	if d.RID == "" {
@@ -102,15 +120,28 @@ func (d *DockerRun) RunnerID() (string, error) {
 }
 
 func (d *DockerRun) Down() error {
+	if d.Engine {
+		cli, err := client.NewEnvClient() // FIXME use a singleton
+		if err != nil {
+			return err
+		}
+		err = NewEngine(cli).Down(d.project())
+		d.Running = false
+		return err
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
-	cmd := exec.Command("docker-compose", "down", "--remove-orphans")
+	bin, err := lazyBin()
+	if err != nil {
+		return err
+	}
+	cmd := bin.Command("--project-name", d.project(), "down", "--remove-orphans")
 	cmd.Dir = d.Path
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	fmt.Println(stdout.String())
 	fmt.Println(stderr.String())
 	d.Running = false
@@ -122,6 +153,22 @@ func (d *DockerRun) Wait(ctx context.Context) (_status.Status, error) {
 	if err != nil {
 		return _status.Error, err
 	}
+	err = d.startMain(ctx, cli)
+	if err != nil {
+		d.Running = false
+		d.Finish = time.Now()
+		errStop := d.stopSidecars(cli)
+		if errStop != nil {
+			log.WithError(errStop).WithField("project", d.project()).Error("Stop sidecars")
+		}
+		switch ctx.Err() {
+		case context.Canceled:
+			return _status.Canceled, err
+		case context.DeadlineExceeded:
+			return _status.Timeout, err
+		}
+		return _status.Error, err
+	}
 	ctxWait, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 	waitC, errC := cli.ContainerWait(ctxWait, d.RID, "")
@@ -168,5 +215,159 @@ func (d *DockerRun) Wait(ctx context.Context) (_status.Status, error) {
 	}
 	// FIXME remove old container after waiting a bit
 	d.ExitCode = inspect.State.ExitCode
+	// the task is done, its sidecars too
+	errStop := d.stopSidecars(cli)
+	if errStop != nil {
+		log.WithError(errStop).WithField("project", d.project()).Error("Stop sidecars")
+	}
 	return status, err
 }
+
+// healthPoll is the delay between two looks at the dependencies health
+var healthPoll = time.Second
+
+// startMain starts the main container, when its dependencies are healthy.
+// It's already started without health dependencies, or when it's attached again.
+func (d *DockerRun) startMain(ctx context.Context, cli *client.Client) error {
+	if len(d.Health) == 0 {
+		return nil
+	}
+	inspect, err := cli.ContainerInspect(ctx, d.RID)
+	if err != nil {
+		return err
+	}
+	if inspect.State.Status != "created" {
+		return nil
+	}
+	err = d.waitHealthy(ctx, cli)
+	if err != nil {
+		return err
+	}
+	d.Start = time.Now()
+	return cli.ContainerStart(ctx, d.RID, types.ContainerStartOptions{})
+}
+
+// waitHealthy waits for the health dependencies, each one failing is an error of the run
+func (d *DockerRun) waitHealthy(ctx context.Context, cli *client.Client) error {
+	timeout := d.StartTimeout
+	if timeout == 0 {
+		timeout = DefaultStartTimeout
+	}
+	ctxStart, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(map[string]bool)
+	for len(done) < len(d.Health) {
+		for _, name := range d.Health {
+			if done[name] {
+				continue
+			}
+			healthy, err := d.healthy(ctxStart, cli, name)
+			if ctxStart.Err() != nil {
+				break
+			}
+			if err != nil {
+				d.Errors = append(d.Errors, fmt.Sprintf("service %s : %v", name, err))
+				done[name] = true
+				continue
+			}
+			if healthy {
+				done[name] = true
+			}
+		}
+		if len(done) == len(d.Health) {
+			break
+		}
+		select {
+		case <-ctxStart.Done():
+			if ctx.Err() != nil {
+				// the task is canceled, or out of time, nothing is unhealthy
+				return ctx.Err()
+			}
+			for _, name := range d.Health {
+				if !done[name] {
+					d.Errors = append(d.Errors, fmt.Sprintf("service %s : not healthy after %v", name, timeout))
+					done[name] = true
+				}
+			}
+		case <-time.After(healthPoll):
+		}
+	}
+	if len(d.Errors) > 0 {
+		return fmt.Errorf("unhealthy dependencies : %s", strings.Join(d.Errors, ", "))
+	}
+	return nil
+}
+
+// healthy tells if a service is healthy, an error when it will never be
+func (d *DockerRun) healthy(ctx context.Context, cli *client.Client, name string) (bool, error) {
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("com.docker.compose.project=%s", d.project()),
+			},
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("com.docker.compose.service=%s", name),
+			}),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(containers) == 0 {
+		return false, errors.New("no container")
+	}
+	inspect, err := cli.ContainerInspect(ctx, containers[0].ID)
+	if err != nil {
+		return false, err
+	}
+	if !inspect.State.Running {
+		return false, fmt.Errorf("not running, %s with exit code %d", inspect.State.Status, inspect.State.ExitCode)
+	}
+	if inspect.State.Health == nil {
+		return false, errors.New("no healthcheck")
+	}
+	switch inspect.State.Health.Status {
+	case types.Healthy:
+		return true, nil
+	case types.Unhealthy:
+		logs := inspect.State.Health.Log
+		if len(logs) > 0 {
+			return false, fmt.Errorf("unhealthy : %s", strings.TrimSpace(logs[len(logs)-1].Output))
+		}
+		return false, errors.New("unhealthy")
+	}
+	return false, nil
+}
+
+const sidecarStopTimeout = 10 * time.Second
+
+// stopSidecars stops the running containers of the project, except the main one
+func (d *DockerRun) stopSidecars(cli *client.Client) error {
+	containers, err := cli.ContainerList(context.TODO(), types.ContainerListOptions{
+		Filters: filters.NewArgs(
+			filters.KeyValuePair{
+				Key:   "label",
+				Value: fmt.Sprintf("com.docker.compose.project=%s", d.project()),
+			}),
+	})
+	if err != nil {
+		return err
+	}
+	timeout := sidecarStopTimeout
+	errs := make([]string, 0)
+	for _, c := range containers {
+		if c.ID == d.RID {
+			continue
+		}
+		err = cli.ContainerStop(context.TODO(), c.ID, &timeout)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s : %v", c.ID, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("can't stop sidecars %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package compose
 import (
 	"bytes"
 	"fmt"
+	"path"
+	"sort"
 	"strings"
 	"unicode"
 )
@@ -49,7 +51,7 @@ func init() {
 }
 
 type VolumeValidator func(source, destination string, readOnly bool) error
-type ServiceValidator func(service map[string]interface{}) error
+type ServiceValidator func(name string, service map[string]interface{}) error
 
 func ValidateVolumeInplace(src, dest string, ro bool) error {
 	if !strings.HasPrefix(src, "./") {
@@ -80,6 +82,7 @@ type ComposeValidator struct {
 	volumeValidators  []VolumeValidator
 	serviceValidators []ServiceValidator
 	badConfig         []string
+	engine            *Engine // Checks that the API runner can run the compose
 }
 
 func NewComposeValidtor(cfg map[string]interface{}) (*ComposeValidator, error) {
@@ -88,8 +91,12 @@ func NewComposeValidtor(cfg map[string]interface{}) (*ComposeValidator, error) {
 		serviceValidators: make([]ServiceValidator, 0),
 		badConfig:         make([]string, 0),
 	}
+	if closed, ok := cfg["ClosedHost"]; ok && closed != false {
+		cfg = closeHost(cfg)
+	}
 	for k, v := range cfg {
 		switch k {
+		case "ClosedHost":
 		case "VolumeInplace":
 			validator.UseVolumeValidator(ValidateVolumeInplace)
 		case "NoDotDot":
@@ -100,6 +107,44 @@ func NewComposeValidtor(cfg map[string]interface{}) (*ComposeValidator, error) {
 				return nil, fmt.Errorf("NotAsDeep argument must be an int : %v", v)
 			}
 			validator.UseVolumeValidator(ValidateNotAsDeep(deep))
+		case "ImageRegistries", "ImageRepositories":
+			patterns, err := stringList(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s argument : %v", k, err)
+			}
+			build := ValidateImageRegistries
+			if k == "ImageRepositories" {
+				build = ValidateImageRepositories
+			}
+			service, err := build(patterns)
+			if err != nil {
+				return nil, err
+			}
+			validator.UseServiceValidator(service)
+		case "Ports":
+			ranges, err := stringList(v)
+			if err != nil && v != nil {
+				return nil, fmt.Errorf("Ports argument : %v", err)
+			}
+			service, err := ValidatePorts(ranges)
+			if err != nil {
+				return nil, err
+			}
+			validator.UseServiceValidator(service)
+		case "NetworkModes", "PidModes", "UsernsModes", "Devices", "SecurityOpts", "Sysctls", "ExtraHosts", "VolumesFrom":
+			patterns, err := stringList(v)
+			if err != nil && v != nil {
+				return nil, fmt.Errorf("%s argument : %v", k, err)
+			}
+			service, err := ValidateHostKey(k, patterns)
+			if err != nil {
+				return nil, err
+			}
+			validator.UseServiceValidator(service)
+		case "NoLatestImage":
+			validator.UseServiceValidator(ValidateNoLatestImage)
+		case "ImageDigest":
+			validator.UseServiceValidator(ValidateImageDigest)
 		default:
 			ok := false
 			if strings.HasPrefix(k, "No") {
@@ -117,6 +162,20 @@ func NewComposeValidtor(cfg map[string]interface{}) (*ComposeValidator, error) {
 	return validator, nil
 }
 
+// closeHost refuses the host keys and the published ports which are not allowed by the config
+func closeHost(cfg map[string]interface{}) map[string]interface{} {
+	closed := map[string]interface{}{
+		"Ports": []string{},
+	}
+	for k := range hostKeys {
+		closed[k] = []string{}
+	}
+	for k, v := range cfg {
+		closed[k] = v
+	}
+	return closed
+}
+
 func (cv *ComposeValidator) UseVolumeValidator(v VolumeValidator) {
 	cv.volumeValidators = append(cv.volumeValidators, v)
 }
@@ -125,6 +184,11 @@ func (cv *ComposeValidator) UseServiceValidator(s ServiceValidator) {
 	cv.serviceValidators = append(cv.serviceValidators, s)
 }
 
+// UseEngine refuses what the engine of the API runner can't run
+func (cv *ComposeValidator) UseEngine(engine *Engine) {
+	cv.engine = engine
+}
+
 func castVolumes(volumesRaw interface{}) ([]string, error) {
 	volumes, ok := volumesRaw.([]interface{})
 	if !ok {
@@ -141,11 +205,188 @@ func castVolumes(volumesRaw interface{}) ([]string, error) {
 	return vv, nil
 }
 
-func (cv *ComposeValidator) Validate(c *Compose) []error {
+// isNamedVolume tells if a volume source is a named volume, not a path
+func isNamedVolume(src string) bool {
+	return src != "" && !strings.HasPrefix(src, ".") && !strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "~")
+}
+
+// validatePath applies the volume validators to a path
+func (cv *ComposeValidator) validatePath(src, dest string, ro bool) []error {
+	errs := make([]error, 0)
+	for _, v := range cv.volumeValidators {
+		err := v(src, dest, ro)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validateVolumes validates the named volumes, plain volumes of the project
+func (cv *ComposeValidator) validateVolumes(volumes map[string]interface{}) []error {
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(volumes) {
+		if volumes[name] == nil {
+			continue
+		}
+		volume, ok := volumes[name].(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("volume %s is not a map : %v", name, volumes[name]))
+			continue
+		}
+		for _, key := range sortedKeys(volume) {
+			switch key {
+			case "labels":
+			case "driver":
+				if volume[key] != "local" {
+					errs = append(errs, fmt.Errorf("the driver %v of the volume %s is not available", volume[key], name))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("the %s config of the volume %s is not available", key, name))
+			}
+		}
+	}
+	return errs
+}
+
+// validateFiles validates the secrets or the configs, read from a file, like a read only volume
+func (cv *ComposeValidator) validateFiles(kind, target string, files map[string]interface{}) []error {
 	errs := make([]error, 0)
+	for _, name := range sortedKeys(files) {
+		file, ok := files[name].(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s %s is not a map : %v", kind, name, files[name]))
+			continue
+		}
+		for _, key := range sortedKeys(file) {
+			if key != "file" {
+				errs = append(errs, fmt.Errorf("the %s config of the %s %s is not available", key, kind, name))
+			}
+		}
+		src, ok := file["file"].(string)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s %s needs a file", kind, name))
+			continue
+		}
+		errs = append(errs, cv.validatePath(src, target+name, true)...)
+	}
+	return errs
+}
+
+// references of a service to secrets or configs, short or long syntax
+func references(raw interface{}) ([]string, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list %v", raw)
+	}
+	refs := make([]string, len(list))
+	for i, r := range list {
+		switch ref := r.(type) {
+		case string:
+			refs[i] = ref
+		case map[string]interface{}:
+			source, ok := ref["source"].(string)
+			if !ok {
+				return nil, fmt.Errorf("no source %v", ref)
+			}
+			refs[i] = source
+		default:
+			return nil, fmt.Errorf("wrong format %v", r)
+		}
+	}
+	return refs, nil
+}
+
+// validateNetworks validates the declared networks, they are merged into the network of the task
+func (cv *ComposeValidator) validateNetworks(networks map[string]interface{}) []error {
+	errs := make([]error, 0)
+	for _, name := range sortedKeys(networks) {
+		if networks[name] == nil {
+			continue
+		}
+		network, ok := networks[name].(map[string]interface{})
+		if !ok {
+			errs = append(errs, fmt.Errorf("network %s is not a map : %v", name, networks[name]))
+			continue
+		}
+		for _, key := range sortedKeys(network) {
+			switch key {
+			case "labels":
+			case "driver":
+				if network[key] != "bridge" {
+					errs = append(errs, fmt.Errorf("the driver %v of the network %s is not available", network[key], name))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("the %s config of the network %s is not available", key, name))
+			}
+		}
+	}
+	return errs
+}
+
+// networksOf a service, with their aliases, short or long syntax
+func networksOf(raw interface{}) (map[string][]string, error) {
+	networks := make(map[string][]string)
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		names, err := stringList(raw)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			networks[name] = nil
+		}
+		return networks, nil
+	}
+	for _, name := range sortedKeys(m) {
+		networks[name] = nil
+		if m[name] == nil {
+			continue
+		}
+		network, ok := m[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("network %s is not a map : %v", name, m[name])
+		}
+		for _, key := range sortedKeys(network) {
+			if key != "aliases" {
+				return nil, fmt.Errorf("the %s config of the network %s is not available", key, name)
+			}
+		}
+		if aliases, ok := network["aliases"]; ok {
+			var err error
+			networks[name], err = stringList(aliases)
+			if err != nil {
+				return nil, fmt.Errorf("aliases of the network %s : %v", name, err)
+			}
+		}
+	}
+	return networks, nil
+}
+
+// Validate the compose as it will run, resolved with the environments of the run.
+// Missing mandatory variables are left to the run, which fails on them.
+func (cv *ComposeValidator) Validate(c *Compose, environments map[string]string) []error {
+	errs := make([]error, 0)
+	c, err := c.resolve(environments, false)
+	if err != nil {
+		return append(errs, err)
+	}
+	errs = append(errs, cv.validateVolumes(c.Volumes)...)
+	errs = append(errs, cv.validateNetworks(c.Networks)...)
+	errs = append(errs, cv.validateFiles("secret", "/run/secrets/", c.Secrets)...)
+	errs = append(errs, cv.validateFiles("config", "/", c.Configs)...)
 	c.WalkServices(func(name string, value map[string]interface{}) error {
 		for _, service := range cv.serviceValidators {
-			err := service(value)
+			err := service(name, value)
 			if err != nil {
 				errs = append(errs, err)
 			}
@@ -156,6 +397,42 @@ func (cv *ComposeValidator) Validate(c *Compose) []error {
 				errs = append(errs, fmt.Errorf("the %s config is not available", bad))
 			}
 		}
+		if raw, ok := value["networks"]; ok {
+			networks, err := networksOf(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("networks of %s : %v", name, err))
+			}
+			unknown := make([]string, 0)
+			for network := range networks {
+				if _, ok := c.Networks[network]; !ok && network != "default" {
+					unknown = append(unknown, network)
+				}
+			}
+			sort.Strings(unknown)
+			for _, network := range unknown {
+				errs = append(errs, fmt.Errorf("unknown network %s", network))
+			}
+		}
+		for _, kind := range []string{"secret", "config"} {
+			declared := c.Secrets
+			if kind == "config" {
+				declared = c.Configs
+			}
+			raw, ok := value[kind+"s"]
+			if !ok {
+				continue
+			}
+			refs, err := references(raw)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%ss of %s : %v", kind, name, err))
+				continue
+			}
+			for _, ref := range refs {
+				if _, ok := declared[ref]; !ok {
+					errs = append(errs, fmt.Errorf("unknown %s %s", kind, ref))
+				}
+			}
+		}
 		volumesRaw, ok := value["volumes"]
 		if !ok {
 			return nil
@@ -169,22 +446,78 @@ func (cv *ComposeValidator) Validate(c *Compose) []error {
 			if len(slugs) == 1 || len(slugs) > 3 {
 				return fmt.Errorf("Wrong volume format : %s", volume)
 			}
+			if isNamedVolume(slugs[0]) {
+				if _, ok := c.Volumes[slugs[0]]; !ok {
+					errs = append(errs, fmt.Errorf("unknown volume %s", slugs[0]))
+				}
+				continue
+			}
 			ro := false
 			if len(slugs) == 3 {
 				ro = slugs[2] == "ro"
 			}
-			for _, v := range cv.volumeValidators {
-				err := v(slugs[0], slugs[1], ro)
-				if err != nil {
-					errs = append(errs, err)
-				}
-			}
+			errs = append(errs, cv.validatePath(slugs[0], slugs[1], ro)...)
 		}
 		return nil
 	})
+	if cv.engine != nil {
+		err = cv.engine.Validate(c)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errs
 }
 
+// globs are path patterns, a trailing /** matches any depth
+type globs []string
+
+func newGlobs(patterns []string) (globs, error) {
+	for _, pattern := range patterns {
+		_, err := path.Match(strings.TrimSuffix(pattern, "/**"), "")
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %s : %v", pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+func (g globs) match(name string) bool {
+	for _, pattern := range g {
+		if strings.HasSuffix(pattern, "/**") {
+			pattern = strings.TrimSuffix(pattern, "/**")
+			slugs := strings.Split(name, "/")
+			for i := len(strings.Split(pattern, "/")); i < len(slugs); i++ {
+				if ok, _ := path.Match(pattern, strings.Join(slugs[:i], "/")); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func stringList(v interface{}) ([]string, error) {
+	switch l := v.(type) {
+	case []string:
+		return l, nil
+	case []interface{}:
+		ss := make([]string, len(l))
+		for i, s := range l {
+			ss[i], _ = s.(string)
+			if ss[i] == "" {
+				return nil, fmt.Errorf("not a string : %v", s)
+			}
+		}
+		return ss, nil
+	}
+	return nil, fmt.Errorf("not a list of strings : %v", v)
+}
+
 func SnakeToCamel(txt string) string {
 	out := bytes.Buffer{}
 	up := true
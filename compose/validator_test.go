@@ -83,7 +83,7 @@ services:
 	} {
 		err := yaml.Unmarshal([]byte(tc.input), &c)
 		assert.NoError(t, err, tc.input)
-		errs := StandardValidtator.Validate(c)
+		errs := StandardValidtator.Validate(c, nil)
 		if tc.err == "" {
 			assert.Len(t, errs, 0, tc)
 		} else {
@@ -95,3 +95,124 @@ services:
 		}
 	}
 }
+
+func TestValidatorTopLevel(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		errs  []string
+	}{
+		{
+			name:  "named volume and files",
+			input: withTopLevel,
+		},
+		{
+			name: "unknown volume",
+			input: `
+version: "3.7"
+services:
+  bob:
+    volumes:
+      - cache:/cache
+`,
+			errs: []string{"unknown volume cache"},
+		},
+		{
+			name: "external volume",
+			input: `
+version: "3.7"
+services:
+  bob:
+    volumes:
+      - data:/data
+volumes:
+  data:
+    external: true
+  bind:
+    driver: local
+    driver_opts:
+      device: /etc
+  nfs:
+    driver: nfs
+`,
+			errs: []string{
+				"the driver_opts config of the volume bind is not available",
+				"the external config of the volume data is not available",
+				"the driver nfs of the volume nfs is not available",
+			},
+		},
+		{
+			name: "files",
+			input: `
+version: "3.7"
+services:
+  bob:
+    secrets:
+      - token
+      - password
+secrets:
+  token:
+    file: /etc/shadow
+  key:
+    environment: KEY
+`,
+			errs: []string{
+				"the environment config of the secret key is not available",
+				"secret key needs a file",
+				"Relative volume only /etc/shadow",
+				"unknown secret password",
+			},
+		},
+		{
+			name: "networks",
+			input: `
+version: "3.7"
+services:
+  bob:
+    networks:
+      - front
+      - default
+networks:
+  back:
+    driver: bridge
+  outside:
+    external: true
+  overlay:
+    driver: overlay
+`,
+			errs: []string{
+				"the external config of the network outside is not available",
+				"the driver overlay of the network overlay is not available",
+				"unknown network front",
+			},
+		},
+		{
+			name: "network config",
+			input: `
+version: "3.7"
+services:
+  alice:
+    networks:
+      back:
+        ipv4_address: 172.16.238.10
+networks:
+  back:
+`,
+			errs: []string{"networks of alice : the ipv4_address config of the network back is not available"},
+		},
+	} {
+		c := NewCompose()
+		err := yaml.Unmarshal([]byte(tc.input), c)
+		assert.NoError(t, err, tc.name)
+		errs := StandardValidtator.Validate(c, nil)
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		if tc.errs == nil {
+			assert.Empty(t, msgs, tc.name)
+		} else {
+			assert.Equal(t, tc.errs, msgs, tc.name)
+		}
+	}
+}
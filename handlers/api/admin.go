@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/factorysh/density/claims"
+	"github.com/factorysh/density/scheduler"
+	"github.com/getsentry/sentry-go"
+)
+
+// adminOnly wraps a raw handler, for streams
+func (a *API) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := claims.FromCtx(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !c.Admin {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func captureError(r *http.Request, err error) {
+	hub := sentry.GetHubFromContext(r.Context())
+	if hub == nil {
+		fmt.Println("Error:", err)
+	} else {
+		hub.CaptureException(err)
+	}
+}
+
+// HandleExport streams all the tasks, as JSON lines
+func (a *API) HandleExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/x-ndjson")
+	_, err := a.schd.Export(w)
+	if err != nil {
+		// headers are already sent
+		captureError(r, err)
+	}
+}
+
+// HandleBackup streams a copy of the store
+func (a *API) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/octet-stream")
+	w.Header().Set("content-disposition", `attachment; filename="density.store"`)
+	_, err := a.schd.Backup(w)
+	if err != nil {
+		captureError(r, err)
+	}
+}
+
+// HandleImport imports tasks, as JSON lines.
+// Parameters are dry_run and conflict : fail, skip, replace or renew.
+func (a *API) HandleImport(c *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if !c.Admin {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	params := r.URL.Query()
+	_, dryRun := params["dry_run"]
+	conflict, err := scheduler.ParseConflict(params.Get("conflict"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, err
+	}
+	defer r.Body.Close()
+	report, err := a.schd.Import(r.Body, scheduler.ImportOptions{
+		DryRun:   dryRun,
+		Conflict: conflict,
+	})
+	if report != nil {
+		// the report tells what is wrong
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+		}
+		return report, nil
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return report, nil
+}
+
+// HandleGetGC lists the latest garbage collections, with a limit parameter
+func (a *API) HandleGetGC(c *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if !c.Admin {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	limit := 10
+	raw := r.URL.Query().Get("limit")
+	if raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, fmt.Errorf("invalid limit : %s", raw)
+		}
+	}
+	reports, err := a.schd.GCReports(limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return reports, nil
+}
+
+// HandlePostGC collects garbage now, and returns the report
+func (a *API) HandlePostGC(c *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if !c.Admin {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	report, err := a.schd.CollectGarbage()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return report, nil
+}
+
+// HandleGetReconcile returns the latest reconciliation with the host
+func (a *API) HandleGetReconcile(c *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if !c.Admin {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	report := a.schd.Reconciled()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, errors.New("no reconciliation yet")
+	}
+	return report, nil
+}
+
+// HandlePostReconcile reconciles with the host now, and returns the report
+func (a *API) HandlePostReconcile(c *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if !c.Admin {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, nil
+	}
+	report, err := a.schd.Reconcile()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return report, nil
+}
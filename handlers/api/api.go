@@ -29,11 +29,19 @@ func RegisterAPI(router *mux.Router, schd *scheduler.Scheduler, validator *task.
 	router.Use(middlewares.Auth(authKey))
 	router.HandleFunc("/tasks/{owner}", api.wrapMyHandler(api.HandleGetTasks)).Methods(http.MethodGet)
 	router.HandleFunc("/task/{uuid}", api.wrapMyHandler(api.HandleGetTask)).Methods(http.MethodGet)
+	router.HandleFunc("/task/{uuid}/runs", api.wrapMyHandler(api.HandleGetRuns)).Methods(http.MethodGet)
 	router.HandleFunc("/tasks", api.wrapMyHandler(api.HandleGetTasks)).Methods(http.MethodGet)
 	router.HandleFunc("/tasks", api.wrapMyHandler(api.HandlePostTasks)).Methods(http.MethodPost)
 	router.HandleFunc("/tasks/{owner}", api.wrapMyHandler(api.HandlePostTasks)).Methods(http.MethodPost)
 	router.HandleFunc("/tasks/{job}", api.wrapMyHandler(api.HandleDeleteTasks)).Methods(http.MethodDelete)
 	router.PathPrefix("/tasks/{job}/volume/").Handler(api.wrapMyHandler(api.HandleGetVolumes)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/export", api.adminOnly(api.HandleExport)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/backup", api.adminOnly(api.HandleBackup)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/import", api.wrapMyHandler(api.HandleImport)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/gc", api.wrapMyHandler(api.HandleGetGC)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/gc", api.wrapMyHandler(api.HandlePostGC)).Methods(http.MethodPost)
+	router.HandleFunc("/admin/reconcile", api.wrapMyHandler(api.HandleGetReconcile)).Methods(http.MethodGet)
+	router.HandleFunc("/admin/reconcile", api.wrapMyHandler(api.HandlePostReconcile)).Methods(http.MethodPost)
 }
 
 func (a *API) wrapMyHandler(handler func(*claims.Claims, http.ResponseWriter,
@@ -38,7 +38,7 @@ func TestAPI(t *testing.T) {
 			},
 		},
 	}
-	err = recompose.Register(docker, "bob")
+	err = recompose.Register(docker)
 	assert.NoError(t, err)
 	s := scheduler.New(scheduler.NewResources(4, 16*1024), runner.New(dir, recompose), store.NewMemoryStore())
 	ctx, cancel := context.WithCancel(context.Background())
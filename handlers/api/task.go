@@ -4,9 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/factorysh/density/claims"
+	"github.com/factorysh/density/scheduler"
 	"github.com/factorysh/density/task"
+	_run "github.com/factorysh/density/task/run"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
@@ -30,6 +33,70 @@ func (a *API) HandleGetTask(u *claims.Claims, _ http.ResponseWriter, r *http.Req
 	if err != nil {
 		return nil, err
 	}
+	if t == nil {
+		return nil, fmt.Errorf("unknown task %s", id)
+	}
 
-	return t.ToTaskResp(), nil
+	resp := t.ToTaskResp()
+	// the latest runs, like when they were stored in the task, /runs pages all of them
+	runs, _, err := a.schd.Runs(id, 0, LatestRuns)
+	if err != nil {
+		return nil, err
+	}
+	resp.Runs = make([]_run.Data, len(runs))
+	for i, run := range runs {
+		resp.Runs[i] = run.Data
+	}
+	return resp, nil
+}
+
+// LatestRuns are the runs of a task response
+const LatestRuns = 20
+
+// RunsPage is a page of runs, latest first
+type RunsPage struct {
+	Total  int                    `json:"total"`
+	Offset int                    `json:"offset"`
+	Runs   []*scheduler.RunRecord `json:"runs"`
+}
+
+// HandleGetRuns returns a page of runs of a task, with offset and limit parameters
+func (a *API) HandleGetRuns(u *claims.Claims, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	id, err := uuid.Parse(mux.Vars(r)[task.UUID])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, err
+	}
+	t, err := a.schd.GetTask(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	if t == nil || (!u.Admin && t.Owner != u.Owner) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, fmt.Errorf("unknown task %s", id)
+	}
+	params := r.URL.Query()
+	offset, limit := 0, 20
+	for name, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		raw := params.Get(name)
+		if raw == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(raw)
+		if err != nil || *value < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, fmt.Errorf("invalid %s : %s", name, raw)
+		}
+	}
+	runs, total, err := a.schd.Runs(id, offset, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	return RunsPage{
+		Total:  total,
+		Offset: offset,
+		Runs:   runs,
+	}, nil
 }
@@ -8,11 +8,14 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/factorysh/density/claims"
 	rawCompose "github.com/factorysh/density/compose"
 	"github.com/factorysh/density/input/compose"
+	"github.com/factorysh/density/scheduler"
 	"github.com/factorysh/density/task"
+	"github.com/factorysh/density/task/status"
 	"github.com/getsentry/sentry-go"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -30,7 +33,6 @@ const MAXFORMMEM = 1024
 func (a *API) HandleGetTasks(c *claims.Claims, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 	labels := make(map[string]string)
-	var ts []*task.Task
 	// toSend array contains task with translated to task.Resp, removing private task fields
 	toSend := []task.Resp{}
 	vars := mux.Vars(r)
@@ -42,27 +44,46 @@ func (a *API) HandleGetTasks(c *claims.Claims, w http.ResponseWriter,
 		return nil, nil
 	}
 
+	query := scheduler.TaskQuery{}
 	for key, values := range r.URL.Query() {
 		if len(values) > 1 {
 			w.WriteHeader(http.StatusBadRequest)
 			return nil, fmt.Errorf("http parameter %s is used multiple times", key)
 		}
 
-		labels[key] = values[0]
+		var err error
+		switch key {
+		// status, comma separated
+		case "status":
+			for _, raw := range strings.Split(values[0], ",") {
+				st, err := status.Parse(raw)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return nil, err
+				}
+				query.Status = append(query.Status, st)
+			}
+		// mtime range, RFC3339
+		case "since":
+			query.Since, err = time.Parse(time.RFC3339, values[0])
+		case "until":
+			query.Until, err = time.Parse(time.RFC3339, values[0])
+		default:
+			labels[key] = values[0]
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return nil, fmt.Errorf("http parameter %s is not a RFC3339 date : %v", key, err)
+		}
 	}
 
-	// if user is an admin
-	if c.Admin {
-		if filter || len(labels) > 1 {
-			// request with a filter
-			ts = a.schd.Filter(o, labels)
-		} else {
-			// request all
-			ts = a.schd.List()
-		}
-	} else {
-		// used context information to get current user name
-		ts = a.schd.Filter(o, labels)
+	// an admin without owner requests all
+	query.Owner = o
+	query.Labels = labels
+	ts, err := a.schd.Query(query)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
 	}
 
 	for _, t := range ts {
@@ -161,17 +182,6 @@ func (a *API) HandlePostTasks(c *claims.Claims,
 		return nil, fmt.Errorf("Labels errors %v", errs)
 	}
 
-	errs = a.validator.ValidateAction(t.Action)
-	if errs != nil && len(errs) > 0 {
-		fmt.Println("Validate errors", errs)
-		w.WriteHeader(400)
-		errz := make([]string, len(errs))
-		for i := 0; i < len(errs); i++ {
-			errz[i] = errs[i].Error()
-		}
-		json.NewEncoder(w).Encode(errz)
-		return nil, fmt.Errorf("Validate errors %v", errs)
-	}
 	// unpriviledged user can't create explicit job
 	if !c.Admin && explicit {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -186,6 +196,20 @@ func (a *API) HandlePostTasks(c *claims.Claims,
 		// else, just use the user passed in the context
 		t.Owner = c.Owner
 	}
+
+	// validated as it will run, with its environments and the predefined ones
+	errs = a.validator.ValidateAction(t.Action, t.RunEnvironments())
+	if errs != nil && len(errs) > 0 {
+		fmt.Println("Validate errors", errs)
+		w.WriteHeader(400)
+		errz := make([]string, len(errs))
+		for i := 0; i < len(errs); i++ {
+			errz[i] = errs[i].Error()
+		}
+		json.NewEncoder(w).Encode(errz)
+		return nil, fmt.Errorf("Validate errors %v", errs)
+	}
+
 	if hub := sentry.GetHubFromContext(r.Context()); hub != nil {
 		hub.WithScope(func(scope *sentry.Scope) {
 			scope.SetExtra("task", t.Id)
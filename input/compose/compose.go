@@ -7,6 +7,8 @@ import (
 
 	cmps "github.com/factorysh/density/compose"
 	"github.com/factorysh/density/task"
+	"github.com/factorysh/density/task/window"
+	"gopkg.in/yaml.v3"
 )
 
 func TaskFromCompose(com *cmps.Compose) (*task.Task, error) {
@@ -55,6 +57,43 @@ func TaskFromCompose(com *cmps.Compose) (*task.Task, error) {
 		t.Cron = cron
 	}
 
+	key, ok := cfg["concurrency_key"]
+	if ok {
+		kk, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("Bad concurrency_key type: %v", key)
+		}
+		t.ConcurrencyKey = kk
+	}
+	limit, ok := cfg["concurrency_limit"]
+	if ok {
+		ll, ok := limit.(int)
+		if !ok {
+			return nil, fmt.Errorf("Bad concurrency_limit type: %v", limit)
+		}
+		if ll <= 0 {
+			return nil, fmt.Errorf("concurrency_limit must be > 0: %d", ll)
+		}
+		t.Concurrency = ll
+	}
+	calendar, ok := cfg["calendar"]
+	if ok {
+		// the calendar is already decoded as a map, round trip it
+		raw, err := yaml.Marshal(calendar)
+		if err != nil {
+			return nil, err
+		}
+		var cc window.Calendar
+		err = yaml.Unmarshal(raw, &cc)
+		if err != nil {
+			return nil, fmt.Errorf("Bad calendar: %v", err)
+		}
+		err = cc.Validate()
+		if err != nil {
+			return nil, err
+		}
+		t.Calendar = &cc
+	}
 	if t.Every != 0 && t.Cron != "" {
 		return nil, fmt.Errorf("cron and every options are mutually exclusive")
 	}
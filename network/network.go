@@ -1,9 +1,9 @@
 package network
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"sort"
 )
@@ -13,11 +13,37 @@ type ByNetwork []*net.IPNet
 func (a ByNetwork) Len() int      { return len(a) }
 func (a ByNetwork) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 func (a ByNetwork) Less(i, j int) bool {
-	return ip4Less(a[i].IP, a[j].IP)
+	return ipLess(a[i].IP, a[j].IP)
 }
 
-func ip4Less(a, b net.IP) bool {
-	return binary.BigEndian.Uint32(a.To4()) < binary.BigEndian.Uint32(b.To4())
+// ipLess sorts IPv4 before IPv6, then by address
+func ipLess(a, b net.IP) bool {
+	ia, bitsA := ipToInt(a)
+	ib, bitsB := ipToInt(b)
+	if bitsA != bitsB {
+		return bitsA < bitsB
+	}
+	return ia.Cmp(ib) < 0
+}
+
+// ipToInt is the address as an integer, with its size, 32 bits for an IPv4, 128 for an IPv6
+func ipToInt(ip net.IP) (*big.Int, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4), 32
+	}
+	return new(big.Int).SetBytes(ip.To16()), 128
+}
+
+// intToIP is the address of an integer, 4 bytes for 32 bits, 16 for 128
+func intToIP(i *big.Int, bits int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, bits/8)
+	// an overflow is truncated, like the uint32 version
+	if len(b) > len(ip) {
+		b = b[len(b)-len(ip):]
+	}
+	copy(ip[len(ip)-len(b):], b)
+	return ip
 }
 
 func intPow(n, m int) int {
@@ -31,23 +57,35 @@ func intPow(n, m int) int {
 	return result
 }
 
+// hostSize is the number of addresses of a mask
+func hostSize(mask net.IPMask) *big.Int {
+	ones, bits := mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// bounds of a network, as integers
+func bounds(network *net.IPNet) (*big.Int, *big.Int, int) {
+	first, bits := ipToInt(network.IP.Mask(network.Mask))
+	last := new(big.Int).Add(first, hostSize(network.Mask))
+	return first, last.Sub(last, big.NewInt(1)), bits
+}
+
 // FirstLast returns the first and last IP of a network
 func FirstLast(network *net.IPNet) (net.IP, net.IP) {
-	first := binary.BigEndian.Uint32(network.IP)
-	mask := binary.BigEndian.Uint32(network.Mask)
-	last := (first & mask) | (0xffffffff - mask)
-	l := make([]byte, 4)
-	binary.BigEndian.PutUint32(l, last)
-	return network.IP, net.IP(l)
+	_, last, bits := bounds(network)
+	return network.IP, intToIP(last, bits)
+}
+
+// bigDistance from a to b
+func bigDistance(a, b net.IP) *big.Int {
+	ia, _ := ipToInt(a)
+	ib, _ := ipToInt(b)
+	return ib.Sub(ib, ia)
 }
 
+// Distance from a to b, IPv6 distances can overflow, see bigDistance
 func Distance(a, b net.IP) int {
-	ib := binary.BigEndian.Uint32(b)
-	ia := binary.BigEndian.Uint32(a)
-	if ib > ia {
-		return int(ib - ia)
-	}
-	return -int(ia - ib)
+	return int(bigDistance(a, b).Int64())
 }
 
 // NetDistance is absolute distance between 2 networks, last to last, if < 0 it's an overlap
@@ -60,75 +98,111 @@ func Distance(a, b net.IP) int {
    |<->|
 */
 func NetDistance(a, b *net.IPNet) int {
-	af, al := FirstLast(a)
-	iaf := binary.BigEndian.Uint32(af)
-	ial := binary.BigEndian.Uint32(al)
-	bf, bl := FirstLast(b)
-	ibf := binary.BigEndian.Uint32(bf)
-	ibl := binary.BigEndian.Uint32(bl)
-	if iaf == ibf && ial == ibl { // same network
-		return 0
-	}
-	if iaf >= ibf && iaf <= ibl { // a start after b
+	return int(netDistance(a, b).Int64())
+}
+
+func netDistance(a, b *net.IPNet) *big.Int {
+	iaf, ial, _ := bounds(a)
+	ibf, ibl, _ := bounds(b)
+	if iaf.Cmp(ibf) == 0 && ial.Cmp(ibl) == 0 { // same network
+		return big.NewInt(0)
+	}
+	if iaf.Cmp(ibf) >= 0 && iaf.Cmp(ibl) <= 0 { // a start after b
 		// overlap
-		return -int(ibl - iaf)
+		return new(big.Int).Sub(iaf, ibl)
 	}
-	if ibf >= iaf && ibf <= ial { // b start after b
+	if ibf.Cmp(iaf) >= 0 && ibf.Cmp(ial) <= 0 { // b start after b
 		// overlap
-		return -int(ial - ibf)
+		return new(big.Int).Sub(ibf, ial)
 	}
-	if iaf > ibl { // a is after b
-		return int(ial - ibl)
+	if iaf.Cmp(ibl) > 0 { // a is after b
+		return new(big.Int).Sub(ial, ibl)
 	}
 	// b is after a
-	return int(ibl - ial)
+	return new(big.Int).Sub(ibl, ial)
 }
 
+// nextNet is the first network of this mask after a, aligned on the mask
 func nextNet(a *net.IPNet, mask net.IPMask) *net.IPNet {
-	_, l := FirstLast(a)
-	start := make([]byte, 4)
-	binary.BigEndian.PutUint32(start, binary.BigEndian.Uint32(l)+1)
+	_, last, bits := bounds(a)
+	start := last.Add(last, big.NewInt(1))
+	size := hostSize(mask)
+	if rest := new(big.Int).Mod(start, size); rest.Sign() != 0 {
+		start.Add(start, size.Sub(size, rest))
+	}
 	return &net.IPNet{
-		IP:   start,
+		IP:   intToIP(start, bits),
 		Mask: mask}
 }
 
+// sameFamily tells if both are IPv4, or both IPv6
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
+// NextAvailableNetwork is a network of this mask, from the first network mini to the last one maxi.
+// The room after the last used network is taken first, then the holes, from the start.
+// IPv4 and IPv6 are handled, networks of the other family are ignored.
 func NextAvailableNetwork(networks []*net.IPNet,
 	mini *net.IPNet,
 	maxi *net.IPNet,
 	mask net.IPMask) (*net.IPNet, error) {
-	if len(networks) == 0 { // no other networks
+	if !sameFamily(mini.IP, maxi.IP) {
+		return nil, fmt.Errorf("%v and %v are not of the same family", mini, maxi)
+	}
+	_, maxLast, _ := bounds(maxi)
+	// only the networks of the family, overlapping the range, matter
+	minFirst, _, _ := bounds(mini)
+	used := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		if !sameFamily(n.IP, mini.IP) {
+			continue
+		}
+		f, l, _ := bounds(n)
+		if l.Cmp(minFirst) < 0 || f.Cmp(maxLast) > 0 {
+			continue
+		}
+		used = append(used, n)
+	}
+	if len(used) == 0 { // no other networks
 		return mini, nil
 	}
-	sort.Sort(ByNetwork(networks))
-	_, l := FirstLast(networks[len(networks)-1])
-	fMax, _ := FirstLast(maxi)
-	d := Distance(l, fMax)
-	ones, _ := mask.Size()
-	maskSize := intPow(2, (32 - ones))
-	if d > maskSize { // there is room in the queue
-		return nextNet(networks[len(networks)-1], mask), nil
+	sort.Sort(ByNetwork(used))
+	fits := func(n *net.IPNet) bool {
+		_, l, _ := bounds(n)
+		return l.Cmp(maxLast) <= 0
 	}
-	poz := 0
+	// there is room in the queue, after the network ending last
+	last := used[0]
+	for _, u := range used[1:] {
+		_, l, _ := bounds(u)
+		if _, ll, _ := bounds(last); l.Cmp(ll) > 0 {
+			last = u
+		}
+	}
+	if n := nextNet(last, mask); fits(n) {
+		return n, nil
+	}
+	// the first hole, used networks are sorted by their start
 	n := mini
-	for {
-		d := NetDistance(n, networks[poz])
-		if d < 0 {
-			n = nextNet(n, mask)
-			poz++
+	for _, u := range used {
+		if overlaps(n, u) {
+			n = nextNet(u, mask)
 			continue
 		}
-		if d >= maskSize {
-			return n, nil
-		}
-		n = nextNet(n, mask)
-		f, _ := FirstLast(n)
-		if Distance(fMax, f) > 0 {
-			return nil, fmt.Errorf("beyond max net : %v", maxi)
-		}
-		poz++
-		if poz == len(networks) {
-			return nil, errors.New("full network")
+		if ipLess(n.IP, u.IP) {
+			break
 		}
 	}
+	if !fits(n) {
+		return nil, errors.New("full network")
+	}
+	return n, nil
+}
+
+// overlaps tells if two networks share addresses
+func overlaps(a, b *net.IPNet) bool {
+	af, al, _ := bounds(a)
+	bf, bl, _ := bounds(b)
+	return af.Cmp(bl) <= 0 && bf.Cmp(al) <= 0
 }
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Default subnet sizes of a pool
+const (
+	DefaultIPv4Size = 24
+	DefaultIPv6Size = 64 // IPv6 subnets smaller than a /64 break autoconfiguration
+)
+
+// Pool of subnets of the same size, from the First one to the Last one
+type Pool struct {
+	First *net.IPNet
+	Last  *net.IPNet
+}
+
+// DefaultPool is the historical range, 172.18.0.0/24 to 172.24.32.0/24
+func DefaultPool() *Pool {
+	return &Pool{
+		First: &net.IPNet{
+			IP:   net.IP{172, 18, 0, 0},
+			Mask: net.CIDRMask(DefaultIPv4Size, 32),
+		},
+		Last: &net.IPNet{
+			IP:   net.IP{172, 24, 32, 0},
+			Mask: net.CIDRMask(DefaultIPv4Size, 32),
+		},
+	}
+}
+
+// NewPool of the subnets of size bits inside a CIDR, 0 is the default size of the family.
+// An IPv6 pool should be a ULA, inside fd00::/8, like fd12:3456:789a::/48.
+func NewPool(cidr string, size int) (*Pool, error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := n.Mask.Size()
+	max := 30 // a network, a gateway, a host and the broadcast
+	if bits == 128 {
+		max = 124
+	}
+	if size == 0 {
+		size = DefaultIPv4Size
+		if bits == 128 {
+			size = DefaultIPv6Size
+		}
+		if size < ones {
+			size = ones
+		}
+	}
+	if size < ones || size > max {
+		return nil, fmt.Errorf("the size of the subnets of %s must be between %d and %d, not %d", cidr, ones, max, size)
+	}
+	mask := net.CIDRMask(size, bits)
+	first := &net.IPNet{IP: n.IP, Mask: mask}
+	_, last, _ := bounds(n)
+	// the last subnet starts a subnet size before the end
+	last.Sub(last, hostSize(mask))
+	last.Add(last, big.NewInt(1))
+	return &Pool{
+		First: first,
+		Last:  &net.IPNet{IP: intToIP(last, bits), Mask: mask},
+	}, nil
+}
+
+// Mask of the subnets
+func (p *Pool) Mask() net.IPMask {
+	return p.First.Mask
+}
+
+// IPv6 tells if it's a pool of IPv6 subnets
+func (p *Pool) IPv6() bool {
+	return p.First.IP.To4() == nil
+}
+
+// Contains tells if the subnet is inside the pool
+func (p *Pool) Contains(subnet *net.IPNet) bool {
+	if !sameFamily(p.First.IP, subnet.IP) {
+		return false
+	}
+	first, _, _ := bounds(p.First)
+	_, last, _ := bounds(p.Last)
+	f, l, _ := bounds(subnet)
+	return f.Cmp(first) >= 0 && l.Cmp(last) <= 0
+}
+
+// Next available subnet of the pool, without overlapping these networks
+func (p *Pool) Next(networks []*net.IPNet) (*net.IPNet, error) {
+	n, err := NextAvailableNetwork(networks, p.First, p.Last, p.Mask())
+	if err != nil {
+		return nil, fmt.Errorf("pool %s : %v", p, err)
+	}
+	return n, nil
+}
+
+func (p *Pool) String() string {
+	_, last := FirstLast(p.Last)
+	ones, _ := p.Mask().Size()
+	return fmt.Sprintf("%s-%s/%d", p.First.IP, last, ones)
+}
+
+// Pools of subnets, used in order
+type Pools []*Pool
+
+// Validate pools, they don't overlap, and there is an IPv4 one
+func (pools Pools) Validate() error {
+	ipv4 := false
+	for i, p := range pools {
+		if !p.IPv6() {
+			ipv4 = true
+		}
+		for _, other := range pools[i+1:] {
+			if !sameFamily(p.First.IP, other.First.IP) {
+				continue
+			}
+			pf, _, _ := bounds(p.First)
+			_, pl, _ := bounds(p.Last)
+			of, _, _ := bounds(other.First)
+			_, ol, _ := bounds(other.Last)
+			if pf.Cmp(ol) <= 0 && of.Cmp(pl) <= 0 {
+				return fmt.Errorf("pools %s and %s overlap", p, other)
+			}
+		}
+	}
+	if !ipv4 {
+		return errors.New("an IPv4 pool is mandatory")
+	}
+	return nil
+}
+
+// Next subnet of the family, from the first pool with room
+func (pools Pools) Next(networks []*net.IPNet, ipv6 bool) (*net.IPNet, error) {
+	errs := make([]error, 0)
+	for _, p := range pools {
+		if p.IPv6() != ipv6 {
+			continue
+		}
+		n, err := p.Next(networks)
+		if err == nil {
+			return n, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("no subnet available : %v", errs)
+}
+
+// HasIPv6 tells if IPv6 subnets are allocated too
+func (pools Pools) HasIPv6() bool {
+	for _, p := range pools {
+		if p.IPv6() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cidrs(t *testing.T, txts ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(txts))
+	for i, txt := range txts {
+		_, n, err := net.ParseCIDR(txt)
+		assert.NoError(t, err)
+		networks[i] = n
+	}
+	return networks
+}
+
+func TestPool(t *testing.T) {
+	p, err := NewPool("10.200.0.0/16", 0)
+	assert.NoError(t, err)
+	assert.False(t, p.IPv6())
+	assert.Equal(t, "10.200.0.0-10.200.255.255/24", p.String())
+	assert.True(t, p.Contains(cidrs(t, "10.200.12.0/24")[0]))
+	assert.False(t, p.Contains(cidrs(t, "10.201.0.0/24")[0]))
+
+	n, err := p.Next(cidrs(t, "10.200.0.0/24", "172.17.0.0/16"))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.200.1.0/24", n.String())
+
+	p, err = NewPool("10.200.0.0/23", 24)
+	assert.NoError(t, err)
+	_, err = p.Next(cidrs(t, "10.200.0.0/24", "10.200.1.0/24"))
+	assert.Error(t, err)
+
+	p, err = NewPool("fd12:3456:789a::/48", 0)
+	assert.NoError(t, err)
+	assert.True(t, p.IPv6())
+	n, err = p.Next(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fd12:3456:789a::/64", n.String())
+	n, err = p.Next(cidrs(t, "fd12:3456:789a::/64", "fd12:3456:789a:1::/64", "10.0.0.0/8"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fd12:3456:789a:2::/64", n.String())
+	// the last subnet is used, the first hole is taken
+	n, err = p.Next(cidrs(t, "fd12:3456:789a:1::/64", "fd12:3456:789a:ffff::/64"))
+	assert.NoError(t, err)
+	assert.Equal(t, "fd12:3456:789a::/64", n.String())
+
+	for _, bad := range []struct {
+		cidr string
+		size int
+	}{
+		{"10.0.0.0/16", 8},
+		{"10.0.0.0/16", 31},
+		{"fd00::/8", 126},
+		{"nope", 24},
+	} {
+		_, err = NewPool(bad.cidr, bad.size)
+		assert.Error(t, err, bad.cidr)
+	}
+}
+
+func TestPools(t *testing.T) {
+	small, err := NewPool("10.200.0.0/24", 25)
+	assert.NoError(t, err)
+	big, err := NewPool("10.100.0.0/16", 24)
+	assert.NoError(t, err)
+	ula, err := NewPool("fd12:3456:789a::/48", 64)
+	assert.NoError(t, err)
+	pools := Pools{small, big, ula}
+	assert.NoError(t, pools.Validate())
+	assert.True(t, pools.HasIPv6())
+
+	n, err := pools.Next(cidrs(t, "10.200.0.0/25", "10.200.0.128/25"), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.100.0.0/24", n.String())
+	n, err = pools.Next(nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "fd12:3456:789a::/64", n.String())
+
+	n, err = Pools{small}.Next(nil, true)
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+
+	overlap, err := NewPool("10.100.128.0/17", 24)
+	assert.NoError(t, err)
+	assert.Error(t, Pools{big, overlap}.Validate())
+	assert.Error(t, Pools{ula}.Validate())
+	assert.NoError(t, Pools{DefaultPool()}.Validate())
+}
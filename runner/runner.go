@@ -1,26 +1,44 @@
 package runner
 
 import (
+	"fmt"
 	"os"
 	"path"
 
 	"github.com/factorysh/density/task"
 	_task "github.com/factorysh/density/task"
 	"github.com/factorysh/density/task/run"
+	"github.com/google/uuid"
 )
 
+// Cleaner removes what a project left behind, and tells what
+type Cleaner func(project string) ([]string, error)
+
 type Runner struct {
 	home      string
 	recompose *task.Recomposator
+	validator *task.Validator
+	cleaners  []Cleaner
 }
 
 func New(home string, recompose *task.Recomposator) *Runner {
 	return &Runner{
 		home:      home,
 		recompose: recompose,
+		cleaners:  make([]Cleaner, 0),
 	}
 }
 
+// UseCleaner adds a cleaner, used when a run is over, and when a task is collected
+func (c *Runner) UseCleaner(cleaner Cleaner) {
+	c.cleaners = append(c.cleaners, cleaner)
+}
+
+// UseValidator validates the actions again before their run, with the environments of the run
+func (c *Runner) UseValidator(validator *task.Validator) {
+	c.validator = validator
+}
+
 // Up a Task
 func (c *Runner) Up(task *_task.Task) (run.Run, error) {
 	pwd := path.Join(c.home, task.Id.String())
@@ -28,9 +46,18 @@ func (c *Runner) Up(task *_task.Task) (run.Run, error) {
 	if err != nil && os.IsNotExist(err) {
 		return nil, err
 	}
+	// inject predefined environement vars into task env, before recomposing with them
+	task.InjectPredefinedEnv()
+	if c.validator != nil {
+		errs := c.validator.ValidateAction(task.Action, task.Environments)
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("invalid action %v", errs)
+		}
+	}
 	var action _task.Action
 	if c.recompose != nil {
-		action, err = c.recompose.RecomposeAction(task.Action)
+		// each task is its own project
+		action, err = c.recompose.RecomposeAction(task.Id.String(), task.Environments, task.Action)
 		if err != nil {
 			return nil, err
 		}
@@ -39,10 +66,39 @@ func (c *Runner) Up(task *_task.Task) (run.Run, error) {
 	}
 	// increment run counter
 	task.RunCounter++
-	// inject predefined environement vars into task env
-	task.InjectPredefinedEnv()
 	// FIXME add some late environments
-	return action.Up(pwd, task.Environments, task.RunCounter)
+	return action.Up(task.Id.String(), pwd, task.Environments, task.RunCounter)
+}
+
+// Release what the cleaners find once a run is over, like its network, the working directory is kept
+func (c *Runner) Release(id uuid.UUID) ([]string, error) {
+	removed := make([]string, 0)
+	for _, cleaner := range c.cleaners {
+		r, err := cleaner(id.String())
+		removed = append(removed, r...)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Clean removes what the cleaners find, then the working directory of a task
+func (c *Runner) Clean(id uuid.UUID) ([]string, error) {
+	removed, err := c.Release(id)
+	if err != nil {
+		return removed, err
+	}
+	pwd := path.Join(c.home, id.String())
+	_, err = os.Stat(pwd)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	err = os.RemoveAll(pwd)
+	if err != nil {
+		return removed, err
+	}
+	return append(removed, fmt.Sprintf("workdir %s", pwd)), nil
 }
 
 // GetHome fetch current data dir for runner
@@ -0,0 +1,281 @@
+package scheduler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/factorysh/density/store"
+	"github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+)
+
+// Conflict policy, when an imported task already exists
+type Conflict string
+
+const (
+	ConflictFail    Conflict = "fail"    // abort the import
+	ConflictSkip    Conflict = "skip"    // keep the existing task
+	ConflictReplace Conflict = "replace" // overwrite the existing task
+	ConflictRenew   Conflict = "renew"   // import with a new id
+)
+
+// ParseConflict reads a conflict policy, empty is fail
+func ParseConflict(raw string) (Conflict, error) {
+	switch c := Conflict(raw); c {
+	case "":
+		return ConflictFail, nil
+	case ConflictFail, ConflictSkip, ConflictReplace, ConflictRenew:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %s", raw)
+}
+
+// ImportOptions of an import
+type ImportOptions struct {
+	DryRun   bool
+	Conflict Conflict
+}
+
+// ImportReport tells what was, or would be with a dry run, imported
+type ImportReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Replaced int      `json:"replaced"`
+	Renewed  int      `json:"renewed"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// importer is where tasks are imported, keeping their mtime
+type importer interface {
+	Get(id uuid.UUID) (*task.Task, error)
+	put(t *task.Task) error
+	putRuns(id uuid.UUID, runs []*RunRecord, replace bool) error
+}
+
+// exported is a line of an export, a task with its runs, latest first
+type exported struct {
+	task *task.Task
+	runs []*RunRecord
+}
+
+// Export all the tasks, as JSON lines, each task with its runs
+func (j *JSONStore) Export(w io.Writer) (int, error) {
+	runs := make(map[string][]*RunRecord)
+	err := j.runs().store.ForEach(func(k, v []byte) error {
+		var run RunRecord
+		err := json.Unmarshal(v, &run)
+		if err != nil {
+			return fmt.Errorf("run %s : %v", string(k), err)
+		}
+		runs[run.Task.String()] = append(runs[run.Task.String()], &run)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range runs {
+		sort.Slice(r, func(i, j int) bool {
+			return r[i].ID > r[j].ID
+		})
+	}
+	n := 0
+	err = j.store.ForEach(func(k, v []byte) error {
+		line := bytes.TrimSpace(v)
+		if r, ok := runs[string(k)]; ok {
+			var doc map[string]json.RawMessage
+			err := json.Unmarshal(line, &doc)
+			if err != nil {
+				return fmt.Errorf("task %s : %v", string(k), err)
+			}
+			doc["runs"], err = json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			line, err = json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(append(line, '\n'))
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// putRuns of an imported task, replacing its old runs
+func (j *JSONStore) putRuns(id uuid.UUID, runs []*RunRecord, replace bool) error {
+	stored := j.runs()
+	if replace {
+		err := stored.DeleteTask(id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, run := range runs {
+		run.Task = id
+		// it was running somewhere else
+		run.Running = false
+		err := stored.Put(run)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import tasks, as JSON lines
+func (j *JSONStore) Import(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	_, report, err := importTasks(j, r, opts)
+	return report, err
+}
+
+// Backup writes a copy of the whole store, when the store can do it
+func (j *JSONStore) Backup(w io.Writer) (int64, error) {
+	b, ok := j.store.(store.Backuper)
+	if !ok {
+		return 0, errors.New("this store can't be backuped")
+	}
+	return b.Backup(w)
+}
+
+// readTasks reads all the lines, and migrates them, with their runs
+func readTasks(r io.Reader) ([]*exported, []string, error) {
+	tasks := make([]*exported, 0)
+	errs := make([]string, 0)
+	reader := bufio.NewReader(r)
+	for i := 1; ; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			e, errLine := readTask(line)
+			if errLine == nil {
+				tasks = append(tasks, e)
+			} else {
+				errs = append(errs, fmt.Sprintf("line %d : %v", i, errLine))
+			}
+		}
+		if err == io.EOF {
+			return tasks, errs, nil
+		}
+	}
+}
+
+// readTask reads a line, the runs of an old task are moved out by its migration
+func readTask(line []byte) (*exported, error) {
+	moved := &RunStore{store.NewMemoryStore()}
+	raw, _, err := task.Migrate(line, moved)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseTask(raw)
+	if err != nil {
+		return nil, err
+	}
+	if t.Id == uuid.Nil {
+		return nil, errors.New("task without id")
+	}
+	var withRuns struct {
+		Runs []*RunRecord `json:"runs"`
+	}
+	err = json.Unmarshal(raw, &withRuns)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := moved.forTask(t.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &exported{
+		task: t,
+		runs: append(withRuns.Runs, legacy...),
+	}, nil
+}
+
+// importTasks checks all the tasks, then writes them, unless dry run.
+// A running task belongs to another host, it's imported as an error.
+func importTasks(dst importer, r io.Reader, opts ImportOptions) ([]*task.Task, *ImportReport, error) {
+	if opts.Conflict == "" {
+		opts.Conflict = ConflictFail
+	}
+	tasks, errs, err := readTasks(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &ImportReport{
+		DryRun: opts.DryRun,
+		Errors: errs,
+	}
+	todo := make([]*exported, 0, len(tasks))
+	replaced := make(map[uuid.UUID]bool)
+	seen := make(map[uuid.UUID]bool)
+	for _, e := range tasks {
+		t := e.task
+		old, err := dst.Get(t.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if old != nil || seen[t.Id] {
+			switch opts.Conflict {
+			case ConflictFail:
+				report.Errors = append(report.Errors, fmt.Sprintf("task %s already exists", t.Id))
+				continue
+			case ConflictSkip:
+				report.Skipped++
+				continue
+			case ConflictReplace:
+				if old != nil && (old.Status == _status.Running || old.Status == _status.Waiting) {
+					report.Errors = append(report.Errors, fmt.Sprintf("task %s is %s, it can't be replaced", t.Id, old.Status))
+					continue
+				}
+				replaced[t.Id] = true
+				report.Replaced++
+			case ConflictRenew:
+				id, err := uuid.NewRandom()
+				if err != nil {
+					return nil, nil, err
+				}
+				t.Id = id
+				report.Renewed++
+			}
+		}
+		seen[t.Id] = true
+		if t.Status == _status.Running {
+			t.Status = _status.Error
+		}
+		todo = append(todo, e)
+	}
+	if len(report.Errors) > 0 {
+		return nil, report, fmt.Errorf("%d errors, nothing imported", len(report.Errors))
+	}
+	report.Imported = len(todo)
+	if opts.DryRun {
+		return nil, report, nil
+	}
+	imported := make([]*task.Task, len(todo))
+	for i, e := range todo {
+		err = dst.putRuns(e.task.Id, e.runs, replaced[e.task.Id])
+		if err != nil {
+			return nil, nil, err
+		}
+		err = dst.put(e.task)
+		if err != nil {
+			return nil, nil, err
+		}
+		imported[i] = e.task
+	}
+	return imported, report, nil
+}
@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/factorysh/density/store"
+	"github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	src := NewJSONStore(store.NewMemoryStore())
+	ids := make([]uuid.UUID, 0)
+	for _, st := range []_status.Status{_status.Done, _status.Running} {
+		id, err := uuid.NewRandom()
+		assert.NoError(t, err)
+		ids = append(ids, id)
+		err = src.Put(&task.Task{Id: id, Owner: "bob", Status: st})
+		assert.NoError(t, err)
+	}
+	var buff bytes.Buffer
+	n, err := src.Export(&buff)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	dump := buff.String()
+
+	dst := NewJSONStore(store.NewMemoryStore())
+	report, err := dst.Import(strings.NewReader(dump), ImportOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 0, dst.Length())
+
+	report, err = dst.Import(strings.NewReader(dump), ImportOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 2, dst.Length())
+	running, err := dst.Get(ids[1])
+	assert.NoError(t, err)
+	// it was running somewhere else
+	assert.Equal(t, _status.Error, running.Status)
+
+	_, err = dst.Import(strings.NewReader(dump), ImportOptions{Conflict: ConflictFail})
+	assert.Error(t, err)
+	assert.Equal(t, 2, dst.Length())
+
+	report, err = dst.Import(strings.NewReader(dump), ImportOptions{Conflict: ConflictSkip})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Skipped)
+	assert.Equal(t, 0, report.Imported)
+
+	report, err = dst.Import(strings.NewReader(dump), ImportOptions{Conflict: ConflictReplace})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Replaced)
+	assert.Equal(t, 2, dst.Length())
+
+	report, err = dst.Import(strings.NewReader(dump), ImportOptions{Conflict: ConflictRenew})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Renewed)
+	assert.Equal(t, 4, dst.Length())
+
+	report, err = dst.Import(strings.NewReader(fmt.Sprintf("%s\nplop\n", dump)), ImportOptions{Conflict: ConflictSkip})
+	assert.Error(t, err)
+	assert.Len(t, report.Errors, 1)
+	assert.Contains(t, report.Errors[0], "line 4")
+
+	_, err = ParseConflict("merge")
+	assert.Error(t, err)
+}
+
+func TestExportImportRuns(t *testing.T) {
+	src := NewJSONStore(store.NewMemoryStore())
+	id, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	err = src.Put(&task.Task{Id: id, Owner: "bob", Status: _status.Done})
+	assert.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		run := &RunRecord{Task: id, Status: _status.Done}
+		run.ID = i
+		err = src.runs().Put(run)
+		assert.NoError(t, err)
+	}
+	var buff bytes.Buffer
+	_, err = src.Export(&buff)
+	assert.NoError(t, err)
+	dump := buff.String()
+
+	dst := NewJSONStore(store.NewMemoryStore())
+	_, err = dst.Import(strings.NewReader(dump), ImportOptions{})
+	assert.NoError(t, err)
+	runs, total, err := dst.runs().List(id, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+	assert.Equal(t, 3, runs[0].ID)
+
+	// replaced runs are not merged
+	_, err = dst.Import(strings.NewReader(dump), ImportOptions{Conflict: ConflictReplace})
+	assert.NoError(t, err)
+	_, total, err = dst.runs().List(id, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, total)
+
+	// an old export, the runs are in the task
+	old := uuid.New()
+	_, err = dst.Import(strings.NewReader(fmt.Sprintf(`{"version": 1, "id": "%s", "owner": "bob", "status": "Done", "runs": [{"id": 1}]}`, old)),
+		ImportOptions{})
+	assert.NoError(t, err)
+	_, total, err = dst.runs().List(old, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+}
+
+func TestBackup(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	b, err := store.NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	j := NewJSONStore(b)
+	id, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	err = j.Put(&task.Task{Id: id, Owner: "bob"})
+	assert.NoError(t, err)
+
+	backup, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(backup.Name())
+	_, err = j.Backup(backup)
+	assert.NoError(t, err)
+	backup.Close()
+
+	restored, err := store.NewBoltStore(backup.Name())
+	assert.NoError(t, err)
+	tt, err := NewJSONStore(restored).Get(id)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", tt.Owner)
+
+	_, err = NewJSONStore(store.NewMemoryStore()).Backup(&bytes.Buffer{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,425 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/factorysh/density/store"
+	"github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// TaskQuery selects tasks, empty fields match everything
+type TaskQuery struct {
+	Owner  string
+	Labels map[string]string
+	Status []_status.Status
+	Since  time.Time // mtime, included
+	Until  time.Time // mtime, excluded
+}
+
+func (q TaskQuery) storeQuery() store.Query {
+	terms := make(map[string][]string)
+	if q.Owner != "" {
+		terms["owner"] = []string{q.Owner}
+	}
+	for k, v := range q.Labels {
+		terms["label."+k] = []string{v}
+	}
+	if len(q.Status) > 0 {
+		status := make([]string, len(q.Status))
+		for i, s := range q.Status {
+			status[i] = s.String()
+		}
+		terms["status"] = status
+	}
+	return store.Query{
+		Terms: terms,
+		Since: q.Since,
+		Until: q.Until,
+	}
+}
+
+// indexed keys of a task, to remove them when the task changes
+type indexed struct {
+	owner  string
+	status _status.Status
+	labels []string
+}
+
+// TaskCache is the authoritative set of tasks, in memory.
+// Tasks are copied in and out, the cached ones are never shared with the callers.
+// Every mutation is written through the JSONStore.
+type TaskCache struct {
+	store    *JSONStore
+	lock     sync.RWMutex
+	tasks    map[uuid.UUID]*task.Task
+	indexed  map[uuid.UUID]indexed
+	byOwner  map[string]map[uuid.UUID]*task.Task
+	byStatus map[_status.Status]map[uuid.UUID]*task.Task
+	byLabel  map[string]map[uuid.UUID]*task.Task // key is label=value
+}
+
+// NewTaskCache returns an empty cache, writing to store
+func NewTaskCache(store *JSONStore) *TaskCache {
+	return &TaskCache{
+		store:    store,
+		tasks:    make(map[uuid.UUID]*task.Task),
+		indexed:  make(map[uuid.UUID]indexed),
+		byOwner:  make(map[string]map[uuid.UUID]*task.Task),
+		byStatus: make(map[_status.Status]map[uuid.UUID]*task.Task),
+		byLabel:  make(map[string]map[uuid.UUID]*task.Task),
+	}
+}
+
+// copyOf a task, its fields and its maps can be changed without touching the cached one
+func copyOf(t *task.Task) *task.Task {
+	c := *t
+	c.Labels = copyStrings(t.Labels)
+	c.Environments = copyStrings(t.Environments)
+	return &c
+}
+
+func copyStrings(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func labelKey(key, value string) string {
+	return fmt.Sprintf("%s=%s", key, value)
+}
+
+func addTo(idx map[string]map[uuid.UUID]*task.Task, key string, t *task.Task) {
+	m, ok := idx[key]
+	if !ok {
+		m = make(map[uuid.UUID]*task.Task)
+		idx[key] = m
+	}
+	m[t.Id] = t
+}
+
+func removeFrom(idx map[string]map[uuid.UUID]*task.Task, key string, id uuid.UUID) {
+	m, ok := idx[key]
+	if !ok {
+		return
+	}
+	delete(m, id)
+	if len(m) == 0 {
+		delete(idx, key)
+	}
+}
+
+func (c *TaskCache) unindex(id uuid.UUID) {
+	old, ok := c.indexed[id]
+	if !ok {
+		return
+	}
+	removeFrom(c.byOwner, old.owner, id)
+	if m, ok := c.byStatus[old.status]; ok {
+		delete(m, id)
+	}
+	for _, l := range old.labels {
+		removeFrom(c.byLabel, l, id)
+	}
+	delete(c.indexed, id)
+}
+
+func (c *TaskCache) index(t *task.Task) {
+	c.unindex(t.Id)
+	idx := indexed{
+		owner:  t.Owner,
+		status: t.Status,
+		labels: make([]string, 0, len(t.Labels)),
+	}
+	addTo(c.byOwner, t.Owner, t)
+	m, ok := c.byStatus[t.Status]
+	if !ok {
+		m = make(map[uuid.UUID]*task.Task)
+		c.byStatus[t.Status] = m
+	}
+	m[t.Id] = t
+	for k, v := range t.Labels {
+		l := labelKey(k, v)
+		addTo(c.byLabel, l, t)
+		idx.labels = append(idx.labels, l)
+	}
+	c.indexed[t.Id] = idx
+}
+
+// Load all the tasks from the store, the cache is reset.
+// Old tasks are migrated first.
+func (c *TaskCache) Load() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	migrated, quarantined, err := c.store.Migrate()
+	if err != nil {
+		return err
+	}
+	if migrated > 0 || quarantined > 0 {
+		log.WithFields(log.Fields{
+			"migrated":    migrated,
+			"quarantined": quarantined,
+		}).Info("Store migration")
+	}
+	c.tasks = make(map[uuid.UUID]*task.Task)
+	c.indexed = make(map[uuid.UUID]indexed)
+	c.byOwner = make(map[string]map[uuid.UUID]*task.Task)
+	c.byStatus = make(map[_status.Status]map[uuid.UUID]*task.Task)
+	c.byLabel = make(map[string]map[uuid.UUID]*task.Task)
+	err = c.store.ForEach(func(t *task.Task) error {
+		c.tasks[t.Id] = t
+		c.index(t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.reindex()
+}
+
+// reindex the store, when some tasks were written without index
+func (c *TaskCache) reindex() error {
+	indexed, ok := c.store.store.(store.IndexedStore)
+	if !ok {
+		return nil
+	}
+	keys, err := indexed.Query(store.Query{})
+	if err != nil {
+		return err
+	}
+	if len(keys) == len(c.tasks) {
+		return nil
+	}
+	for _, t := range c.tasks {
+		err = c.store.put(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get a copy of a Task
+func (c *TaskCache) Get(id uuid.UUID) (*task.Task, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	t, ok := c.tasks[id]
+	if !ok {
+		return nil, nil
+	}
+	return copyOf(t), nil
+}
+
+// Put a task, in the store, then in the cache
+func (c *TaskCache) Put(t *task.Task) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.store.Put(t)
+	if err != nil {
+		return err
+	}
+	t = copyOf(t)
+	c.tasks[t.Id] = t
+	c.index(t)
+	return nil
+}
+
+// put a task, without touching its mtime
+func (c *TaskCache) put(t *task.Task) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.store.put(t)
+	if err != nil {
+		return err
+	}
+	t = copyOf(t)
+	c.tasks[t.Id] = t
+	c.index(t)
+	return nil
+}
+
+// putRuns of an imported task, the runs are not cached
+func (c *TaskCache) putRuns(id uuid.UUID, runs []*RunRecord, replace bool) error {
+	return c.store.putRuns(id, runs, replace)
+}
+
+// Delete a task
+func (c *TaskCache) Delete(id uuid.UUID) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.store.Delete(id)
+	if err != nil {
+		return err
+	}
+	c.unindex(id)
+	delete(c.tasks, id)
+	return nil
+}
+
+// Length of the cache
+func (c *TaskCache) Length() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.tasks)
+}
+
+// snapshot of some tasks, copied, fn can then use the cache
+func (c *TaskCache) snapshot(m map[uuid.UUID]*task.Task) []*task.Task {
+	tasks := make([]*task.Task, 0, len(m))
+	for _, t := range m {
+		tasks = append(tasks, copyOf(t))
+	}
+	return tasks
+}
+
+// ForEach loops over a snapshot of the tasks
+func (c *TaskCache) ForEach(fn func(t *task.Task) error) error {
+	c.lock.RLock()
+	tasks := c.snapshot(c.tasks)
+	c.lock.RUnlock()
+	for _, t := range tasks {
+		err := fn(t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteWithClause batch delete
+func (c *TaskCache) DeleteWithClause(fn func(t *task.Task) bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	todo := make(map[string]uuid.UUID)
+	for id, t := range c.tasks {
+		if fn(t) {
+			todo[id.String()] = id
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+	err := c.store.store.DeleteWithClause(func(k, v []byte) bool {
+		_, ok := todo[string(k)]
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range todo {
+		c.unindex(id)
+		delete(c.tasks, id)
+	}
+	return nil
+}
+
+// Filter tasks by owner and labels, an empty owner is any owner
+func (c *TaskCache) Filter(owner string, labels map[string]string) []*task.Task {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.filter(owner, labels)
+}
+
+func (c *TaskCache) filter(owner string, labels map[string]string) []*task.Task {
+	// start with the smallest index
+	candidates := c.tasks
+	if owner != "" {
+		candidates = c.byOwner[owner]
+	}
+	for k, v := range labels {
+		l := c.byLabel[labelKey(k, v)]
+		if len(l) < len(candidates) {
+			candidates = l
+		}
+	}
+	tasks := make([]*task.Task, 0)
+	for _, t := range candidates {
+		if owner != "" && t.Owner != owner {
+			continue
+		}
+		ok := true
+		for k, v := range labels {
+			if value, found := t.Labels[k]; !found || value != v {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			tasks = append(tasks, copyOf(t))
+		}
+	}
+	return tasks
+}
+
+// Query tasks, ordered by mtime.
+// The store indexes are used when available.
+func (c *TaskCache) Query(q TaskQuery) ([]*task.Task, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	indexed, ok := c.store.store.(store.IndexedStore)
+	if ok {
+		keys, err := indexed.Query(q.storeQuery())
+		if err != nil {
+			return nil, err
+		}
+		tasks := make([]*task.Task, 0, len(keys))
+		for _, k := range keys {
+			id, err := uuid.ParseBytes(k)
+			if err != nil {
+				return nil, err
+			}
+			if t, ok := c.tasks[id]; ok {
+				tasks = append(tasks, copyOf(t))
+			}
+		}
+		return tasks, nil
+	}
+	tasks := c.filter(q.Owner, q.Labels)
+	status := make(map[_status.Status]bool)
+	for _, s := range q.Status {
+		status[s] = true
+	}
+	found := make([]*task.Task, 0, len(tasks))
+	for _, t := range tasks {
+		if len(status) > 0 && !status[t.Status] {
+			continue
+		}
+		if !q.Since.IsZero() && t.Mtime.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !t.Mtime.Before(q.Until) {
+			continue
+		}
+		found = append(found, t)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Mtime.Before(found[j].Mtime)
+	})
+	return found, nil
+}
+
+// ByStatus returns tasks with one of these status
+func (c *TaskCache) ByStatus(status ..._status.Status) []*task.Task {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	tasks := make([]*task.Task, 0)
+	for _, s := range status {
+		tasks = append(tasks, c.snapshot(c.byStatus[s])...)
+	}
+	return tasks
+}
+
+// Sync the store
+func (c *TaskCache) Sync() error {
+	return c.store.store.Sync()
+}
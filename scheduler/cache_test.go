@@ -0,0 +1,140 @@
+package scheduler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/store"
+	"github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskCache(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	b, err := store.NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	for _, s := range []store.Store{store.NewMemoryStore(), b} {
+		c := NewTaskCache(&JSONStore{s})
+		tasks := make([]*task.Task, 0)
+		for _, owner := range []string{"alice", "bob", "bob"} {
+			id, err := uuid.NewRandom()
+			assert.NoError(t, err)
+			tt := &task.Task{
+				Owner:  owner,
+				Id:     id,
+				Status: _status.Waiting,
+				Labels: map[string]string{"env": "prod"},
+			}
+			assert.NoError(t, c.Put(tt))
+			tasks = append(tasks, tt)
+		}
+		assert.Equal(t, 3, c.Length())
+
+		// copies, the cached task doesn't move
+		copied, err := c.Get(tasks[0].Id)
+		assert.NoError(t, err)
+		assert.False(t, copied == tasks[0])
+		copied.Status = _status.Running
+		copied.Labels["env"] = "dev"
+		cached, err := c.Get(tasks[0].Id)
+		assert.NoError(t, err)
+		assert.Equal(t, _status.Waiting, cached.Status)
+		assert.Equal(t, "prod", cached.Labels["env"])
+
+		assert.Len(t, c.Filter("bob", nil), 2)
+		assert.Len(t, c.Filter("", map[string]string{"env": "prod"}), 3)
+		assert.Len(t, c.Filter("", map[string]string{"env": "dev"}), 0)
+
+		// indexes follow mutations
+		tasks[1].Labels["env"] = "dev"
+		tasks[1].Status = _status.Running
+		assert.NoError(t, c.Put(tasks[1]))
+		assert.Len(t, c.Filter("bob", map[string]string{"env": "prod"}), 1)
+		assert.Len(t, c.Filter("", map[string]string{"env": "dev"}), 1)
+		assert.Len(t, c.ByStatus(_status.Waiting), 2)
+		assert.Len(t, c.ByStatus(_status.Waiting, _status.Running), 3)
+
+		// written through
+		stored, err := (&JSONStore{s}).Get(tasks[1].Id)
+		assert.NoError(t, err)
+		assert.Equal(t, _status.Running, stored.Status)
+
+		err = c.DeleteWithClause(func(t *task.Task) bool {
+			return t.Status == _status.Waiting
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, c.Length())
+		assert.Equal(t, 1, s.Length())
+		assert.Len(t, c.Filter("alice", nil), 0)
+
+		// a fresh cache reads the store
+		fresh := NewTaskCache(&JSONStore{s})
+		assert.NoError(t, fresh.Load())
+		assert.Len(t, fresh.ByStatus(_status.Running), 1)
+
+		assert.NoError(t, c.Delete(tasks[1].Id))
+		assert.Equal(t, 0, c.Length())
+		assert.Equal(t, 0, s.Length())
+	}
+}
+
+func TestTaskCacheQuery(t *testing.T) {
+	now := time.Now()
+	// the memory store is indexed, the raw one is not
+	for _, s := range []store.Store{store.NewMemoryStore(), rawStore{store.NewMemoryStore()}} {
+		c := NewTaskCache(&JSONStore{s})
+		for i, st := range []_status.Status{_status.Done, _status.Running, _status.Error} {
+			id, err := uuid.NewRandom()
+			assert.NoError(t, err)
+			tt := &task.Task{
+				Owner:  "bob",
+				Id:     id,
+				Status: st,
+				Labels: map[string]string{"env": "prod", "app": fmt.Sprintf("app-%d", i)},
+			}
+			assert.NoError(t, c.Put(tt))
+			// Put touches the mtime
+			tt.Mtime = now.Add(time.Duration(i) * time.Minute)
+			assert.NoError(t, c.put(tt))
+		}
+		tasks, err := c.Query(TaskQuery{})
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 3)
+		assert.Equal(t, _status.Done, tasks[0].Status)
+
+		tasks, err = c.Query(TaskQuery{
+			Status: []_status.Status{_status.Done, _status.Error},
+			Labels: map[string]string{"env": "prod"},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 2)
+
+		tasks, err = c.Query(TaskQuery{
+			Owner:  "bob",
+			Labels: map[string]string{"env": "prod", "app": "app-1"},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		assert.Equal(t, _status.Running, tasks[0].Status)
+
+		tasks, err = c.Query(TaskQuery{
+			Since: now.Add(time.Minute),
+			Until: now.Add(2 * time.Minute),
+		})
+		assert.NoError(t, err)
+		assert.Len(t, tasks, 1)
+		assert.Equal(t, _status.Running, tasks[0].Status)
+	}
+}
+
+// rawStore hides the indexes
+type rawStore struct {
+	store.Store
+}
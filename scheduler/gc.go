@@ -0,0 +1,305 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/factorysh/density/store"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// GCBucket holds the garbage collection reports
+const GCBucket = "gc"
+
+// gcReportsKept is the number of reports kept
+const gcReportsKept = 100
+
+// Cleaner removes what a runner left on the host for a task, and tells what
+type Cleaner interface {
+	Clean(id uuid.UUID) ([]string, error)
+}
+
+// Expiry of finished tasks, zero keeps them
+type Expiry struct {
+	MaxAge time.Duration            `yaml:"max_age"`
+	Status map[string]time.Duration `yaml:"status"` // By status name : Done, Error, Timeout, Canceled
+}
+
+func (e Expiry) validate() error {
+	if e.MaxAge < 0 {
+		return fmt.Errorf("negative max_age : %v", e.MaxAge)
+	}
+	for name, age := range e.Status {
+		s, err := _status.Parse(name)
+		if err != nil {
+			return err
+		}
+		if !finished(s) {
+			return fmt.Errorf("%s is not a final status", name)
+		}
+		if age < 0 {
+			return fmt.Errorf("negative max age for %s : %v", name, age)
+		}
+	}
+	return nil
+}
+
+// GCPolicy is a default expiry, and expiries by owner
+type GCPolicy struct {
+	Every  time.Duration `yaml:"every"` // Period of the collection, zero disables it
+	Expiry `yaml:",inline"`
+	Owner  map[string]Expiry `yaml:"owner"`
+}
+
+// Validate the policy
+func (p GCPolicy) Validate() error {
+	if p.Every < 0 {
+		return fmt.Errorf("negative period : %v", p.Every)
+	}
+	err := p.Expiry.validate()
+	if err != nil {
+		return err
+	}
+	for owner, e := range p.Owner {
+		err = e.validate()
+		if err != nil {
+			return fmt.Errorf("expiry of %s : %v", owner, err)
+		}
+	}
+	return nil
+}
+
+// maxAge of a finished task : owner and status, owner, status, then default
+func (p GCPolicy) maxAge(owner string, status _status.Status) time.Duration {
+	if e, ok := p.Owner[owner]; ok {
+		if age, ok := e.Status[status.String()]; ok {
+			return age
+		}
+		if e.MaxAge > 0 {
+			return e.MaxAge
+		}
+	}
+	if age, ok := p.Status[status.String()]; ok {
+		return age
+	}
+	return p.MaxAge
+}
+
+func finished(s _status.Status) bool {
+	return s == _status.Done || s == _status.Timeout || s == _status.Canceled || s == _status.Error
+}
+
+// GCReport tells what a collection removed
+type GCReport struct {
+	Start    time.Time           `json:"start"`
+	Duration time.Duration       `json:"duration"`
+	Tasks    []uuid.UUID         `json:"tasks"`   // Removed tasks
+	Removed  map[string][]string `json:"removed"` // Removed by the runner, by task
+	Runs     int                 `json:"runs"`    // Removed runs
+	Errors   []string            `json:"errors,omitempty"`
+}
+
+func (r *GCReport) key() []byte {
+	return []byte(r.Start.UTC().Format("2006-01-02T15:04:05.000000000Z"))
+}
+
+func (r *GCReport) failed(id uuid.UUID, err error) {
+	log.WithError(err).WithField("id", id).Error("GC")
+	r.Errors = append(r.Errors, fmt.Sprintf("%s : %v", id, err))
+}
+
+// GCReports stores the latest reports
+type GCReports struct {
+	store store.Store
+}
+
+// NewGCReports uses the gc bucket of the store, or memory
+func NewGCReports(s store.Store) *GCReports {
+	return &GCReports{bucket(s, GCBucket)}
+}
+
+// Put a report, the oldest ones are removed
+func (g *GCReports) Put(report *GCReport) error {
+	value, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	err = g.store.Put(report.key(), value)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	err = g.store.ForEach(func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(keys) <= gcReportsKept {
+		return nil
+	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-gcReportsKept] {
+		err = g.store.Delete([]byte(k))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List the latest reports, latest first, limit 0 is all
+func (g *GCReports) List(limit int) ([]*GCReport, error) {
+	reports := make([]*GCReport, 0)
+	err := g.store.ForEach(func(k, v []byte) error {
+		var report GCReport
+		err := json.Unmarshal(v, &report)
+		if err != nil {
+			return fmt.Errorf("gc report %s : %v", string(k), err)
+		}
+		reports = append(reports, &report)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Start.After(reports[j].Start)
+	})
+	if limit > 0 && limit < len(reports) {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+// UseGC sets the garbage collection policy
+func (s *Scheduler) UseGC(policy GCPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gc = policy
+	return nil
+}
+
+// CollectGarbage removes expired tasks, with their runs and what the runner left,
+// and the working directories of unknown tasks. What is removed is reported.
+func (s *Scheduler) CollectGarbage() (*GCReport, error) {
+	s.gcLock.Lock()
+	defer s.gcLock.Unlock()
+	s.lock.RLock()
+	policy := s.gc
+	s.lock.RUnlock()
+	report := &GCReport{
+		Start:   time.Now(),
+		Tasks:   make([]uuid.UUID, 0),
+		Removed: make(map[string][]string),
+	}
+	cleaner, _ := s.runner.(Cleaner)
+	tasks, err := s.Query(TaskQuery{
+		Status: []_status.Status{_status.Done, _status.Timeout, _status.Canceled, _status.Error},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tasks {
+		age := policy.maxAge(t.Owner, t.Status)
+		if age <= 0 || report.Start.Sub(t.Mtime) < age || !finished(t.Status) {
+			continue
+		}
+		if cleaner != nil {
+			removed, err := cleaner.Clean(t.Id)
+			if len(removed) > 0 {
+				report.Removed[t.Id.String()] = removed
+			}
+			if err != nil {
+				// the task is kept, the next collection will try again
+				report.failed(t.Id, err)
+				continue
+			}
+		}
+		err = s.Delete(t.Id)
+		if err != nil {
+			report.failed(t.Id, err)
+			continue
+		}
+		report.Tasks = append(report.Tasks, t.Id)
+	}
+	if cleaner != nil {
+		err = s.cleanOrphans(cleaner, report)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+	report.Runs = s.FlushRuns()
+	report.Duration = time.Since(report.Start)
+	err = s.gcReports.Put(report)
+	if err != nil {
+		log.WithError(err).Error("GC report")
+	}
+	log.WithFields(log.Fields{
+		"tasks":    len(report.Tasks),
+		"cleaned":  len(report.Removed),
+		"runs":     report.Runs,
+		"errors":   len(report.Errors),
+		"duration": report.Duration,
+	}).Info("GC")
+	return report, nil
+}
+
+// cleanOrphans cleans the working directories without task
+func (s *Scheduler) cleanOrphans(cleaner Cleaner, report *GCReport) error {
+	entries, err := ioutil.ReadDir(s.runner.GetHome())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		t, err := s.tasks.Get(id)
+		if err != nil || t != nil {
+			continue
+		}
+		removed, err := cleaner.Clean(id)
+		if len(removed) > 0 {
+			report.Removed[id.String()] = removed
+		}
+		if err != nil {
+			report.failed(id, err)
+		}
+	}
+	return nil
+}
+
+// GCReports lists the latest garbage collections, latest first
+func (s *Scheduler) GCReports(limit int) ([]*GCReport, error) {
+	return s.gcReports.List(limit)
+}
+
+// collectGarbage periodically, until the context is done
+func (s *Scheduler) collectGarbage(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := s.CollectGarbage()
+			if err != nil {
+				log.WithError(err).Error("GC")
+			}
+		}
+	}
+}
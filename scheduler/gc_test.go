@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/runner"
+	"github.com/factorysh/density/store"
+	_task "github.com/factorysh/density/task"
+	_run "github.com/factorysh/density/task/run"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPolicy(t *testing.T) {
+	policy := GCPolicy{
+		Expiry: Expiry{
+			MaxAge: time.Hour,
+			Status: map[string]time.Duration{"Error": 24 * time.Hour},
+		},
+		Owner: map[string]Expiry{
+			"alice": {MaxAge: time.Minute},
+			"bob":   {Status: map[string]time.Duration{"Error": 0}},
+		},
+	}
+	assert.NoError(t, policy.Validate())
+	assert.Equal(t, time.Hour, policy.maxAge("carol", _status.Done))
+	assert.Equal(t, 24*time.Hour, policy.maxAge("carol", _status.Error))
+	assert.Equal(t, time.Minute, policy.maxAge("alice", _status.Error))
+	assert.Equal(t, time.Hour, policy.maxAge("bob", _status.Done))
+	assert.Equal(t, time.Duration(0), policy.maxAge("bob", _status.Error))
+
+	assert.Error(t, GCPolicy{Expiry: Expiry{Status: map[string]time.Duration{"Running": time.Hour}}}.Validate())
+	assert.Error(t, GCPolicy{Owner: map[string]Expiry{"bob": {MaxAge: -time.Hour}}}.Validate())
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "gc-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cleaned := make([]string, 0)
+	r := runner.New(dir, nil)
+	r.UseCleaner(func(project string) ([]string, error) {
+		cleaned = append(cleaned, project)
+		return []string{"network batch-" + project}, nil
+	})
+	s := New(NewResources(4, 16*1024), r, store.NewMemoryStore())
+	err = s.UseGC(GCPolicy{
+		Expiry: Expiry{MaxAge: time.Hour},
+		Owner: map[string]Expiry{
+			"bob": {Status: map[string]time.Duration{"Error": 0}},
+		},
+	})
+	assert.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour)
+	tasks := map[string]*_task.Task{
+		"expired": {Owner: "alice", Status: _status.Done, Mtime: old},
+		"fresh":   {Owner: "alice", Status: _status.Done, Mtime: time.Now()},
+		"kept":    {Owner: "bob", Status: _status.Error, Mtime: old},
+		"waiting": {Owner: "alice", Status: _status.Waiting, Mtime: old},
+	}
+	for _, task := range tasks {
+		task.Id, err = uuid.NewRandom()
+		assert.NoError(t, err)
+		task.Action = &_task.DummyAction{}
+		err = s.tasks.put(task)
+		assert.NoError(t, err)
+		err = os.Mkdir(path.Join(dir, task.Id.String()), 0750)
+		assert.NoError(t, err)
+	}
+	expired := tasks["expired"].Id
+	err = s.runs.Put(&RunRecord{Task: expired, Data: _run.Data{ID: 1}})
+	assert.NoError(t, err)
+	orphan, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	err = os.Mkdir(path.Join(dir, orphan.String()), 0750)
+	assert.NoError(t, err)
+
+	report, err := s.CollectGarbage()
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{expired}, report.Tasks)
+	assert.Len(t, report.Errors, 0)
+	assert.Len(t, report.Removed, 2)
+	assert.Contains(t, report.Removed[orphan.String()], "network batch-"+orphan.String())
+	assert.ElementsMatch(t, []string{expired.String(), orphan.String()}, cleaned)
+	assert.Equal(t, 3, s.Length())
+	_, total, err := s.Runs(expired, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+	for name, task := range tasks {
+		_, err = os.Stat(path.Join(dir, task.Id.String()))
+		if name == "expired" {
+			assert.True(t, os.IsNotExist(err))
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+	_, err = os.Stat(path.Join(dir, orphan.String()))
+	assert.True(t, os.IsNotExist(err))
+
+	reports, err := s.GCReports(0)
+	assert.NoError(t, err)
+	assert.Len(t, reports, 1)
+	assert.Equal(t, report.Tasks, reports[0].Tasks)
+}
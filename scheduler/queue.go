@@ -0,0 +1,139 @@
+package scheduler
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/factorysh/density/task"
+	"github.com/google/uuid"
+)
+
+// waiting is a task in the queue, with its wake up time
+type waiting struct {
+	task  *task.Task
+	wake  time.Time
+	index int
+}
+
+// queue is a min-heap of waiting tasks, ordered by wake up time
+type queue struct {
+	items []*waiting
+	byID  map[uuid.UUID]*waiting
+}
+
+func newQueue() *queue {
+	return &queue{
+		items: make([]*waiting, 0),
+		byID:  make(map[uuid.UUID]*waiting),
+	}
+}
+
+// heap.Interface implementation, don't use it directly
+
+func (q *queue) Len() int { return len(q.items) }
+
+func (q *queue) Less(i, j int) bool { return q.items[i].wake.Before(q.items[j].wake) }
+
+func (q *queue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.items[i].index = i
+	q.items[j].index = j
+}
+
+func (q *queue) Push(x interface{}) {
+	w := x.(*waiting)
+	w.index = len(q.items)
+	q.items = append(q.items, w)
+}
+
+func (q *queue) Pop() interface{} {
+	old := q.items
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	q.items = old[:n-1]
+	w.index = -1
+	return w
+}
+
+// Put a task in the queue, or move it if it's already there
+func (q *queue) Put(t *task.Task) {
+	w, ok := q.byID[t.Id]
+	if ok {
+		w.task = t
+		w.wake = t.Start
+		heap.Fix(q, w.index)
+		return
+	}
+	w = &waiting{
+		task: t,
+		wake: t.Start,
+	}
+	heap.Push(q, w)
+	q.byID[t.Id] = w
+}
+
+// Postpone a task, its wake up time is later than its start
+func (q *queue) Postpone(id uuid.UUID, wake time.Time) {
+	w, ok := q.byID[id]
+	if !ok {
+		return
+	}
+	w.wake = wake
+	heap.Fix(q, w.index)
+}
+
+// Remove a task from the queue
+func (q *queue) Remove(id uuid.UUID) *task.Task {
+	w, ok := q.byID[id]
+	if !ok {
+		return nil
+	}
+	heap.Remove(q, w.index)
+	delete(q.byID, id)
+	return w.task
+}
+
+// NextAfter returns the first wake up time after now
+func (q *queue) NextAfter(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(q.items) {
+			return
+		}
+		w := q.items[i].wake
+		if w.After(now) {
+			// children are later
+			if !found || w.Before(next) {
+				next = w
+				found = true
+			}
+			return
+		}
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	return next, found
+}
+
+// Due returns all the tasks waking before now, without order
+func (q *queue) Due(now time.Time) []*waiting {
+	due := make([]*waiting, 0)
+	q.walk(0, now, func(w *waiting) {
+		due = append(due, w)
+	})
+	return due
+}
+
+// walk the heap, a child is never before its parent
+func (q *queue) walk(i int, now time.Time, fn func(*waiting)) {
+	if i >= len(q.items) || q.items[i].wake.After(now) {
+		return
+	}
+	fn(q.items[i])
+	q.walk(2*i+1, now, fn)
+	q.walk(2*i+2, now, fn)
+}
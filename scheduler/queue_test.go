@@ -0,0 +1,49 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/task"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	q := newQueue()
+	now := time.Now()
+	_, ok := q.NextAfter(now)
+	assert.False(t, ok)
+
+	tasks := make([]*task.Task, 0)
+	for _, delta := range []time.Duration{3 * time.Minute, -time.Minute, time.Minute, -2 * time.Minute} {
+		tt := &task.Task{
+			Id:    uuid.New(),
+			Start: now.Add(delta),
+		}
+		tasks = append(tasks, tt)
+		q.Put(tt)
+	}
+	assert.Len(t, q.Due(now), 2)
+	next, ok := q.NextAfter(now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Minute), next)
+
+	// a late task waits for its window
+	q.Postpone(tasks[1].Id, now.Add(30*time.Second))
+	assert.Len(t, q.Due(now), 1)
+	next, _ = q.NextAfter(now)
+	assert.Equal(t, now.Add(30*time.Second), next)
+
+	assert.Equal(t, tasks[2], q.Remove(tasks[2].Id))
+	assert.Nil(t, q.Remove(tasks[2].Id))
+	q.Remove(tasks[1].Id)
+	next, _ = q.NextAfter(now)
+	assert.Equal(t, now.Add(3*time.Minute), next)
+
+	// moving a task
+	tasks[0].Start = now.Add(-time.Hour)
+	q.Put(tasks[0])
+	assert.Len(t, q.Due(now), 2)
+	assert.Equal(t, 2, q.Len())
+}
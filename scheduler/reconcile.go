@@ -0,0 +1,247 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/factorysh/density/pubsub"
+	"github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resource kinds
+const (
+	ContainerResource = "container"
+	NetworkResource   = "network"
+)
+
+// Resource is a container or a network found on the host
+type Resource struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Project string `json:"project"` // The task id, for the tasks of density
+	Running bool   `json:"running,omitempty"`
+	Egress  string `json:"egress,omitempty"` // Egress policy of a network
+}
+
+// Host lists and removes the resources left by the tasks
+type Host interface {
+	Inventory() ([]Resource, error)
+	Remove(Resource) error
+}
+
+// Reconcile actions
+const (
+	Adopt  = "adopt"
+	Kill   = "kill"
+	Report = "report"
+)
+
+// ReconcilePolicy tells what to do with the resources the scheduler doesn't count
+type ReconcilePolicy struct {
+	Orphans string `yaml:"orphans" json:"orphans"` // Without task : kill or report
+	Zombies string `yaml:"zombies" json:"zombies"` // Running for a finished task : adopt, kill or report
+}
+
+// Validate the policy, empty actions are report
+func (p ReconcilePolicy) Validate() error {
+	switch p.Orphans {
+	case "", Kill, Report:
+	default:
+		return fmt.Errorf("orphans can't be %s, use kill or report", p.Orphans)
+	}
+	switch p.Zombies {
+	case "", Adopt, Kill, Report:
+	default:
+		return fmt.Errorf("zombies can't be %s, use adopt, kill or report", p.Zombies)
+	}
+	return nil
+}
+
+// Finding kinds
+const (
+	OrphanFinding = "orphan"
+	ZombieFinding = "zombie"
+)
+
+// Finding is a resource without task, or running for a finished task
+type Finding struct {
+	Kind     string   `json:"kind"`
+	Resource Resource `json:"resource"`
+	Task     string   `json:"task,omitempty"`
+	Action   string   `json:"action"` // adopted, killed or reported
+	Error    string   `json:"error,omitempty"`
+}
+
+// ReconcileReport is what a reconciliation found, and did
+type ReconcileReport struct {
+	Date     time.Time       `json:"date"`
+	Policy   ReconcilePolicy `json:"policy"`
+	Findings []Finding       `json:"findings"`
+}
+
+// UseHost sets the host to reconcile with, at load time
+func (s *Scheduler) UseHost(host Host) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.host = host
+}
+
+// UseReconcilePolicy sets what to do with the resources found by a reconciliation
+func (s *Scheduler) UseReconcilePolicy(policy ReconcilePolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reconcile = policy
+	return nil
+}
+
+// Reconcile the tasks with the host : containers and networks without task,
+// and containers still running for finished tasks.
+func (s *Scheduler) Reconcile() (*ReconcileReport, error) {
+	s.lock.RLock()
+	host := s.host
+	policy := s.reconcile
+	s.lock.RUnlock()
+	if host == nil {
+		return nil, errors.New("no host to reconcile with")
+	}
+	resources, err := host.Inventory()
+	if err != nil {
+		return nil, err
+	}
+	// containers first, a network with containers can't be removed
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resources[i].Kind == ContainerResource && resources[j].Kind != ContainerResource
+	})
+	report := &ReconcileReport{
+		Date:     time.Now(),
+		Policy:   policy,
+		Findings: make([]Finding, 0),
+	}
+	adopted := make(map[uuid.UUID]error)
+	for _, r := range resources {
+		var t *task.Task
+		id, err := uuid.Parse(r.Project)
+		if err == nil {
+			t, err = s.tasks.Get(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		finding := Finding{
+			Resource: r,
+			Action:   "reported",
+		}
+		action := Report
+		switch {
+		case t == nil:
+			finding.Kind = OrphanFinding
+			action = policy.Orphans
+		case r.Kind == ContainerResource && r.Running && finished(t.Status):
+			finding.Kind = ZombieFinding
+			finding.Task = t.Id.String()
+			action = policy.Zombies
+		default:
+			continue
+		}
+		switch action {
+		case Kill:
+			err = host.Remove(r)
+			if err == nil {
+				finding.Action = "killed"
+			}
+		case Adopt:
+			// all the containers of a task are adopted together
+			var done bool
+			err, done = adopted[t.Id]
+			if !done {
+				err = s.adopt(t)
+				adopted[t.Id] = err
+			}
+			if err == nil {
+				finding.Action = "adopted"
+			}
+		}
+		if err != nil {
+			finding.Error = err.Error()
+		}
+		log.WithFields(log.Fields{
+			"kind":     finding.Kind,
+			"resource": r.Kind,
+			"name":     r.Name,
+			"project":  r.Project,
+			"action":   finding.Action,
+			"error":    finding.Error,
+		}).Warning("Reconcile")
+		report.Findings = append(report.Findings, finding)
+	}
+	s.lock.Lock()
+	s.reconciled = report
+	s.lock.Unlock()
+	return report, nil
+}
+
+// Reconciled returns the latest reconciliation, or nil
+func (s *Scheduler) Reconciled() *ReconcileReport {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.reconciled
+}
+
+// adopt a finished task whose containers are still running,
+// with the timeout left since its start, a late one times out at once
+func (s *Scheduler) adopt(t *task.Task) error {
+	if t.Run == nil {
+		return fmt.Errorf("task %s has no run to adopt", t.Id)
+	}
+	s.attach(t)
+	return nil
+}
+
+// deadline of a running task, from its start
+func deadline(t *task.Task) time.Time {
+	start := t.Start
+	if start.IsZero() && t.Run != nil {
+		start = t.Run.Data().Start
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+	return start.Add(t.MaxExectionTime)
+}
+
+// attach a watcher to a task already running, without starting it again.
+// Its resources are consumed, and its timeout is what is left since its start.
+func (s *Scheduler) attach(t *task.Task) {
+	s.lock.Lock()
+	s.queue.Remove(t.Id)
+	release := s.resources.Consume(t.CPU, t.RAM)
+	t.Status = _status.Running
+	s.running[t.Id] = t
+	ctx, cancel := context.WithDeadline(context.TODO(), deadline(t))
+	t.Cancel = cancel
+	s.watchers.Add(1)
+	err := s.tasks.Put(t)
+	s.lock.Unlock()
+	if err != nil {
+		log.WithError(err).WithField("id", t.Id).Error("Attach")
+	}
+	s.Pubsub.Publish(pubsub.Event{
+		Action: t.Status.String(),
+		Id:     t.Id,
+	})
+	go s.watch(ctx, t, t.Run, func() {
+		cancel()
+		release()
+	})
+}
@@ -0,0 +1,239 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/pubsub"
+	"github.com/factorysh/density/store"
+	_task "github.com/factorysh/density/task"
+	_run "github.com/factorysh/density/task/run"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHost struct {
+	resources []Resource
+	removed   []string
+}
+
+func (h *fakeHost) Inventory() ([]Resource, error) {
+	return h.resources, nil
+}
+
+func (h *fakeHost) Remove(r Resource) error {
+	h.removed = append(h.removed, r.Name)
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	s := New(NewResources(4, 16*1024), nil, store.NewMemoryStore())
+	_, err := s.Reconcile()
+	assert.Error(t, err)
+
+	tasks := make(map[string]*_task.Task)
+	for _, name := range []string{"running", "done", "zombie", "late"} {
+		id, err := uuid.NewRandom()
+		assert.NoError(t, err)
+		action := &_task.DummyAction{Name: name, Wait: time.Hour}
+		run, err := action.Up("", "", nil, 1)
+		assert.NoError(t, err)
+		task := &_task.Task{
+			Id:              id,
+			Owner:           "bob",
+			Action:          action,
+			Run:             run,
+			CPU:             1,
+			RAM:             512,
+			Status:          _status.Done,
+			Start:           time.Now(),
+			MaxExectionTime: time.Hour,
+		}
+		switch name {
+		case "running":
+			task.Status = _status.Running
+		case "zombie":
+			task.Start = time.Now().Add(-10 * time.Minute)
+		case "late":
+			// its deadline is over, since long
+			task.Start = time.Now().Add(-2 * time.Hour)
+		}
+		err = s.tasks.Put(task)
+		assert.NoError(t, err)
+		tasks[name] = task
+	}
+	host := &fakeHost{
+		resources: []Resource{
+			{Kind: NetworkResource, Name: "batch-bob-0-0", Project: "bob"},
+			{Kind: ContainerResource, Name: "orphan", Project: uuid.New().String(), Running: true},
+			{Kind: ContainerResource, Name: "running", Project: tasks["running"].Id.String(), Running: true},
+			{Kind: ContainerResource, Name: "done", Project: tasks["done"].Id.String()},
+			{Kind: ContainerResource, Name: "zombie", Project: tasks["zombie"].Id.String(), Running: true},
+			{Kind: ContainerResource, Name: "zombie-sidecar", Project: tasks["zombie"].Id.String(), Running: true},
+			{Kind: ContainerResource, Name: "late", Project: tasks["late"].Id.String(), Running: true},
+		},
+	}
+	s.UseHost(host)
+
+	report, err := s.Reconcile()
+	assert.NoError(t, err)
+	assert.Len(t, report.Findings, 5)
+	assert.Len(t, host.removed, 0)
+	kinds := make(map[string]string)
+	for _, f := range report.Findings {
+		assert.Equal(t, "reported", f.Action)
+		kinds[f.Resource.Name] = f.Kind
+	}
+	assert.Equal(t, map[string]string{
+		"orphan":         OrphanFinding,
+		"batch-bob-0-0":  OrphanFinding,
+		"zombie":         ZombieFinding,
+		"zombie-sidecar": ZombieFinding,
+		"late":           ZombieFinding,
+	}, kinds)
+	assert.Equal(t, report, s.Reconciled())
+
+	assert.Error(t, s.UseReconcilePolicy(ReconcilePolicy{Orphans: Adopt}))
+	err = s.UseReconcilePolicy(ReconcilePolicy{Orphans: Kill, Zombies: Adopt})
+	assert.NoError(t, err)
+	late := waitFor(s.Pubsub, 1, func(event pubsub.Event) bool {
+		return event.Id == tasks["late"].Id && event.Action == _status.Timeout.String()
+	})
+	report, err = s.Reconcile()
+	assert.NoError(t, err)
+	// containers before networks
+	assert.Equal(t, []string{"orphan", "batch-bob-0-0"}, host.removed)
+	for _, f := range report.Findings {
+		if f.Kind == ZombieFinding {
+			assert.Equal(t, "adopted", f.Action)
+			assert.Equal(t, "", f.Error)
+		}
+	}
+	// the late one has no time left
+	late.Wait()
+	stored, err := s.GetTask(tasks["late"].Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Timeout, stored.Status)
+
+	// the zombie keeps its start, and what is left of its timeout
+	stored, err = s.GetTask(tasks["zombie"].Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Running, stored.Status)
+	assert.True(t, stored.Start.Equal(tasks["zombie"].Start))
+	cpu, ram := s.resources.Free()
+	assert.Equal(t, 3, cpu)
+	assert.Equal(t, 16*1024-512, ram)
+	s.lock.RLock()
+	zombie, ok := s.running[stored.Id]
+	s.lock.RUnlock()
+	assert.True(t, ok)
+	zombie.Cancel()
+}
+
+// attachedRun is still running after a restart
+type attachedRun struct {
+	Start time.Time `json:"start"`
+}
+
+var attachedDeadlines = make(chan time.Time, 1)
+
+func (r *attachedRun) Down() error                       { return nil }
+func (r *attachedRun) RunnerID() (string, error)         { return "attached", nil }
+func (r *attachedRun) RegisteredName() string            { return "attached" }
+func (r *attachedRun) Status() (_run.Status, int, error) { return _run.Running, 0, nil }
+func (r *attachedRun) Data() _run.Data                   { return _run.Data{Start: r.Start, Running: true} }
+func (r *attachedRun) Wait(ctx context.Context) (_status.Status, error) {
+	deadline, _ := ctx.Deadline()
+	attachedDeadlines <- deadline
+	<-ctx.Done()
+	return _status.Canceled, nil
+}
+
+// upCounter never starts anything
+type upCounter struct {
+	ups int
+}
+
+func (u *upCounter) Up(*_task.Task) (_run.Run, error) {
+	u.ups++
+	return nil, errors.New("no up")
+}
+
+func (u *upCounter) GetHome() string {
+	return os.TempDir()
+}
+
+func TestLoadAttach(t *testing.T) {
+	_task.RunRegistry["attached"] = func() _run.Run {
+		return &attachedRun{}
+	}
+	s := store.NewMemoryStore()
+	start := time.Now().Add(-30 * time.Minute)
+	running := &_task.Task{
+		Id:              uuid.New(),
+		Owner:           "bob",
+		Action:          &_task.DummyAction{},
+		Run:             &attachedRun{Start: start},
+		CPU:             2,
+		RAM:             1024,
+		Status:          _status.Running,
+		Start:           start,
+		MaxExectionTime: time.Hour,
+	}
+	lost := &_task.Task{
+		Id:              uuid.New(),
+		Owner:           "bob",
+		Action:          &_task.DummyAction{},
+		Status:          _status.Running,
+		MaxExectionTime: time.Hour,
+	}
+	done := &_task.Task{
+		Id:              uuid.New(),
+		Owner:           "bob",
+		Action:          &_task.DummyAction{},
+		Status:          _status.Done,
+		MaxExectionTime: time.Hour,
+	}
+	js := NewJSONStore(s)
+	for _, task := range []*_task.Task{running, lost, done} {
+		assert.NoError(t, js.Put(task))
+	}
+
+	runner := &upCounter{}
+	schd := New(NewResources(4, 16*1024), runner, s)
+	err := schd.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, runner.ups)
+
+	select {
+	case deadline := <-attachedDeadlines:
+		assert.WithinDuration(t, start.Add(time.Hour), deadline, time.Second)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the running task is not watched")
+	}
+	task, err := schd.GetTask(running.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Running, task.Status)
+	cpu, ram := schd.resources.Free()
+	assert.Equal(t, 2, cpu)
+	assert.Equal(t, 16*1024-1024, ram)
+
+	task, err = schd.GetTask(lost.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Error, task.Status)
+	task, err = schd.GetTask(done.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Done, task.Status)
+
+	wait := waitFor(schd.Pubsub, 1, func(evt pubsub.Event) bool {
+		return evt.Id == running.Id && evt.Action == _status.Canceled.String()
+	})
+	assert.NoError(t, schd.Cancel(running.Id))
+	wait.Wait()
+	cpu, _ = schd.resources.Free()
+	assert.Equal(t, 4, cpu)
+}
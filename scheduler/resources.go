@@ -1,7 +1,6 @@
 package scheduler
 
 import (
-	"context"
 	"errors"
 	"sync"
 )
@@ -42,22 +41,30 @@ func (r *Resources) Check(cpu, ram int) error {
 	return nil
 }
 
-func (r *Resources) Consume(ctx context.Context, cpu, ram int) {
+// Consume resources, until release is called
+func (r *Resources) Consume(cpu, ram int) (release func()) {
 	r.lock.Lock()
 	r.cpu -= cpu
 	r.ram -= ram
 	r.processes++
 	r.lock.Unlock()
-	go func() {
-		select {
-		case <-ctx.Done():
+	once := &sync.Once{}
+	return func() {
+		once.Do(func() {
 			r.lock.Lock()
 			r.cpu += cpu
 			r.ram += ram
 			r.processes--
 			r.lock.Unlock()
-		}
-	}()
+		})
+	}
+}
+
+// Free returns available CPU and RAM
+func (r *Resources) Free() (int, int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cpu, r.ram
 }
 
 func (r *Resources) IsDoable(cpu, ram int) bool {
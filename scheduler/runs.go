@@ -0,0 +1,239 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/factorysh/density/store"
+	_run "github.com/factorysh/density/task/run"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunsBucket holds the runs, apart from the tasks
+const RunsBucket = "runs"
+
+// RunRecord is a run of a task
+type RunRecord struct {
+	Task   uuid.UUID      `json:"task"`
+	Status _status.Status `json:"status"` // Status of the task, when the run ended
+	_run.Data
+}
+
+func (r *RunRecord) key() []byte {
+	return []byte(fmt.Sprintf("%s/%010d", r.Task, r.ID))
+}
+
+// ended is the finish time, or the start of an unfinished run
+func (r *RunRecord) ended() time.Time {
+	if r.Finish.IsZero() {
+		return r.Start
+	}
+	return r.Finish
+}
+
+// Retention of runs, zero values keep everything
+type Retention struct {
+	Keep   int           `yaml:"keep"`    // Latest runs kept, by task
+	MaxAge time.Duration `yaml:"max_age"` // Older runs are removed
+}
+
+// RunRetention is a default retention, and retentions by status
+type RunRetention struct {
+	Retention `yaml:",inline"`
+	Status    map[string]Retention `yaml:"status"` // By status name : Done, Error, Timeout, Canceled
+}
+
+// Validate status names
+func (r RunRetention) Validate() error {
+	for name := range r.Status {
+		_, err := _status.Parse(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunStore stores runs, keyed by task and run id
+type RunStore struct {
+	store store.Store
+}
+
+// bucket of the store, or memory
+func bucket(s store.Store, name string) store.Store {
+	if b, ok := s.(store.Bucketed); ok {
+		bucket, err := b.Bucket(name)
+		if err == nil {
+			return bucket
+		}
+		log.WithError(err).WithField("bucket", name).Error("Bucket")
+	}
+	log.WithField("bucket", name).Warning("Bucket is kept in memory")
+	return store.NewMemoryStore()
+}
+
+// NewRunStore uses the runs bucket of the store, or memory
+func NewRunStore(s store.Store) *RunStore {
+	return &RunStore{bucket(s, RunsBucket)}
+}
+
+// Put a run
+func (r *RunStore) Put(run *RunRecord) error {
+	value, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(run.key(), value)
+}
+
+// forTask reads all the runs of a task, latest first
+func (r *RunStore) forTask(task uuid.UUID) ([]*RunRecord, error) {
+	prefix := []byte(task.String() + "/")
+	runs := make([]*RunRecord, 0)
+	read := func(k, v []byte) error {
+		var run RunRecord
+		err := json.Unmarshal(v, &run)
+		if err != nil {
+			return fmt.Errorf("run %s : %v", string(k), err)
+		}
+		runs = append(runs, &run)
+		return nil
+	}
+	var err error
+	if ranger, ok := r.store.(store.Ranger); ok {
+		err = ranger.ForEachPrefix(prefix, read)
+	} else {
+		err = r.store.ForEach(func(k, v []byte) error {
+			if strings.HasPrefix(string(k), string(prefix)) {
+				return read(k, v)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ID > runs[j].ID
+	})
+	return runs, nil
+}
+
+// MoveRuns stores the runs moved out of a task by its migration, latest first.
+// Their ids are guessed when missing, their status comes from the exit code.
+func (r *RunStore) MoveRuns(task uuid.UUID, runs []_run.Data) error {
+	for i, data := range runs {
+		record := &RunRecord{
+			Task: task,
+			Data: data,
+		}
+		if record.ID == 0 {
+			record.ID = len(runs) - i
+		}
+		record.Running = false
+		record.Status = _status.Done
+		if record.ExitCode != 0 {
+			record.Status = _status.Error
+		}
+		err := r.Put(record)
+		if err != nil {
+			return err
+		}
+	}
+	log.WithField("id", task).WithField("runs", len(runs)).Info("Runs moved out of the task")
+	return nil
+}
+
+// List a page of runs of a task, latest first, with the total
+func (r *RunStore) List(task uuid.UUID, offset, limit int) ([]*RunRecord, int, error) {
+	runs, err := r.forTask(task)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(runs)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit > 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return runs[offset:end], total, nil
+}
+
+// DeleteTask removes all the runs of a task
+func (r *RunStore) DeleteTask(task uuid.UUID) error {
+	runs, err := r.forTask(task)
+	if err != nil {
+		return err
+	}
+	return r.delete(runs)
+}
+
+func (r *RunStore) delete(runs []*RunRecord) error {
+	for _, run := range runs {
+		err := r.store.Delete(run.key())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune the runs of a task, running ones are kept
+func (r *RunStore) Prune(task uuid.UUID, retention RunRetention, now time.Time) (int, error) {
+	runs, err := r.forTask(task)
+	if err != nil {
+		return 0, err
+	}
+	// runs kept by status, latest first
+	kept := make(map[string]int)
+	todo := make([]*RunRecord, 0)
+	for _, run := range runs {
+		if run.Running {
+			continue
+		}
+		group := ""
+		policy := retention.Retention
+		if p, ok := retention.Status[run.Status.String()]; ok {
+			group = run.Status.String()
+			policy = p
+		}
+		if (policy.Keep > 0 && kept[group] >= policy.Keep) ||
+			(policy.MaxAge > 0 && now.Sub(run.ended()) > policy.MaxAge) {
+			todo = append(todo, run)
+			continue
+		}
+		kept[group]++
+	}
+	err = r.delete(todo)
+	if err != nil {
+		return 0, err
+	}
+	return len(todo), nil
+}
+
+// tasks having runs
+func (r *RunStore) tasks() ([]uuid.UUID, error) {
+	seen := make(map[string]bool)
+	ids := make([]uuid.UUID, 0)
+	err := r.store.ForEach(func(k, v []byte) error {
+		slash := strings.IndexByte(string(k), '/')
+		if slash == -1 || seen[string(k[:slash])] {
+			return nil
+		}
+		seen[string(k[:slash])] = true
+		id, err := uuid.ParseBytes(k[:slash])
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
@@ -0,0 +1,119 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/store"
+	_task "github.com/factorysh/density/task"
+	_run "github.com/factorysh/density/task/run"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunStore(t *testing.T) {
+	now := time.Now()
+	runs := NewRunStore(store.NewMemoryStore())
+	id, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	other, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	// one run by hour, 1 is the oldest, even ones fail
+	for i := 1; i <= 10; i++ {
+		status := _status.Done
+		if i%2 == 0 {
+			status = _status.Error
+		}
+		err = runs.Put(&RunRecord{
+			Task:   id,
+			Status: status,
+			Data: _run.Data{
+				ID:     i,
+				Finish: now.Add(time.Duration(i-10) * time.Hour),
+			},
+		})
+		assert.NoError(t, err)
+	}
+	err = runs.Put(&RunRecord{Task: other, Data: _run.Data{ID: 1}})
+	assert.NoError(t, err)
+
+	page, total, err := runs.List(id, 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, total)
+	assert.Len(t, page, 3)
+	assert.Equal(t, 10, page[0].ID)
+	page, _, err = runs.List(id, 8, 3)
+	assert.NoError(t, err)
+	assert.Len(t, page, 2)
+	assert.Equal(t, 1, page[1].ID)
+	page, _, err = runs.List(id, 20, 3)
+	assert.NoError(t, err)
+	assert.Len(t, page, 0)
+
+	// 3 successes, errors for 5h
+	n, err := runs.Prune(id, RunRetention{
+		Retention: Retention{Keep: 3},
+		Status: map[string]Retention{
+			"Error": {MaxAge: 5 * time.Hour},
+		},
+	}, now)
+	assert.NoError(t, err)
+	page, _, err = runs.List(id, 0, 0)
+	assert.NoError(t, err)
+	ids := make([]int, 0)
+	for _, run := range page {
+		ids = append(ids, run.ID)
+	}
+	assert.Equal(t, []int{10, 9, 8, 7, 6, 5}, ids)
+	assert.Equal(t, 4, n)
+
+	// running runs are kept
+	err = runs.Put(&RunRecord{Task: id, Data: _run.Data{ID: 11, Running: true}})
+	assert.NoError(t, err)
+	_, err = runs.Prune(id, RunRetention{Retention: Retention{Keep: 1}}, now)
+	assert.NoError(t, err)
+	_, total, err = runs.List(id, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+
+	err = runs.DeleteTask(id)
+	assert.NoError(t, err)
+	_, total, err = runs.List(id, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+	_, total, err = runs.List(other, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+
+	assert.Error(t, RunRetention{Status: map[string]Retention{"Failed": {}}}.Validate())
+}
+
+func TestLegacyRuns(t *testing.T) {
+	s := store.NewMemoryStore()
+	id, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	err = s.Put([]byte(id.String()), []byte(fmt.Sprintf(`{"version": 1, "id": "%s", "owner": "bob", "status": "Done",
+		"runs": [{"id": 2, "exit_code": 1}, {"id": 1}]}`, id)))
+	assert.NoError(t, err)
+
+	schd := New(NewResources(4, 16*1024), nil, s)
+	// the part of Load without docker, the migration moves the runs
+	err = schd.tasks.Load()
+	assert.NoError(t, err)
+	runs, total, err := schd.Runs(id, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, _status.Error, runs[0].Status)
+	assert.Equal(t, _status.Done, runs[1].Status)
+
+	raw, err := s.Get([]byte(id.String()))
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	err = json.Unmarshal(raw, &doc)
+	assert.NoError(t, err)
+	assert.NotContains(t, doc, "runs")
+	assert.Equal(t, float64(_task.SchemaVersion), doc["version"])
+}
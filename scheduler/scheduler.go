@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"sync"
 	"time"
@@ -13,6 +14,7 @@ import (
 	"github.com/factorysh/density/task"
 	_run "github.com/factorysh/density/task/run"
 	_status "github.com/factorysh/density/task/status"
+	"github.com/factorysh/density/task/window"
 	"github.com/factorysh/density/todo"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
@@ -20,7 +22,7 @@ import (
 
 type Scheduler struct {
 	resources            *Resources
-	tasks                *JSONStore
+	tasks                *TaskCache
 	lock                 sync.RWMutex
 	somethingNewHappened *todo.Todo
 	stop                 chan bool
@@ -28,6 +30,23 @@ type Scheduler struct {
 	Pubsub               *pubsub.PubSub
 	stopping             *sync.WaitGroup
 	started              bool
+	calendars            map[string]*window.Calendar
+	queue                *queue                   // waiting tasks
+	running              map[uuid.UUID]*task.Task // running tasks
+	timer                *time.Timer              // wake up for the next waiting task
+	runs                 *RunStore
+	retention            RunRetention
+	gc                   GCPolicy
+	gcLock               sync.Mutex
+	gcReports            *GCReports
+	host                 Host
+	reconcile            ReconcilePolicy
+	reconciled           *ReconcileReport // the latest reconciliation
+	shutdown             ShutdownPolicy
+	draining             bool               // no more starts, the scheduler is stopping
+	interrupted          map[uuid.UUID]bool // tasks stopped by the shutdown
+	deleted              map[uuid.UUID]bool // running tasks deleted, their watchers forget them
+	watchers             sync.WaitGroup     // running tasks watchers
 }
 
 type Runner interface {
@@ -35,22 +54,84 @@ type Runner interface {
 	GetHome() string
 }
 
+// Releaser frees what a runner holds for a task once its run is over, like its network
+type Releaser interface {
+	Release(id uuid.UUID) ([]string, error)
+}
+
 func New(resources *Resources, runner Runner, store _store.Store) *Scheduler {
-	return &Scheduler{
+	s := &Scheduler{
 		resources:            resources,
-		tasks:                &JSONStore{store},
+		tasks:                NewTaskCache(&JSONStore{store}),
 		somethingNewHappened: todo.New(),
 		stop:                 make(chan bool),
 		runner:               runner,
 		Pubsub:               pubsub.NewPubSub(),
 		stopping:             &sync.WaitGroup{},
 		started:              false,
+		calendars:            make(map[string]*window.Calendar),
+		runs:                 NewRunStore(store),
+		gcReports:            NewGCReports(store),
+		queue:                newQueue(),
+		running:              make(map[uuid.UUID]*task.Task),
+		interrupted:          make(map[uuid.UUID]bool),
+		deleted:              make(map[uuid.UUID]bool),
+	}
+	s.timer = time.AfterFunc(time.Hour, func() {
+		s.somethingNewHappened.Ping()
+	})
+	s.timer.Stop()
+	return s
+}
+
+// UseCalendar sets allowed run windows for all tasks of an owner
+func (s *Scheduler) UseCalendar(owner string, calendar *window.Calendar) error {
+	err := calendar.Validate()
+	if err != nil {
+		return err
 	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.calendars[owner] = calendar
+	return nil
+}
+
+// UseRetention sets how long runs are kept
+func (s *Scheduler) UseRetention(retention RunRetention) error {
+	err := retention.Validate()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.retention = retention
+	return nil
+}
+
+// opening returns the first moment, from now, when both task and owner calendars allow a run
+func (s *Scheduler) opening(t *task.Task, now time.Time) (time.Time, error) {
+	owner := s.calendars[t.Owner]
+	// each calendar skips to its next opening, until both agree
+	for i := 0; i < 32; i++ {
+		next, err := t.Calendar.Next(now)
+		if err != nil {
+			return now, err
+		}
+		next, err = owner.Next(next)
+		if err != nil {
+			return now, err
+		}
+		if next.Equal(now) {
+			return now, nil
+		}
+		now = next
+	}
+	return now, fmt.Errorf("calendars of task %s never agree", t.Id)
 }
 
 // Add a new task
 func (s *Scheduler) Add(task *task.Task) (uuid.UUID, error) {
-	if !s.started {
+	if !s.isStarted() {
 		return uuid.Nil, errors.New("Scheduler is not started")
 	}
 	if task.Id != uuid.Nil {
@@ -63,6 +144,16 @@ func (s *Scheduler) Add(task *task.Task) (uuid.UUID, error) {
 	if task.MaxExectionTime <= 0 {
 		return uuid.Nil, errors.New("MaxExectionTime must be > 0")
 	}
+	_, err = task.ConcurrencyGroup()
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if task.Calendar != nil {
+		err = task.Calendar.Validate()
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return uuid.Nil, err
@@ -74,9 +165,10 @@ func (s *Scheduler) Add(task *task.Task) (uuid.UUID, error) {
 	if err != nil {
 		return uuid.Nil, err
 	}
-	task.Cancel = func() {
-		task.Status = _status.Canceled
-	}
+	s.lock.Lock()
+	// the caller keeps its task, the scheduler changes its own
+	s.queue.Put(copyOf(task))
+	s.lock.Unlock()
 	s.somethingNewHappened.Ping()
 	s.Pubsub.Publish(pubsub.Event{
 		Action: "added",
@@ -87,84 +179,99 @@ func (s *Scheduler) Add(task *task.Task) (uuid.UUID, error) {
 
 // Load will fetch jobs data and status from storage
 func (s *Scheduler) Load() error {
-	if s.started {
+	if s.isStarted() {
 		return errors.New("don't load a started scheduler")
 	}
-	// to remove tasks
-	garbage := make([]*task.Task, 0)
+	err := s.tasks.Load()
+	if err != nil {
+		return err
+	}
 	// to update tasks
 	update := make([]*task.Task, 0)
+	// still running, to watch again
+	running := make([]*task.Task, 0)
 
-	err := s.tasks.ForEach(func(t *task.Task) error {
+	err = s.tasks.ForEach(func(t *task.Task) error {
 		// remember old status
 		old := t.Status
-		// fresh status
-		var fresh _status.Status
-		var status _run.Status
-		var exit int
-		var err error
+		// fresh status, only running tasks may have changed
+		fresh := old
 
-		// fetch status
-		if t.Run != nil {
-			status, exit, err = t.Run.Status()
-			if err != nil {
-				return err
+		if old == _status.Running {
+			var status _run.Status
+			var exit int
+			var err error
+
+			// fetch status
+			if t.Run != nil {
+				status, exit, err = t.Run.Status()
+				if err != nil {
+					return err
+				}
+			} else {
+				status = _run.Unkown
 			}
-		} else {
-			status = _run.Unkown
-		}
 
-		// map runner status to task status
-		switch status {
-		case _run.Running:
-			fresh = _status.Running
-			// exec task will consume ressources, attach a watcher to exesting task without relaunching the entire task
-			s.execTask(t)
-		case _run.Dead:
-			fresh = _status.Error
-		case _run.Exited:
-			if exit != 0 {
+			// map runner status to task status
+			switch status {
+			case _run.Running, _run.Paused, _run.Restarting:
+				// attached once the store is up to date, its watcher may end it
+				running = append(running, t)
+			case _run.Dead:
+				fresh = _status.Error
+			case _run.Exited:
+				if exit != 0 {
+					fresh = _status.Error
+				} else {
+					fresh = _status.Done
+				}
+			default:
+				// nothing left to watch
+				log.WithField("id", t.Id).Warning("Running task is lost")
 				fresh = _status.Error
-			} else {
-				fresh = _status.Done
 			}
-		case _run.Unkown:
-			// FIXME
-			update = append(update, t)
-		default:
-			// gc the ones not found
-			log.WithField("status", status).Info("Garbage")
-			garbage = append(garbage, t)
+			if fresh != _status.Running && t.Run != nil {
+				s.recordRun(t, t.Run, fresh, false)
+			}
 		}
 
-		// if status mismatch, update
-		if old != fresh {
-			t.Status = fresh
-			update = append(update, t)
-		} else if t.HasCron() && t.Status != _status.Running {
+		t.Status = fresh
+		reschedule := t.HasCron() && fresh != _status.Running && fresh != _status.Canceled
+		if reschedule {
 			t.Status = _status.Waiting
 			t.PrepareReschedule()
+		}
+		if t.Status != old || reschedule {
 			update = append(update, t)
 		}
+		if t.Status == _status.Waiting {
+			s.lock.Lock()
+			s.queue.Put(t)
+			s.lock.Unlock()
+		}
 		return nil
 	})
 	if err != nil {
 		return err
 	}
 
-	for _, t := range garbage {
-		log.WithField("id", t.Id).Info("removed while store load")
-		err := s.tasks.Delete(t.Id)
+	for _, t := range update {
+		log.WithField("id", t.Id).Info("Back in main loop while store load")
+		err := s.tasks.Put(t)
 		if err != nil {
 			return err
 		}
 	}
 
-	for _, t := range update {
-		log.WithField("id", t.Id).Info("Back in main loop while store load")
-		err := s.tasks.Put(t)
+	for _, t := range running {
+		log.WithField("id", t.Id).Info("Attached while store load")
+		s.attach(t)
+	}
+
+	if s.host != nil {
+		_, err = s.Reconcile()
 		if err != nil {
-			return err
+			log.WithError(err).Error("Reconcile")
 		}
 	}
 
@@ -174,30 +281,30 @@ func (s *Scheduler) Load() error {
 
 // Start is the main loop, non blocking
 func (s *Scheduler) Start(ctx context.Context) {
-	if s.started {
+	if s.isStarted() {
 		panic("Start once")
 	}
+	s.setStarted(true)
 	s.stopping.Add(1)
-	// FIXME, find all detached running tasks in s.tasks
 	log.Info("Starting main loop")
 	go func() {
 		for {
 			select { // waiting for a trigger
 			case <-s.stop:
-				err := s.tasks.store.Sync()
+				err := s.tasks.Sync()
+				s.setStarted(false)
 				s.stopping.Done()
 				if err != nil {
 					log.WithError(err).Error("Stop and sync")
 				}
-				s.started = false
 				log.Info("Scheduler loop is stopped")
 				return // stop the loop
 			case <-ctx.Done():
-				err := s.tasks.store.Sync()
+				err := s.tasks.Sync()
 				if err != nil {
 					log.WithError(err).Error("Context.Done and sync")
 				}
-				s.started = false
+				s.setStarted(false)
 				s.stopping.Done()
 				log.Info("Scheduler start context is done, loop is stopped.")
 				return // stop the loop
@@ -206,155 +313,274 @@ func (s *Scheduler) Start(ctx context.Context) {
 			s.oneLoop()
 		}
 	}()
-	s.started = true
+	s.lock.RLock()
+	every := s.gc.Every
+	s.lock.RUnlock()
+	if every > 0 {
+		go s.collectGarbage(ctx, every)
+	}
+}
+
+// isStarted tells if the main loop is running
+func (s *Scheduler) isStarted() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.started
+}
+
+func (s *Scheduler) setStarted(started bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.started = started
 }
 
 func (s *Scheduler) oneLoop() {
 	s.somethingNewHappened.Done()
-	todos := s.readyToGo()
-	if len(todos) > 0 { // Something todo
-		s.execTask(todos[0])
-		s.somethingNewHappened.Ping() // is there any // tasks waiting?
+	for _, t := range s.readyToGo() {
+		s.execTask(t)
+	}
+	s.wakeUp()
+}
+
+// wakeUp sets the timer for the next start, late tasks are waiting for a free slot
+func (s *Scheduler) wakeUp() {
+	n, ok := s.next()
+	if !ok { // no future
+		s.timer.Stop()
 		return
 	}
-	// nothing is ready just wait
-	now := time.Now()
-	n := s.next()
-	if n != nil {
-		sleep := n.Start.Sub(now)
-		time.AfterFunc(sleep, func() {
-			s.somethingNewHappened.Ping()
-		})
-	} // else no future
+	s.timer.Reset(time.Until(n))
 }
 
 // Exec chosen task
 func (s *Scheduler) execTask(chosen *task.Task) {
 	s.lock.Lock()
-	ctxResources, cancelResources := context.WithCancel(context.TODO())
-	s.resources.Consume(ctxResources, chosen.CPU, chosen.RAM)
+	s.queue.Remove(chosen.Id)
+	release := s.resources.Consume(chosen.CPU, chosen.RAM)
 	log.WithFields(log.Fields{
 		"cpu":     s.resources.cpu,
 		"ram":     s.resources.ram,
 		"process": s.resources.processes,
 	}).Info()
 	run, err := s.runner.Up(chosen)
-	// save the run to task runs history (latest first)
-	chosen.AddRunToHistory(run)
+	if run != nil {
+		if err == nil {
+			s.recordRun(chosen, run, _status.Running, true)
+		} else {
+			s.recordRun(chosen, run, _status.Error, false)
+		}
+	}
 	if err != nil {
 		chosen.Status = _status.Error
-		cancelResources()
+		release()
 		log.WithError(err).Error()
 		s.tasks.Put(chosen)
 		s.lock.Unlock()
+		// what the failed up holds, like its network
+		s.release(chosen.Id)
 		return
 	}
 	chosen.Status = _status.Running
 	chosen.Start = time.Now()
 	chosen.Run = run
+	s.running[chosen.Id] = chosen
 	s.tasks.Put(chosen)
 
 	ctx, cancel := context.WithTimeout(context.TODO(), chosen.MaxExectionTime)
+	chosen.Cancel = cancel
 
 	cleanup := func() {
 		cancel()
-		cancelResources()
+		release()
 	}
 	s.Pubsub.Publish(pubsub.Event{
 		Action: chosen.Status.String(),
 		Id:     chosen.Id,
 	})
+	s.watchers.Add(1)
 	s.lock.Unlock()
-	go func(ctx context.Context, task *task.Task, run _run.Run, cleanup func()) {
-		defer cleanup()
-		status, err := run.Wait(ctx)
-		if err != nil {
-			log.WithError(err).Error()
-		}
-		task.Status = status
-		if task.HasCron() {
-			task.Status = _status.Waiting
-			task.PrepareReschedule()
-		}
-		s.tasks.Put(task)
-		s.Pubsub.Publish(pubsub.Event{
-			Action: task.Status.String(),
-			Id:     task.Id,
-		})
-		s.somethingNewHappened.Ping() // a slot is now free, let's try to full it
-	}(ctx, chosen, run, cleanup)
+	go s.watch(ctx, chosen, run, cleanup)
 }
 
-// List all the tasks associated with this scheduler
-func (s *Scheduler) List() []*task.Task {
-	tasks := make([]*task.Task, 0)
-
-	s.tasks.ForEach(func(t *task.Task) error {
-		tasks = append(tasks, t)
-		return nil
+// watch a running task until its end
+func (s *Scheduler) watch(ctx context.Context, task *task.Task, run _run.Run, cleanup func()) {
+	defer s.watchers.Done()
+	status, err := run.Wait(ctx)
+	if err != nil {
+		log.WithError(err).Error()
+	}
+	// resources are free before telling the loop
+	cleanup()
+	s.release(task.Id)
+	s.lock.Lock()
+	if s.deleted[task.Id] {
+		// nothing to record, the task is gone
+		delete(s.deleted, task.Id)
+		s.lock.Unlock()
+		s.somethingNewHappened.Ping()
+		return
+	}
+	s.lock.Unlock()
+	s.recordRun(task, run, status, false)
+	s.pruneRuns(task.Id)
+	s.lock.Lock()
+	delete(s.running, task.Id)
+	task.Status = status
+	if s.interrupted[task.Id] {
+		// started again by the next Load
+		delete(s.interrupted, task.Id)
+		task.Status = _status.Waiting
+	} else if task.HasCron() && status != _status.Canceled {
+		task.Status = _status.Waiting
+		task.PrepareReschedule()
+		s.queue.Put(task)
+	}
+	s.tasks.Put(task)
+	s.lock.Unlock()
+	s.Pubsub.Publish(pubsub.Event{
+		Action: task.Status.String(),
+		Id:     task.Id,
 	})
+	s.somethingNewHappened.Ping() // a slot is now free, let's try to full it
+}
 
-	return tasks
+// release what the runner holds for a finished run
+func (s *Scheduler) release(id uuid.UUID) {
+	releaser, ok := s.runner.(Releaser)
+	if !ok {
+		return
+	}
+	released, err := releaser.Release(id)
+	l := log.WithField("id", id).WithField("released", released)
+	if err != nil {
+		l.WithError(err).Error("Release")
+		return
+	}
+	l.Info("Released")
 }
 
-// Filter tasks for a specific owner
-func (s *Scheduler) Filter(owner string, labels map[string]string) []*task.Task {
-	tasks := make([]*task.Task, 0)
+// recordRun saves a run in the history
+func (s *Scheduler) recordRun(t *task.Task, run _run.Run, status _status.Status, running bool) {
+	record := &RunRecord{
+		Task:   t.Id,
+		Status: status,
+		Data:   run.Data(),
+	}
+	record.ID = t.RunCounter
+	record.Running = running
+	if record.Start.IsZero() {
+		record.Start = t.Start
+	}
+	if !running && record.Finish.IsZero() {
+		record.Finish = time.Now()
+	}
+	err := s.runs.Put(record)
+	if err != nil {
+		log.WithError(err).WithField("id", t.Id).Error("Run history")
+	}
+}
 
+// pruneRuns applies the retention to the runs of a task
+func (s *Scheduler) pruneRuns(id uuid.UUID) int {
 	s.lock.RLock()
-	defer s.lock.RUnlock()
+	retention := s.retention
+	s.lock.RUnlock()
+	n, err := s.runs.Prune(id, retention, time.Now())
+	if err != nil {
+		log.WithError(err).WithField("id", id).Error("Run retention")
+	}
+	return n
+}
 
-	s.tasks.ForEach(func(t *task.Task) error {
-		if owner != "" && t.Owner != owner {
-			return nil
-		}
-		for key, value := range labels {
-			taskValue, found := t.Labels[key]
-			if !found || taskValue != value {
-				return nil
-			}
-		}
-		tasks = append(tasks, t)
-		return nil
-	})
+// Runs of a task, a page of them, latest first, and the total
+func (s *Scheduler) Runs(id uuid.UUID, offset, limit int) ([]*RunRecord, int, error) {
+	return s.runs.List(id, offset, limit)
+}
+
+// List all the tasks associated with this scheduler
+func (s *Scheduler) List() []*task.Task {
+	return s.Filter("", nil)
+}
 
+// Filter tasks for a specific owner
+func (s *Scheduler) Filter(owner string, labels map[string]string) []*task.Task {
+	tasks, err := s.Query(TaskQuery{
+		Owner:  owner,
+		Labels: labels,
+	})
+	if err != nil {
+		log.WithError(err).Error("Filter")
+		return []*task.Task{}
+	}
 	return tasks
 }
 
+// Query tasks, the oldest first
+func (s *Scheduler) Query(q TaskQuery) ([]*task.Task, error) {
+	return s.tasks.Query(q)
+}
+
+// readyToGo returns waiting tasks that can start now, all together, the best karma first
 func (s *Scheduler) readyToGo() []*task.Task {
 	now := time.Now()
 	tasks := make(task.TaskByKarma, 0)
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	s.tasks.ForEach(func(task *task.Task) error {
-		// enough CPU, enough RAM, Start date is okay
-		if task.Start.Before(now) && task.Status == _status.Waiting && s.resources.IsDoable(task.CPU, task.RAM) {
-			tasks = append(tasks, task)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.draining {
+		return tasks
+	}
+	for _, w := range s.queue.Due(now) {
+		// in its run window
+		opening, err := s.opening(w.task, now)
+		if err != nil {
+			log.WithError(err).WithField("id", w.task.Id).Error("Calendar")
+			continue
 		}
-		return nil
-	})
+		if opening.After(now) {
+			s.queue.Postpone(w.task.Id, opening)
+			continue
+		}
+		tasks = append(tasks, w.task)
+	}
 	sort.Sort(tasks)
-	return tasks
+	// running tasks by concurrency group
+	running := make(map[string]int)
+	for _, t := range s.running {
+		group, err := t.ConcurrencyGroup()
+		if err == nil && group != "" {
+			running[group]++
+		}
+	}
+	cpu, ram := s.resources.Free()
+	ready := make([]*task.Task, 0, len(tasks))
+	for _, t := range tasks {
+		// enough CPU, enough RAM
+		if t.CPU > cpu || t.RAM > ram {
+			continue
+		}
+		group, err := t.ConcurrencyGroup()
+		if err != nil {
+			log.WithError(err).WithField("id", t.Id).Error("Concurrency group")
+			continue
+		}
+		if group != "" {
+			if running[group] >= t.ConcurrencyLimit() {
+				continue
+			}
+			running[group]++
+		}
+		cpu -= t.CPU
+		ram -= t.RAM
+		ready = append(ready, t)
+	}
+	return ready
 }
 
-func (s *Scheduler) next() *task.Task {
-	if s.tasks.Length() == 0 {
-		return nil
-	}
+// next returns the next time a waiting task should start
+func (s *Scheduler) next() (time.Time, bool) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	tasks := make(task.TaskByStart, 0)
-	s.tasks.ForEach(func(task *task.Task) error {
-		if task.Status == _status.Waiting {
-			tasks = append(tasks, task)
-		}
-		return nil
-	})
-	if len(tasks) == 0 {
-		return nil
-	}
-	sort.Sort(tasks)
-	return tasks[0]
+	return s.queue.NextAfter(time.Now())
 }
 
 func (s *Scheduler) GetTask(id uuid.UUID) (*task.Task, error) {
@@ -363,9 +589,16 @@ func (s *Scheduler) GetTask(id uuid.UUID) (*task.Task, error) {
 
 // Cancel a task
 func (s *Scheduler) Cancel(id uuid.UUID) error {
-	task, err := s.tasks.Get(id)
-	if err != nil {
-		return err
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the live task, when it runs
+	task, ok := s.running[id]
+	if !ok {
+		var err error
+		task, err = s.tasks.Get(id)
+		if err != nil {
+			return err
+		}
 	}
 
 	if task == nil {
@@ -376,18 +609,13 @@ func (s *Scheduler) Cancel(id uuid.UUID) error {
 		return nil
 	}
 
-	// TODO: find a way to generate a Cancel method when getting the task from
-	// the memory store
-	task.Cancel = func() {
-		if task.Run != nil {
-			task.Run.Down()
-		}
-		task.Status = _status.Canceled
-	}
+	s.queue.Remove(id)
 
-	if task.Status == _status.Running {
+	// its watcher stops it
+	if task.Status == _status.Running && task.Cancel != nil {
 		task.Cancel()
 	}
+	task.Status = _status.Canceled
 	task.Mtime = time.Now()
 	return s.tasks.Put(task)
 }
@@ -403,10 +631,23 @@ func (s *Scheduler) Delete(id uuid.UUID) error {
 		return fmt.Errorf("unknown id %s", id.String())
 	}
 
+	s.lock.Lock()
+	s.queue.Remove(id)
+	if _, running := s.running[id]; running {
+		// its watcher doesn't record it again
+		delete(s.running, id)
+		s.deleted[id] = true
+	}
+	s.lock.Unlock()
+
 	if task.Status == _status.Running && task.Run != nil {
 		task.Run.Down()
 	}
 
+	err = s.runs.DeleteTask(id)
+	if err != nil {
+		return err
+	}
 	return s.tasks.Delete(id)
 }
 
@@ -415,28 +656,107 @@ func (s *Scheduler) Length() int {
 	return s.tasks.Length()
 }
 
-// Flush removes all done Tasks
+// Flush removes all done Tasks, with their runs, and applies the runs retention
 func (s *Scheduler) Flush(age time.Duration) int {
-	now := time.Now()
+	defer s.FlushRuns()
+	old, err := s.Query(TaskQuery{
+		Status: []_status.Status{_status.Done, _status.Timeout, _status.Canceled, _status.Error},
+		Until:  time.Now().Add(-age),
+	})
+	if err != nil {
+		log.WithError(err).Error("Flush")
+		return 0
+	}
+	if len(old) == 0 {
+		return 0
+	}
+	ids := make(map[uuid.UUID]bool, len(old))
+	for _, t := range old {
+		ids[t.Id] = true
+	}
 	i := 0
-	s.tasks.DeleteWithClause(func(task *task.Task) bool {
-		if task.Status != _status.Running && task.Status != _status.Waiting && now.Sub(task.Mtime) > age {
+	err = s.tasks.DeleteWithClause(func(task *task.Task) bool {
+		// the status may have changed since the query
+		if ids[task.Id] && task.Status != _status.Running && task.Status != _status.Waiting {
 			i++
 			return true
 		}
+		ids[task.Id] = false
 		return false
 	})
-
+	if err != nil {
+		log.WithError(err).Error("Flush")
+		return i
+	}
+	for id, deleted := range ids {
+		if !deleted {
+			continue
+		}
+		err = s.runs.DeleteTask(id)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Error("Flush runs")
+		}
+	}
 	return i
 }
 
+// FlushRuns applies the runs retention to all the tasks
+func (s *Scheduler) FlushRuns() int {
+	ids, err := s.runs.tasks()
+	if err != nil {
+		log.WithError(err).Error("Flush runs")
+		return 0
+	}
+	n := 0
+	for _, id := range ids {
+		t, err := s.tasks.Get(id)
+		if err == nil && t == nil {
+			// runs of a forgotten task
+			err = s.runs.DeleteTask(id)
+			if err != nil {
+				log.WithError(err).WithField("id", id).Error("Flush runs")
+			}
+			continue
+		}
+		n += s.pruneRuns(id)
+	}
+	return n
+}
+
+// Export all the tasks, as JSON lines
+func (s *Scheduler) Export(w io.Writer) (int, error) {
+	return s.tasks.store.Export(w)
+}
+
+// Import tasks, as JSON lines, waiting tasks are scheduled
+func (s *Scheduler) Import(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	tasks, report, err := importTasks(s.tasks, r, opts)
+	if err != nil {
+		return report, err
+	}
+	s.lock.Lock()
+	for _, t := range tasks {
+		if t.Status == _status.Waiting {
+			s.queue.Put(t)
+		}
+	}
+	s.lock.Unlock()
+	s.somethingNewHappened.Ping()
+	return report, nil
+}
+
+// Backup writes a copy of the whole store
+func (s *Scheduler) Backup(w io.Writer) (int64, error) {
+	return s.tasks.store.Backup(w)
+}
+
 // GetDataDir will return data dir for current runner
 func (s *Scheduler) GetDataDir() string {
 	return s.runner.GetHome()
 }
 
 func (s *Scheduler) WaitStop() {
-	if !s.started {
+	if !s.isStarted() {
 		panic("Scheduler not started.")
 	}
 	s.stopping.Wait()
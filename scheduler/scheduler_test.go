@@ -2,10 +2,13 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"path"
 	"sync"
 	"testing"
 	"time"
@@ -16,7 +19,9 @@ import (
 	"github.com/factorysh/density/store"
 	_task "github.com/factorysh/density/task"
 	_ "github.com/factorysh/density/task/compose" // registering compose
+	_run "github.com/factorysh/density/task/run"
 	_status "github.com/factorysh/density/task/status"
+	"github.com/factorysh/density/task/window"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
@@ -26,10 +31,11 @@ func waitFor(ps *pubsub.PubSub, size int, clause func(evt pubsub.Event) bool) *s
 	wait := &sync.WaitGroup{}
 	wait.Add(size)
 
+	// subscribe before returning, events published just after must not be missed
+	ctx, cancel := context.WithCancel(context.TODO())
+	events := ps.Subscribe(ctx)
 	go func(ps *pubsub.PubSub, size int, clause func(evt pubsub.Event) bool) {
-		ctx, cancel := context.WithCancel(context.TODO())
 		defer cancel()
-		events := ps.Subscribe(ctx)
 		for {
 			event := <-events
 			if clause(event) {
@@ -47,6 +53,23 @@ func waitFor(ps *pubsub.PubSub, size int, clause func(evt pubsub.Event) bool) *s
 	return wait
 }
 
+// put a task in the scheduler, bypassing Add and the main loop
+func put(s *Scheduler, task *_task.Task) error {
+	err := s.tasks.Put(task)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch task.Status {
+	case _status.Waiting:
+		s.queue.Put(task)
+	case _status.Running:
+		s.running[task.Id] = task
+	}
+	return nil
+}
+
 func TestWaitFor(t *testing.T) {
 	ps := pubsub.NewPubSub()
 	n := 1000
@@ -86,10 +109,10 @@ func TestSchedulerStartStop(t *testing.T) {
 	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
 	ctx, cancel := context.WithCancel(context.Background())
 	s.Start(ctx)
-	assert.True(t, s.started)
+	assert.True(t, s.isStarted())
 	cancel()
 	s.WaitStop()
-	assert.False(t, s.started)
+	assert.False(t, s.isStarted())
 }
 
 func TestScheduler(t *testing.T) {
@@ -100,7 +123,7 @@ func TestScheduler(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	s.Start(ctx)
-	assert.True(t, s.started)
+	assert.True(t, s.isStarted())
 	wait := waitFor(s.Pubsub, 1, func(event pubsub.Event) bool {
 		return event.Action == "Done"
 	})
@@ -234,7 +257,88 @@ func TestRunsHistory(t *testing.T) {
 	fromStorage, err := s.tasks.Get(task.Id)
 	assert.NoError(t, err)
 	assert.Equal(t, _status.Done, fromStorage.Status)
-	assert.Equal(t, 1, len(fromStorage.Runs))
+	runs, total, err := s.Runs(task.Id, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, runs[0].ID)
+	assert.Equal(t, _status.Done, runs[0].Status)
+	assert.False(t, runs[0].Running)
+	assert.False(t, runs[0].Finish.IsZero())
+}
+
+func TestDeleteRunning(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	wait := waitFor(s.Pubsub, 1, func(event pubsub.Event) bool {
+		return event.Action == "Running"
+	})
+	task := &_task.Task{
+		Start:           time.Now(),
+		CPU:             2,
+		RAM:             256,
+		MaxExectionTime: 2 * time.Second,
+		Action: &_task.DummyAction{
+			Name: "Deleted while running",
+			Wait: 300 * time.Millisecond,
+		},
+	}
+	_, err = s.Add(task)
+	assert.NoError(t, err)
+	wait.Wait()
+	err = s.Delete(task.Id)
+	assert.NoError(t, err)
+	// the watcher ends without writing anything
+	s.watchers.Wait()
+	fromStorage, err := s.tasks.Get(task.Id)
+	assert.NoError(t, err)
+	assert.Nil(t, fromStorage)
+	_, total, err := s.Runs(task.Id, 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+}
+
+func TestReleaseFinished(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	r := runner.New(dir, nil)
+	released := make(chan string, 1)
+	r.UseCleaner(func(project string) ([]string, error) {
+		released <- project
+		return []string{"network batch-" + project}, nil
+	})
+	s := New(NewResources(4, 16*1024), r, store.NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	task := &_task.Task{
+		Start:           time.Now(),
+		CPU:             2,
+		RAM:             256,
+		MaxExectionTime: 2 * time.Second,
+		Action: &_task.DummyAction{
+			Name: "Released",
+			Wait: 100 * time.Millisecond,
+		},
+	}
+	_, err = s.Add(task)
+	assert.NoError(t, err)
+	select {
+	case project := <-released:
+		assert.Equal(t, task.Id.String(), project)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run is not released")
+	}
+	// the working directory is kept until the task is collected
+	_, err = os.Stat(path.Join(dir, task.Id.String()))
+	assert.NoError(t, err)
 }
 
 func TestTimeout(t *testing.T) {
@@ -275,6 +379,75 @@ func TestTimeout(t *testing.T) {
 	})
 }
 
+func TestConcurrencyKey(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
+
+	for i, st := range []_status.Status{_status.Running, _status.Waiting, _status.Waiting} {
+		err := put(s, &_task.Task{
+			Id:              uuid.New(),
+			Start:           time.Now().Add(-time.Second),
+			CPU:             1,
+			RAM:             128,
+			MaxExectionTime: time.Second,
+			Status:          st,
+			ConcurrencyKey:  "deploy-{{ .Labels.env }}",
+			Labels: map[string]string{
+				"env": "prod",
+			},
+			Action: &_task.DummyAction{
+				Name: fmt.Sprintf("Deploy #%d", i),
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, s.readyToGo(), 0)
+
+	for _, task := range s.running {
+		task.Concurrency = 2
+	}
+	for _, w := range s.queue.items {
+		w.task.Concurrency = 2
+	}
+	assert.Len(t, s.readyToGo(), 1)
+}
+
+func TestCalendar(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
+
+	now := time.Now()
+	err = put(s, &_task.Task{
+		Id:              uuid.New(),
+		Owner:           "bob",
+		Start:           now.Add(-time.Second),
+		CPU:             1,
+		RAM:             128,
+		MaxExectionTime: time.Second,
+		Status:          _status.Waiting,
+		Action: &_task.DummyAction{
+			Name: "Reindex",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, s.readyToGo(), 1)
+
+	// no run today
+	err = s.UseCalendar("bob", &window.Calendar{
+		Blackouts: []string{now.Format("2006-01-02")},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, s.readyToGo(), 0)
+	next, ok := s.next()
+	assert.True(t, ok)
+	y, m, d := now.AddDate(0, 0, 1).Date()
+	assert.Equal(t, time.Date(y, m, d, 0, 0, 0, 0, time.Local), next)
+}
+
 func TestLoad(t *testing.T) {
 	// can't run in CI since access to docker host can be limited
 	if os.Getenv("CI") != "" {
@@ -435,3 +608,61 @@ func TestCancel(t *testing.T) {
 }
 
 */
+
+// leasingAction takes a lease, then fails to start
+type leasingAction struct {
+	ledger *compose.Ledger
+}
+
+func (a *leasingAction) Validate() error        { return nil }
+func (a *leasingAction) RegisteredName() string { return "leasing" }
+func (a *leasingAction) Up(project, pwd string, environments map[string]string, runID int) (_run.Run, error) {
+	_, err := a.ledger.Lease(project, func(used []*net.IPNet) ([]*net.IPNet, error) {
+		_, subnet, err := net.ParseCIDR("172.18.0.0/24")
+		return []*net.IPNet{subnet}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nil, errors.New("can't start")
+}
+
+func TestReleaseFailedUp(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ledger := compose.NewLedger(store.NewMemoryStore())
+	r := runner.New(dir, nil)
+	released := make(chan string, 1)
+	r.UseCleaner(func(project string) ([]string, error) {
+		err := ledger.Release(project)
+		released <- project
+		return []string{"lease " + project}, err
+	})
+	s := New(NewResources(4, 16*1024), r, store.NewMemoryStore())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+
+	task := &_task.Task{
+		Start:           time.Now(),
+		CPU:             2,
+		RAM:             256,
+		MaxExectionTime: 2 * time.Second,
+		Action:          &leasingAction{ledger: ledger},
+	}
+	_, err = s.Add(task)
+	assert.NoError(t, err)
+	select {
+	case project := <-released:
+		assert.Equal(t, task.Id.String(), project)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed up is not released")
+	}
+	leases, err := ledger.Leases()
+	assert.NoError(t, err)
+	assert.Empty(t, leases)
+	stored, err := s.GetTask(task.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Error, stored.Status)
+}
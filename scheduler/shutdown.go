@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/factorysh/density/task"
+	log "github.com/sirupsen/logrus"
+)
+
+// Shutdown policies
+const (
+	Drain  = "drain"
+	Stop   = "stop"
+	Detach = "detach"
+)
+
+// defaultStopTimeout is how long stopped tasks have to write their status
+const defaultStopTimeout = 30 * time.Second
+
+// ShutdownPolicy tells what happens to the running tasks, when the scheduler stops
+type ShutdownPolicy struct {
+	Policy   string        `yaml:"policy"`   // drain, stop or detach, the default
+	Timeout  time.Duration `yaml:"timeout"`  // Drain deadline, or how long stopped tasks are waited for
+	Fallback string        `yaml:"fallback"` // What happens to the tasks not drained : stop or detach, the default
+}
+
+// Validate the policy
+func (p ShutdownPolicy) Validate() error {
+	switch p.Policy {
+	case "", Drain, Stop, Detach:
+	default:
+		return fmt.Errorf("unknown shutdown policy %s, use drain, stop or detach", p.Policy)
+	}
+	switch p.Fallback {
+	case "", Stop, Detach:
+	default:
+		return fmt.Errorf("unknown shutdown fallback %s, use stop or detach", p.Fallback)
+	}
+	if p.Policy == Drain && p.Timeout <= 0 {
+		return fmt.Errorf("draining needs a timeout")
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("negative timeout : %v", p.Timeout)
+	}
+	return nil
+}
+
+// UseShutdown sets what happens to the running tasks, when the scheduler stops
+func (s *Scheduler) UseShutdown(policy ShutdownPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.shutdown = policy
+	return nil
+}
+
+// Shutdown stops starting tasks, and applies the shutdown policy to the running ones.
+// The decision is recorded in each task : drained tasks ended in time,
+// stopped tasks are waiting for the next start, detached tasks are attached again by Load.
+func (s *Scheduler) Shutdown() error {
+	s.lock.Lock()
+	s.draining = true
+	policy := s.shutdown
+	running := make([]*task.Task, 0, len(s.running))
+	for _, t := range s.running {
+		running = append(running, t)
+	}
+	s.lock.Unlock()
+	if policy.Policy == "" {
+		policy.Policy = Detach
+	}
+	if policy.Fallback == "" {
+		policy.Fallback = Detach
+	}
+	l := log.WithField("policy", policy.Policy).WithField("running", len(running))
+	l.Info("Shutdown")
+
+	action := policy.Policy
+	if action == Drain {
+		drained := s.waitWatchers(policy.Timeout)
+		for _, t := range running {
+			s.lock.Lock()
+			_, still := s.running[t.Id]
+			s.lock.Unlock()
+			if !still {
+				s.decide(t, policy.Policy, "drained")
+			}
+		}
+		if drained {
+			l.Info("All tasks are drained")
+			return s.tasks.Sync()
+		}
+		action = policy.Fallback
+	}
+
+	s.lock.Lock()
+	left := make([]*task.Task, 0, len(s.running))
+	for _, t := range s.running {
+		left = append(left, t)
+		if action == Stop {
+			s.interrupted[t.Id] = true
+		}
+	}
+	s.lock.Unlock()
+	for _, t := range left {
+		switch action {
+		case Stop:
+			s.decide(t, policy.Policy, "stopped")
+			if t.Cancel != nil {
+				t.Cancel()
+			}
+		default:
+			s.decide(t, policy.Policy, "detached")
+		}
+	}
+	if action == Stop {
+		timeout := policy.Timeout
+		if timeout == 0 || policy.Policy == Drain {
+			timeout = defaultStopTimeout
+		}
+		if !s.waitWatchers(timeout) {
+			l.Warning("Some stopped tasks are still running")
+		}
+	}
+	l.WithField("action", action).WithField("left", len(left)).Info("Shutdown is done")
+	return s.tasks.Sync()
+}
+
+// decide records the shutdown decision in a task
+func (s *Scheduler) decide(t *task.Task, policy, action string) {
+	s.lock.Lock()
+	t.Shutdown = &task.Shutdown{
+		Policy: policy,
+		Action: action,
+		Date:   time.Now(),
+	}
+	err := s.tasks.put(t)
+	s.lock.Unlock()
+	if err != nil {
+		log.WithError(err).WithField("id", t.Id).Error("Shutdown")
+	}
+}
+
+// waitWatchers waits for the end of all the running tasks, until the timeout
+func (s *Scheduler) waitWatchers(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		s.watchers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/pubsub"
+	"github.com/factorysh/density/runner"
+	"github.com/factorysh/density/store"
+	_task "github.com/factorysh/density/task"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTasks adds dummy tasks, and waits until they are running
+func startTasks(t *testing.T, s *Scheduler, waits ...time.Duration) []uuid.UUID {
+	wait := waitFor(s.Pubsub, len(waits), func(evt pubsub.Event) bool {
+		return evt.Action == _status.Running.String()
+	})
+	ids := make([]uuid.UUID, len(waits))
+	for i, w := range waits {
+		id, err := s.Add(&_task.Task{
+			Owner:           "bob",
+			Start:           time.Now(),
+			MaxExectionTime: time.Hour,
+			Action: &_task.DummyAction{
+				Name: "shutdown",
+				Wait: w,
+			},
+			CPU: 1,
+			RAM: 256,
+		})
+		assert.NoError(t, err)
+		ids[i] = id
+	}
+	wait.Wait()
+	return ids
+}
+
+func TestShutdownStop(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
+	assert.Error(t, s.UseShutdown(ShutdownPolicy{Policy: Drain}))
+	assert.Error(t, s.UseShutdown(ShutdownPolicy{Policy: Stop, Fallback: Drain}))
+	err = s.UseShutdown(ShutdownPolicy{Policy: Stop, Timeout: time.Second})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	ids := startTasks(t, s, time.Hour)
+
+	err = s.Shutdown()
+	assert.NoError(t, err)
+	task, err := s.GetTask(ids[0])
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Waiting, task.Status)
+	assert.Equal(t, Stop, task.Shutdown.Policy)
+	assert.Equal(t, "stopped", task.Shutdown.Action)
+	// nothing starts anymore
+	assert.Len(t, s.readyToGo(), 0)
+	runs, _, err := s.Runs(ids[0], 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Canceled, runs[0].Status)
+}
+
+func TestShutdownDrain(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "scheduler-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := New(NewResources(4, 16*1024), runner.New(dir, nil), store.NewMemoryStore())
+	err = s.UseShutdown(ShutdownPolicy{Policy: Drain, Timeout: 500 * time.Millisecond})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	ids := startTasks(t, s, 100*time.Millisecond, time.Hour)
+
+	err = s.Shutdown()
+	assert.NoError(t, err)
+	short, err := s.GetTask(ids[0])
+	assert.NoError(t, err)
+	assert.Equal(t, _status.Done, short.Status)
+	assert.Equal(t, "drained", short.Shutdown.Action)
+	long, err := s.GetTask(ids[1])
+	assert.NoError(t, err)
+	// detached, Load will attach it
+	assert.Equal(t, _status.Running, long.Status)
+	assert.Equal(t, Drain, long.Shutdown.Policy)
+	assert.Equal(t, "detached", long.Shutdown.Action)
+	long.Cancel()
+}
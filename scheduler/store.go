@@ -8,6 +8,7 @@ import (
 	"github.com/factorysh/density/store"
 	"github.com/factorysh/density/task"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 )
 
 // JSONStore stores task.Task
@@ -42,13 +43,36 @@ func (j *JSONStore) Put(t *task.Task) error {
 		return errors.New("Task wihtout id")
 	}
 	t.Mtime = time.Now()
+	return j.put(t)
+}
+
+// put a task, without touching its mtime
+func (j *JSONStore) put(t *task.Task) error {
 	value, err := json.Marshal(t)
 	if err != nil {
 		return err
 	}
+	if indexed, ok := j.store.(store.IndexedStore); ok {
+		return indexed.PutIndexed([]byte(t.Id.String()), value, taskIndex(t))
+	}
 	return j.store.Put([]byte(t.Id.String()), value)
 }
 
+// taskIndex indexes owner, status and labels, each label is a term
+func taskIndex(t *task.Task) store.Index {
+	terms := map[string][]string{
+		"owner":  {t.Owner},
+		"status": {t.Status.String()},
+	}
+	for k, v := range t.Labels {
+		terms["label."+k] = []string{v}
+	}
+	return store.Index{
+		Mtime: t.Mtime,
+		Terms: terms,
+	}
+}
+
 // Delete a task
 func (j *JSONStore) Delete(id uuid.UUID) error {
 	return j.store.Delete([]byte(id.String()))
@@ -59,25 +83,117 @@ func (j *JSONStore) Length() int {
 	return j.store.Length()
 }
 
-// ForEach loops over kv
+// ForEach loops over kv, unreadable tasks are skipped
 func (j *JSONStore) ForEach(fn func(t *task.Task) error) error {
 	return j.store.ForEach(func(k, v []byte) error {
 		// k is the UUID, serialized in v
 		t, err := parseTask(v)
 		if err != nil {
-			return err
+			log.WithError(err).WithField("key", string(k)).Error("Unreadable task")
+			return nil
 		}
 		return fn(t)
 	})
 }
 
-// DeleteWithClause batch delete
+// DeleteWithClause batch delete, unreadable tasks are kept
 func (j *JSONStore) DeleteWithClause(fn func(t *task.Task) bool) error {
 	return j.store.DeleteWithClause(func(k, v []byte) bool {
 		t, err := parseTask(v)
 		if err != nil {
-			panic(err)
+			log.WithError(err).WithField("key", string(k)).Error("Unreadable task")
+			return false
 		}
 		return fn(t)
 	})
 }
+
+// QuarantineBucket holds the tasks which can't be read
+const QuarantineBucket = "quarantine"
+
+// Quarantined is an unreadable task, with the reason
+type Quarantined struct {
+	Error  string    `json:"error"`
+	Date   time.Time `json:"date"`
+	Record string    `json:"record"`
+}
+
+// runs of the tasks, in their bucket of the store
+func (j *JSONStore) runs() *RunStore {
+	return NewRunStore(j.store)
+}
+
+// Migrate all the tasks to the current schema, unreadable tasks go to quarantine.
+// What is moved out of the tasks, like their runs, goes to its own bucket.
+func (j *JSONStore) Migrate() (migrated int, quarantined int, err error) {
+	type record struct {
+		key   []byte
+		value []byte
+	}
+	records := make([]record, 0)
+	err = j.store.ForEach(func(k, v []byte) error {
+		records = append(records, record{
+			key:   append([]byte{}, k...),
+			value: append([]byte{}, v...),
+		})
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	runs := j.runs()
+	for _, r := range records {
+		raw, changed, err := task.Migrate(r.value, runs)
+		if err == nil {
+			var t *task.Task
+			t, err = parseTask(raw)
+			if err == nil {
+				if changed {
+					err = j.put(t)
+					if err != nil {
+						return migrated, quarantined, err
+					}
+					migrated++
+				}
+				continue
+			}
+		}
+		log.WithError(err).WithField("key", string(r.key)).Error("Task in quarantine")
+		err = j.quarantine(r.key, r.value, err)
+		if err != nil {
+			return migrated, quarantined, err
+		}
+		quarantined++
+	}
+	return migrated, quarantined, nil
+}
+
+func (j *JSONStore) quarantine(key, value []byte, reason error) error {
+	bucketed, ok := j.store.(store.Bucketed)
+	if !ok {
+		// ForEach will skip it
+		return nil
+	}
+	q, err := bucketed.Bucket(QuarantineBucket)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(Quarantined{
+		Error:  reason.Error(),
+		Date:   time.Now(),
+		Record: string(value),
+	})
+	if err != nil {
+		return err
+	}
+	err = q.Put(key, raw)
+	if err != nil {
+		return err
+	}
+	return j.store.Delete(key)
+}
+
+// NewJSONStore wraps a store
+func NewJSONStore(s store.Store) *JSONStore {
+	return &JSONStore{s}
+}
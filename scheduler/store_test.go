@@ -1,6 +1,8 @@
 package scheduler
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -59,3 +61,67 @@ func TestStore(t *testing.T) {
 		assert.True(t, ok)
 	}
 }
+
+func TestMigrate(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	b, err := store.NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	for _, s := range []store.Store{store.NewMemoryStore(), b} {
+		id, err := uuid.NewRandom()
+		assert.NoError(t, err)
+		// an old task, without version
+		err = s.Put([]byte(id.String()), []byte(fmt.Sprintf(`{"id": "%s", "owner": "bob", "status": "Done"}`, id)))
+		assert.NoError(t, err)
+		// an unknown action
+		err = s.Put([]byte("broken"), []byte(`{"owner": "alice", "action": {"nope": {}}}`))
+		assert.NoError(t, err)
+
+		j := &JSONStore{s}
+		migrated, quarantined, err := j.Migrate()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, migrated)
+		assert.Equal(t, 1, quarantined)
+		assert.Equal(t, 1, j.Length())
+
+		v, err := s.Get([]byte(id.String()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(v), fmt.Sprintf(`"version":%d`, task.SchemaVersion))
+
+		q, err := s.(store.Bucketed).Bucket(QuarantineBucket)
+		assert.NoError(t, err)
+		v, err = q.Get([]byte("broken"))
+		assert.NoError(t, err)
+		var broken Quarantined
+		err = json.Unmarshal(v, &broken)
+		assert.NoError(t, err)
+		assert.Contains(t, broken.Error, "nope")
+		assert.Contains(t, broken.Record, "alice")
+
+		// nothing left to do
+		migrated, quarantined, err = j.Migrate()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, migrated)
+		assert.Equal(t, 0, quarantined)
+	}
+}
+
+func TestUnreadable(t *testing.T) {
+	s := store.NewMemoryStore()
+	j := &JSONStore{s}
+	err := s.Put([]byte("broken"), []byte(`plop`))
+	assert.NoError(t, err)
+	n := 0
+	err = j.ForEach(func(t *task.Task) error {
+		n++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	err = j.DeleteWithClause(func(t *task.Task) bool {
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, j.Length())
+}
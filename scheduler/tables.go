@@ -0,0 +1,37 @@
+package scheduler
+
+import "github.com/factorysh/density/store"
+
+// ReportTables are SQL tables of the tasks and their runs, written by the stores able to
+var ReportTables = []store.Table{
+	{
+		Name:   "tasks",
+		Bucket: string(store.DefaultBucket),
+		Key:    "id",
+		Columns: []store.Column{
+			{Name: "owner", Type: "TEXT", Path: "$.owner"},
+			{Name: "status", Type: "TEXT", Path: "$.status"},
+			{Name: "start", Type: "TEXT", Path: "$.start"},
+			{Name: "mtime", Type: "TEXT", Path: "$.mtime"},
+			{Name: "cpu", Type: "INTEGER", Path: "$.cpu"},
+			{Name: "ram", Type: "INTEGER", Path: "$.ram"},
+			{Name: "cron", Type: "TEXT", Path: "$.cron"},
+			{Name: "run_counter", Type: "INTEGER", Path: "$.run_counter"},
+			{Name: "labels", Type: "TEXT", Path: "$.labels"},
+		},
+	},
+	{
+		Name:   "runs",
+		Bucket: RunsBucket,
+		Key:    "key",
+		Columns: []store.Column{
+			{Name: "task_id", Type: "TEXT", Path: "$.task"},
+			{Name: "id", Type: "INTEGER", Path: "$.id"},
+			{Name: "status", Type: "TEXT", Path: "$.status"},
+			{Name: "runner", Type: "TEXT", Path: "$.runner"},
+			{Name: "start", Type: "TEXT", Path: "$.start"},
+			{Name: "finish", Type: "TEXT", Path: "$.finish"},
+			{Name: "exit_code", Type: "INTEGER", Path: "$.exit_code"},
+		},
+	},
+}
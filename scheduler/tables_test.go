@@ -0,0 +1,63 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/factorysh/density/store"
+	"github.com/factorysh/density/task"
+	_run "github.com/factorysh/density/task/run"
+	_status "github.com/factorysh/density/task/status"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportTables(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "sqlite-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := store.NewSQLiteStore(dir + "/store.sqlite")
+	assert.NoError(t, err)
+	defer s.Close()
+	id, err := uuid.NewRandom()
+	assert.NoError(t, err)
+	j := NewJSONStore(s)
+	// written before the tables
+	err = j.Put(&task.Task{
+		Id:    id,
+		Owner: "bob",
+	})
+	assert.NoError(t, err)
+	for _, table := range ReportTables {
+		assert.NoError(t, s.UseTable(table))
+	}
+	runs := NewRunStore(s)
+	for _, run := range []*RunRecord{
+		{Task: id, Status: _status.Error, Data: _run.Data{ID: 2, ExitCode: 1, Start: time.Now()}},
+		{Task: id, Status: _status.Done, Data: _run.Data{ID: 1, Start: time.Now().Add(-time.Hour)}},
+	} {
+		assert.NoError(t, runs.Put(run))
+	}
+
+	var owner, status string
+	err = s.Db.QueryRow(`SELECT owner, status FROM tasks WHERE id = ?`, id.String()).Scan(&owner, &status)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", owner)
+	assert.Equal(t, "Waiting", status)
+
+	var failed int
+	err = s.Db.QueryRow(`SELECT COUNT(*) FROM runs JOIN tasks ON tasks.id = runs.task_id
+		WHERE owner = 'bob' AND runs.status = 'Error'`).Scan(&failed)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, failed)
+
+	// the rows follow the values
+	assert.NoError(t, runs.DeleteTask(id))
+	assert.NoError(t, j.Delete(id))
+	var n int
+	err = s.Db.QueryRow(`SELECT (SELECT COUNT(*) FROM tasks) + (SELECT COUNT(*) FROM runs)`).Scan(&n)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -1,10 +1,42 @@
 package server
 
+import (
+	"os"
+
+	"github.com/factorysh/density/scheduler"
+	"github.com/factorysh/density/task/window"
+	"gopkg.in/yaml.v3"
+)
+
 type Config struct {
 	Validators    map[string]map[string]interface{} `yaml:"validators"`
+	Recomposators map[string]map[string]interface{} `yaml:"recomposators"` // Patches of the actions, over the standard ones
 	Configurators map[string]map[string]interface{} `yaml:"configurators"`
 	Listen        string                            `yaml:"listen"`
 	DataDir       string                            `yaml:"data_dir"`
 	CPU           int                               `yaml:"cpu"`
 	RAM           int                               `yaml:"ram"`
+	Calendars     map[string]*window.Calendar       `yaml:"calendars"` // Allowed run windows, by owner
+	Store         string                            `yaml:"store"`     // Store engine, bolt or sqlite
+	Runner        string                            `yaml:"runner"`    // Compose runner, cli (docker-compose) or api (Docker API)
+	Compose       string                            `yaml:"compose"`   // Path to docker-compose, or to docker for the plugin, detected if empty
+	Runs          scheduler.RunRetention            `yaml:"runs"`      // Runs retention
+	GC            scheduler.GCPolicy                `yaml:"gc"`        // Garbage collection of finished tasks
+	Reconcile     scheduler.ReconcilePolicy         `yaml:"reconcile"` // What to do with containers and networks without task
+	Shutdown      scheduler.ShutdownPolicy          `yaml:"shutdown"`  // What happens to running tasks, on SIGTERM
+}
+
+// LoadConfig reads a YAML config file
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg Config
+	err = yaml.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
 }
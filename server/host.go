@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/docker/docker/client"
+	"github.com/factorysh/density/compose"
+	"github.com/factorysh/density/scheduler"
+)
+
+// dockerHost is the docker side of the scheduler
+type dockerHost struct {
+	docker *client.Client
+	ledger *compose.Ledger
+}
+
+// Inventory of the host, the subnet ledger is synced with Docker too
+func (d *dockerHost) Inventory() ([]scheduler.Resource, error) {
+	err := d.ledger.Sync(d.docker)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := compose.Inventory(d.docker)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]scheduler.Resource, len(resources))
+	for i, r := range resources {
+		found[i] = scheduler.Resource(r)
+	}
+	return found, nil
+}
+
+func (d *dockerHost) Remove(r scheduler.Resource) error {
+	return compose.Remove(d.docker, d.ledger, compose.Resource(r))
+}
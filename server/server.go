@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -27,10 +28,61 @@ type Server struct {
 	Scheduler *scheduler.Scheduler
 	AuthKey   string
 	Addr      string
+	validator *task.Validator
+	recompose *task.Recomposator
+	runner    *runner.Runner
+	docker    *client.Client
+	ledger    *compose.Ledger
+	engine    *compose.Engine // Runs the composes with the Docker API, without the compose command
 }
 
-// New initializes server instance
-func New(addr, dataDir, authKey string, cpu, ram int) (*Server, error) {
+// Store engines
+const (
+	BoltEngine   = "bolt"
+	SQLiteEngine = "sqlite"
+)
+
+// Compose runners
+const (
+	CLIRunner = "cli"
+	APIRunner = "api"
+)
+
+// StorePath of the bolt store, in the data dir
+func StorePath(dataDir string) string {
+	return path.Join(strings.TrimRight(dataDir, "/"), "store", "batch.store")
+}
+
+// OpenStore opens the store of an engine, bolt is the default
+func OpenStore(dataDir, engine string) (store.Store, error) {
+	switch engine {
+	case "", BoltEngine:
+		return store.NewBoltStore(StorePath(dataDir))
+	case SQLiteEngine:
+		s, err := store.NewSQLiteStore(path.Join(strings.TrimRight(dataDir, "/"), "store", "batch.sqlite"))
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range scheduler.ReportTables {
+			err = s.UseTable(table)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown store engine %s", engine)
+}
+
+// New initializes server instance, with the store engine and the runner of the config
+func New(addr, dataDir, authKey string, cfg *Config, cpu, ram int) (*Server, error) {
+
+	switch cfg.Runner {
+	case "", CLIRunner, APIRunner:
+	default:
+		return nil, fmt.Errorf("unknown runner %s, use cli or api", cfg.Runner)
+	}
 
 	dataDir = strings.TrimRight(dataDir, "/")
 
@@ -41,7 +93,7 @@ func New(addr, dataDir, authKey string, cpu, ram int) (*Server, error) {
 		}
 	}
 
-	store, err := store.NewBoltStore(path.Join(dataDir, "store", "batch.store"))
+	store, err := OpenStore(dataDir, cfg.Store)
 	if err != nil {
 		return nil, err
 	}
@@ -50,27 +102,175 @@ func New(addr, dataDir, authKey string, cpu, ram int) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	ledger, err := newLedger(store)
+	if err != nil {
+		return nil, err
+	}
+	var engine *compose.Engine
+	if cfg.Runner == APIRunner {
+		engine = compose.NewEngine(docker)
+	}
 
-	recompose := &task.Recomposator{
-		Recomposators: map[string]map[string]interface{}{
-			"compose": {
-				"VolumeInVolumes": "./volumes",
-			},
-		},
+	recompose := &task.Recomposator{}
+	r := runner.New(path.Join(dataDir, "wd"), recompose)
+	r.UseCleaner(compose.Cleaner(docker, ledger))
+	schd := scheduler.New(scheduler.NewResources(cpu, ram), r, store)
+	schd.UseHost(&dockerHost{docker, ledger})
+	s := &Server{
+		AuthKey:   authKey,
+		Addr:      addr,
+		Scheduler: schd,
+		recompose: recompose,
+		runner:    r,
+		docker:    docker,
+		ledger:    ledger,
+		engine:    engine,
 	}
-	err = recompose.Register(docker, "bob")
+	err = s.UseRecomposators(nil)
 	if err != nil {
 		return nil, err
 	}
-	return &Server{
-		AuthKey: authKey,
-		Addr:    addr,
-		Scheduler: scheduler.New(scheduler.NewResources(cpu, ram),
-			runner.New(path.Join(dataDir, "wd"), recompose), store),
-	}, nil
+	err = s.UseValidators(nil)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// newLedger keeps the subnet leases in a bucket of the store, or in memory
+func newLedger(s store.Store) (*compose.Ledger, error) {
+	b, ok := s.(store.Bucketed)
+	if !ok {
+		return compose.NewLedger(store.NewMemoryStore()), nil
+	}
+	subnets, err := b.Bucket(compose.LedgerBucket)
+	if err != nil {
+		return nil, err
+	}
+	return compose.NewLedger(subnets), nil
+}
+
+// ledgerUser is a recomposator leasing subnets, it shares the ledger of the cleaners
+type ledgerUser interface {
+	UseLedger(ledger *compose.Ledger)
+}
+
+// engineUser is a recomposator, or a validator, of the API runner
+type engineUser interface {
+	UseEngine(engine *compose.Engine)
+}
+
+// useEngine of the API runner, if any
+func (s *Server) useEngine(a interface{}) {
+	if s.engine == nil {
+		return
+	}
+	if e, ok := a.(engineUser); ok {
+		e.UseEngine(s.engine)
+	}
 }
 
-// Run starts this server instance
+// UseValidators sets the validators of the actions, the compose ones are added to the standard ones
+func (s *Server) UseValidators(validators map[string]map[string]interface{}) error {
+	standard := make(map[string]interface{})
+	for k, v := range compose.StandardConfig {
+		standard[k] = v
+	}
+	all := map[string]map[string]interface{}{
+		"compose": standard,
+	}
+	for action, cfg := range validators {
+		if action != "compose" {
+			all[action] = cfg
+			continue
+		}
+		for k, v := range cfg {
+			standard[k] = v
+		}
+	}
+	v := &task.Validator{
+		Validators: all,
+	}
+	err := v.Register()
+	if err != nil {
+		return err
+	}
+	if c, ok := v.Get("compose"); ok {
+		s.useEngine(c)
+	}
+	s.validator = v
+	s.runner.UseValidator(v)
+	return nil
+}
+
+// UseRecomposators sets the recomposators of the actions, the compose ones are added to the standard ones
+func (s *Server) UseRecomposators(recomposators map[string]map[string]interface{}) error {
+	standard := map[string]interface{}{
+		"VolumeInVolumes": "./volumes",
+		"NoNewPrivileges": true,
+	}
+	all := map[string]map[string]interface{}{
+		"compose": standard,
+	}
+	for action, cfg := range recomposators {
+		if action != "compose" {
+			all[action] = cfg
+			continue
+		}
+		for k, v := range cfg {
+			standard[k] = v
+		}
+	}
+	s.recompose.Recomposators = all
+	err := s.recompose.Register(s.docker)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.recompose.Get("compose"); ok {
+		if l, ok := c.(ledgerUser); ok {
+			l.UseLedger(s.ledger)
+		}
+		s.useEngine(c)
+	}
+	return nil
+}
+
+// Configure applies optional settings from a config file
+func (s *Server) Configure(cfg *Config) error {
+	for owner, calendar := range cfg.Calendars {
+		err := s.Scheduler.UseCalendar(owner, calendar)
+		if err != nil {
+			return fmt.Errorf("calendar of %s : %v", owner, err)
+		}
+	}
+	err := s.Scheduler.UseRetention(cfg.Runs)
+	if err != nil {
+		return fmt.Errorf("runs retention : %v", err)
+	}
+	err = s.Scheduler.UseGC(cfg.GC)
+	if err != nil {
+		return fmt.Errorf("gc : %v", err)
+	}
+	err = s.Scheduler.UseReconcilePolicy(cfg.Reconcile)
+	if err != nil {
+		return fmt.Errorf("reconcile : %v", err)
+	}
+	err = s.Scheduler.UseShutdown(cfg.Shutdown)
+	if err != nil {
+		return fmt.Errorf("shutdown : %v", err)
+	}
+	err = s.UseValidators(cfg.Validators)
+	if err != nil {
+		return fmt.Errorf("validators : %v", err)
+	}
+	err = s.UseRecomposators(cfg.Recomposators)
+	if err != nil {
+		return fmt.Errorf("recomposators : %v", err)
+	}
+	return nil
+}
+
+// Run starts this server instance, until the context is done and running tasks are handled
 func (s *Server) Run(ctx context.Context) {
 
 	ctxScheduler, cancelScheduler := context.WithCancel(context.Background())
@@ -99,16 +299,7 @@ func (s *Server) Run(ctx context.Context) {
 		w.Header().Set("Content-type", "text/plain")
 		w.Write([]byte(version.Version()))
 	}).Methods(http.MethodGet)
-	v := &task.Validator{
-		Validators: map[string]map[string]interface{}{
-			"compose": compose.StandardConfig,
-		},
-	}
-	err = v.Register()
-	if err != nil { // FIXME it's ugly
-		panic(err)
-	}
-	handlers.RegisterAPI(router.PathPrefix("/api").Subrouter(), s.Scheduler, v, s.AuthKey)
+	handlers.RegisterAPI(router.PathPrefix("/api").Subrouter(), s.Scheduler, s.validator, s.AuthKey)
 	server := &http.Server{
 		Addr:    s.Addr,
 		Handler: sentryHandler.HandleFunc(router.ServeHTTP),
@@ -126,5 +317,10 @@ func (s *Server) Run(ctx context.Context) {
 		defer cancelShutdown()
 		server.Shutdown(ctxShutdown)
 		cancelShutdown()
+		// no new tasks, then the running ones
+		err = s.Scheduler.Shutdown()
+		if err != nil {
+			log.Print(err)
+		}
 	}
 }
@@ -1,7 +1,12 @@
 package store
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -10,9 +15,19 @@ import (
 // DefaultBucket is used as a default bucket for bolt
 var DefaultBucket = []byte("default")
 
+// IndexBucket holds secondary indexes of the default bucket
+var IndexBucket = []byte("index")
+
+var (
+	metaBucket  = []byte("meta")  // key -> Index
+	mtimeBucket = []byte("mtime") // mtime+key -> nil
+	termsBucket = []byte("terms") // name -> value -> key -> nil
+)
+
 // BoltStore wraps all the bbol storage logic
 type BoltStore struct {
-	Db *bolt.DB
+	Db     *bolt.DB
+	bucket []byte
 }
 
 // NewBoltStore inits a BoltStore struct
@@ -25,34 +40,244 @@ func NewBoltStore(path string) (*BoltStore, error) {
 		return nil, err
 	}
 
+	bs := &BoltStore{
+		Db:     db,
+		bucket: DefaultBucket,
+	}
 	// create a default bucket if not exists
-	db.Update(func(tx *bolt.Tx) error {
-		tx.CreateBucketIfNotExists(DefaultBucket)
+	err = bs.create()
+	if err != nil {
+		return nil, err
+	}
+
+	return bs, nil
+}
+
+// create the bucket, and its indexes
+func (bs *BoltStore) create() error {
+	return bs.Db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bs.bucket)
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists(bs.indexBucket())
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{metaBucket, mtimeBucket, termsBucket} {
+			_, err = index.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+}
+
+// indexBucket of the bucket, IndexBucket for the default one
+func (bs *BoltStore) indexBucket() []byte {
+	if bytes.Equal(bs.bucket, DefaultBucket) {
+		return IndexBucket
+	}
+	return append(append([]byte{}, bs.bucket...), ".index"...)
+}
 
-	return &BoltStore{
-		Db: db,
-	}, err
+// Bucket returns a sibling store, in the same file
+func (bs *BoltStore) Bucket(name string) (Store, error) {
+	if name == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	if name == string(IndexBucket) || strings.HasSuffix(name, ".index") {
+		return nil, fmt.Errorf("reserved bucket name %s", name)
+	}
+	b := &BoltStore{
+		Db:     bs.Db,
+		bucket: []byte(name),
+	}
+	err := b.create()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 // Put value associtated to key in the datastore
 func (bs *BoltStore) Put(key []byte, value []byte) error {
 
 	err := bs.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(DefaultBucket)
+		b := tx.Bucket(bs.bucket)
 		if b == nil {
-			return fmt.Errorf("bucket %s does not exists", DefaultBucket)
+			return fmt.Errorf("bucket %s does not exists", bs.bucket)
 		}
 
-		err := b.Put(key, value)
+		err := bs.unindex(tx, key)
+		if err != nil {
+			return err
+		}
 
-		return err
+		return b.Put(key, value)
 	})
 
 	return err
 }
 
+// PutIndexed puts a value, and its index, in one transaction
+func (bs *BoltStore) PutIndexed(key []byte, value []byte, index Index) error {
+	return bs.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bs.bucket)
+		if b == nil {
+			return fmt.Errorf("bucket %s does not exists", bs.bucket)
+		}
+		err := bs.unindex(tx, key)
+		if err != nil {
+			return err
+		}
+		err = b.Put(key, value)
+		if err != nil {
+			return err
+		}
+		idx := tx.Bucket(bs.indexBucket())
+		meta, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+		err = idx.Bucket(metaBucket).Put(key, meta)
+		if err != nil {
+			return err
+		}
+		err = idx.Bucket(mtimeBucket).Put(mtimeKey(index.Mtime, key), nil)
+		if err != nil {
+			return err
+		}
+		terms := idx.Bucket(termsBucket)
+		for name, values := range index.Terms {
+			byName, err := terms.CreateBucketIfNotExists(termKey(name))
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				byValue, err := byName.CreateBucketIfNotExists(termKey(value))
+				if err != nil {
+					return err
+				}
+				err = byValue.Put(key, nil)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// termKey is never empty, bolt needs a bucket name
+func termKey(term string) []byte {
+	return append([]byte{'_'}, term...)
+}
+
+// unindex removes the index of a key, if any
+func (bs *BoltStore) unindex(tx *bolt.Tx, key []byte) error {
+	idx := tx.Bucket(bs.indexBucket())
+	if idx == nil {
+		return nil
+	}
+	raw := idx.Bucket(metaBucket).Get(key)
+	if raw == nil {
+		return nil
+	}
+	var index Index
+	err := json.Unmarshal(raw, &index)
+	if err != nil {
+		return err
+	}
+	err = idx.Bucket(mtimeBucket).Delete(mtimeKey(index.Mtime, key))
+	if err != nil {
+		return err
+	}
+	terms := idx.Bucket(termsBucket)
+	for name, values := range index.Terms {
+		byName := terms.Bucket(termKey(name))
+		if byName == nil {
+			continue
+		}
+		for _, value := range values {
+			byValue := byName.Bucket(termKey(value))
+			if byValue == nil {
+				continue
+			}
+			err = byValue.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return idx.Bucket(metaBucket).Delete(key)
+}
+
+// Query indexed keys
+func (bs *BoltStore) Query(q Query) ([][]byte, error) {
+	var keys [][]byte
+	err := bs.Db.View(func(tx *bolt.Tx) error {
+		idx := tx.Bucket(bs.indexBucket())
+		terms := idx.Bucket(termsBucket)
+		candidates := intersect(q.Terms, func(name, value string) []string {
+			keys := make([]string, 0)
+			byName := terms.Bucket(termKey(name))
+			if byName == nil {
+				return keys
+			}
+			byValue := byName.Bucket(termKey(value))
+			if byValue == nil {
+				return keys
+			}
+			byValue.ForEach(func(k, _ []byte) error {
+				keys = append(keys, string(k))
+				return nil
+			})
+			return keys
+		})
+		// few candidates, without range : no need to walk all the mtimes
+		if candidates != nil && !q.hasRange() {
+			meta := idx.Bucket(metaBucket)
+			found := make([]indexedKey, 0, len(candidates))
+			for k := range candidates {
+				var index Index
+				err := json.Unmarshal(meta.Get([]byte(k)), &index)
+				if err != nil {
+					return err
+				}
+				found = append(found, indexedKey{k, index.Mtime})
+			}
+			keys = sortByMtime(found)
+			return nil
+		}
+		keys = make([][]byte, 0)
+		c := idx.Bucket(mtimeBucket).Cursor()
+		var k []byte
+		if q.Since.IsZero() {
+			k, _ = c.First()
+		} else {
+			k, _ = c.Seek(mtimeKey(q.Since, nil))
+		}
+		var until []byte
+		if !q.Until.IsZero() {
+			until = mtimeKey(q.Until, nil)
+		}
+		for ; k != nil; k, _ = c.Next() {
+			if until != nil && bytes.Compare(k, until) >= 0 {
+				break
+			}
+			key := k[8:]
+			if candidates != nil && !candidates[string(key)] {
+				continue
+			}
+			keys = append(keys, append([]byte{}, key...))
+		}
+		return nil
+	})
+	return keys, err
+}
+
 // Get a value using it's key
 func (bs *BoltStore) Get(key []byte) ([]byte, error) {
 
@@ -60,9 +285,9 @@ func (bs *BoltStore) Get(key []byte) ([]byte, error) {
 	var value []byte
 
 	err := bs.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(DefaultBucket)
+		b := tx.Bucket(bs.bucket)
 		if b == nil {
-			return fmt.Errorf("bucket %s does not exists", DefaultBucket)
+			return fmt.Errorf("bucket %s does not exists", bs.bucket)
 		}
 
 		v := b.Get(key)
@@ -85,9 +310,14 @@ func (bs *BoltStore) Get(key []byte) ([]byte, error) {
 func (bs *BoltStore) Delete(key []byte) error {
 
 	err := bs.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(DefaultBucket)
+		b := tx.Bucket(bs.bucket)
 		if b == nil {
-			return fmt.Errorf("bucket %s does not exists", DefaultBucket)
+			return fmt.Errorf("bucket %s does not exists", bs.bucket)
+		}
+
+		err := bs.unindex(tx, key)
+		if err != nil {
+			return err
 		}
 
 		return b.Delete(key)
@@ -100,33 +330,77 @@ func (bs *BoltStore) Delete(key []byte) error {
 func (bs *BoltStore) Length() int {
 	var l int
 	bs.Db.View(func(tx *bolt.Tx) error {
-		l = tx.Bucket(DefaultBucket).Stats().KeyN
+		l = tx.Bucket(bs.bucket).Stats().KeyN
 		return nil
 	})
 	return l
 }
 
+// Backup writes the whole database, in a read transaction
+func (bs *BoltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := bs.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
 func (bs *BoltStore) Sync() error {
 	return bs.Db.Sync()
 }
 
 func (bs *BoltStore) ForEach(fn func(k, v []byte) error) error {
 	return bs.Db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(DefaultBucket)
+		b := tx.Bucket(bs.bucket)
 		return b.ForEach(fn)
 	})
 }
 
+// ForEachPrefix loops over the keys starting with prefix
+func (bs *BoltStore) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	return bs.Db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bs.bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			err := fn(k, v)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (bs *BoltStore) DeleteWithClause(fn func(k, v []byte) bool) error {
-	bs.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(DefaultBucket)
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
+	return bs.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bs.bucket)
+		// deleting with the cursor skips keys
+		todos := make([][]byte, 0)
+		err := b.ForEach(func(k, v []byte) error {
 			if fn(k, v) {
-				c.Delete()
+				todos = append(todos, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range todos {
+			err = bs.unindex(tx, k)
+			if err != nil {
+				return err
+			}
+			err = b.Delete(k)
+			if err != nil {
+				return err
 			}
 		}
 		return nil
 	})
-	return nil
+}
+
+// Close the database
+func (bs *BoltStore) Close() error {
+	return bs.Db.Close()
 }
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// Index of a value : its mtime, and its terms, by name
+type Index struct {
+	Mtime time.Time           `json:"mtime"`
+	Terms map[string][]string `json:"terms"`
+}
+
+// Query selects keys with terms and a mtime range.
+// Each term name must match one of its values, a zero time is unbounded.
+type Query struct {
+	Terms map[string][]string
+	Since time.Time // included
+	Until time.Time // excluded
+}
+
+// IndexedStore is a Store with secondary indexes
+type IndexedStore interface {
+	Store
+	PutIndexed(key, value []byte, index Index) error
+	// Query returns matching keys, ordered by mtime
+	Query(q Query) ([][]byte, error)
+}
+
+func (q Query) hasRange() bool {
+	return !q.Since.IsZero() || !q.Until.IsZero()
+}
+
+func (q Query) inRange(mtime time.Time) bool {
+	if !q.Since.IsZero() && mtime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !mtime.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// mtimeKey sorts keys by mtime, with bytes
+func mtimeKey(mtime time.Time, key []byte) []byte {
+	k := make([]byte, 8+len(key))
+	if !mtime.IsZero() {
+		binary.BigEndian.PutUint64(k, uint64(mtime.UnixNano()))
+	}
+	copy(k[8:], key)
+	return k
+}
+
+type indexedKey struct {
+	key   string
+	mtime time.Time
+}
+
+func sortByMtime(keys []indexedKey) [][]byte {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mtime.Equal(keys[j].mtime) {
+			return keys[i].key < keys[j].key
+		}
+		return keys[i].mtime.Before(keys[j].mtime)
+	})
+	sorted := make([][]byte, len(keys))
+	for i, k := range keys {
+		sorted[i] = []byte(k.key)
+	}
+	return sorted
+}
+
+// intersect candidates of each term name, nil is everything
+func intersect(terms map[string][]string, lookup func(name, value string) []string) map[string]bool {
+	var candidates map[string]bool
+	for name, values := range terms {
+		union := make(map[string]bool)
+		for _, value := range values {
+			for _, k := range lookup(name, value) {
+				if candidates == nil || candidates[k] {
+					union[k] = true
+				}
+			}
+		}
+		candidates = union
+	}
+	return candidates
+}
@@ -1,21 +1,51 @@
 package store
 
 import (
+	"errors"
+	"sort"
+	"strings"
 	"sync"
 )
 
 type MemoryStore struct {
-	kv   map[string][]byte
-	lock *sync.RWMutex
+	kv      map[string][]byte
+	lock    *sync.RWMutex
+	indexes map[string]Index                      // by key
+	terms   map[string]map[string]map[string]bool // name, value, keys
+	buckets *memoryBuckets                        // shared with siblings
+}
+
+type memoryBuckets struct {
+	lock    sync.Mutex
+	buckets map[string]*MemoryStore
 }
 
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		kv:   make(map[string][]byte),
-		lock: &sync.RWMutex{},
+		kv:      make(map[string][]byte),
+		lock:    &sync.RWMutex{},
+		indexes: make(map[string]Index),
+		terms:   make(map[string]map[string]map[string]bool),
+		buckets: &memoryBuckets{buckets: make(map[string]*MemoryStore)},
 	}
 }
 
+// Bucket returns a sibling store
+func (m *MemoryStore) Bucket(name string) (Store, error) {
+	if name == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	m.buckets.lock.Lock()
+	defer m.buckets.lock.Unlock()
+	b, ok := m.buckets.buckets[name]
+	if !ok {
+		b = NewMemoryStore()
+		b.buckets = m.buckets
+		m.buckets.buckets[name] = b
+	}
+	return b, nil
+}
+
 func (m *MemoryStore) Get(key []byte) ([]byte, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -29,17 +59,109 @@ func (m *MemoryStore) Get(key []byte) ([]byte, error) {
 func (m *MemoryStore) Put(key []byte, value []byte) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	m.unindex(string(key))
 	m.kv[string(key)] = value
 	return nil
 }
 
+// PutIndexed puts a value, and its index
+func (m *MemoryStore) PutIndexed(key []byte, value []byte, index Index) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	k := string(key)
+	m.unindex(k)
+	m.kv[k] = value
+	m.indexes[k] = index
+	for name, values := range index.Terms {
+		byValue, ok := m.terms[name]
+		if !ok {
+			byValue = make(map[string]map[string]bool)
+			m.terms[name] = byValue
+		}
+		for _, value := range values {
+			keys, ok := byValue[value]
+			if !ok {
+				keys = make(map[string]bool)
+				byValue[value] = keys
+			}
+			keys[k] = true
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) unindex(key string) {
+	index, ok := m.indexes[key]
+	if !ok {
+		return
+	}
+	for name, values := range index.Terms {
+		for _, value := range values {
+			keys := m.terms[name][value]
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(m.terms[name], value)
+			}
+		}
+	}
+	delete(m.indexes, key)
+}
+
+// Query indexed keys
+func (m *MemoryStore) Query(q Query) ([][]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	candidates := intersect(q.Terms, func(name, value string) []string {
+		keys := make([]string, 0, len(m.terms[name][value]))
+		for k := range m.terms[name][value] {
+			keys = append(keys, k)
+		}
+		return keys
+	})
+	if candidates == nil {
+		candidates = make(map[string]bool, len(m.indexes))
+		for k := range m.indexes {
+			candidates[k] = true
+		}
+	}
+	keys := make([]indexedKey, 0, len(candidates))
+	for k := range candidates {
+		mtime := m.indexes[k].Mtime
+		if q.inRange(mtime) {
+			keys = append(keys, indexedKey{k, mtime})
+		}
+	}
+	return sortByMtime(keys), nil
+}
+
 func (m *MemoryStore) Delete(key []byte) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	m.unindex(string(key))
 	delete(m.kv, string(key))
 	return nil
 }
 
+// ForEachPrefix loops over the keys starting with prefix, in order
+func (m *MemoryStore) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	keys := make([]string, 0)
+	for k := range m.kv {
+		if strings.HasPrefix(k, string(prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := fn([]byte(k), m.kv[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *MemoryStore) DeleteWithClause(fn func(k, v []byte) bool) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
@@ -50,6 +172,7 @@ func (m *MemoryStore) DeleteWithClause(fn func(k, v []byte) bool) error {
 		}
 	}
 	for _, k := range todos {
+		m.unindex(k)
 		delete(m.kv, k)
 	}
 	return nil
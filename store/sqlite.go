@@ -0,0 +1,422 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go driver, no cgo
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS kv (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		value  TEXT NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS kv_index (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		mtime  INTEGER NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS kv_index_mtime ON kv_index (bucket, mtime)`,
+	`CREATE TABLE IF NOT EXISTS kv_terms (
+		bucket TEXT NOT NULL,
+		key    TEXT NOT NULL,
+		name   TEXT NOT NULL,
+		value  TEXT NOT NULL,
+		PRIMARY KEY (bucket, name, value, key)
+	)`,
+	`CREATE INDEX IF NOT EXISTS kv_terms_key ON kv_terms (bucket, key)`,
+}
+
+// SQLiteStore stores values in the kv table of a SQLite database, one bucket at a time.
+// JSON values can be read with SQL, and its JSON functions, or written in tables, see UseTable.
+type SQLiteStore struct {
+	Db     *sql.DB
+	bucket string
+	tables *sqliteTables
+}
+
+// sqliteTables of the buckets, shared by the sibling stores
+type sqliteTables struct {
+	lock   sync.RWMutex
+	tables map[string]Table
+}
+
+// NewSQLiteStore opens, or creates, a SQLite database
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// one writer, and ForEach reads before calling back
+	db.SetMaxOpenConns(1)
+	for _, pragma := range []string{
+		"PRAGMA journal_mode=WAL", // readers don't block the writer
+		"PRAGMA busy_timeout=1000",
+	} {
+		_, err = db.Exec(pragma)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	for _, stmt := range sqliteSchema {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLiteStore{
+		Db:     db,
+		bucket: string(DefaultBucket),
+		tables: &sqliteTables{tables: make(map[string]Table)},
+	}, nil
+}
+
+// Bucket returns a sibling store, in the same database
+func (s *SQLiteStore) Bucket(name string) (Store, error) {
+	if name == "" {
+		return nil, errors.New("empty bucket name")
+	}
+	return &SQLiteStore{
+		Db:     s.Db,
+		bucket: name,
+		tables: s.tables,
+	}, nil
+}
+
+// UseTable writes the values of a bucket in a table, in the transaction of the kv.
+// The table is created again, and filled from the kv, it's never the reference.
+func (s *SQLiteStore) UseTable(t Table) error {
+	columns := []string{fmt.Sprintf(`"%s" TEXT PRIMARY KEY`, t.Key)}
+	for _, c := range t.Columns {
+		columns = append(columns, fmt.Sprintf(`"%s" %s`, c.Name, c.Type))
+	}
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// older stores have a view
+	var kind string
+	err = tx.QueryRow(`SELECT type FROM sqlite_master WHERE name = ?`, t.Name).Scan(&kind)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	stmts := make([]string, 0, 2)
+	if kind != "" {
+		stmts = append(stmts, fmt.Sprintf(`DROP %s "%s"`, strings.ToUpper(kind), t.Name))
+	}
+	stmts = append(stmts, fmt.Sprintf(`CREATE TABLE "%s" (%s)`, t.Name, strings.Join(columns, ", ")))
+	for _, stmt := range stmts {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("table %s : %v", t.Name, err)
+		}
+	}
+	_, err = tx.Exec(insertRows(t, `kv WHERE bucket = ?`), t.Bucket)
+	if err != nil {
+		return fmt.Errorf("table %s : %v", t.Name, err)
+	}
+	s.tables.lock.Lock()
+	defer s.tables.lock.Unlock()
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	s.tables.tables[t.Bucket] = t
+	return nil
+}
+
+// insertRows of a table, from the key and value columns
+func insertRows(t Table, from string) string {
+	names := []string{fmt.Sprintf(`"%s"`, t.Key)}
+	values := []string{"key"}
+	for _, c := range t.Columns {
+		names = append(names, fmt.Sprintf(`"%s"`, c.Name))
+		values = append(values, fmt.Sprintf(`json_extract(value, '%s')`, c.Path))
+	}
+	return fmt.Sprintf(`INSERT OR REPLACE INTO "%s" (%s) SELECT %s FROM %s`,
+		t.Name, strings.Join(names, ", "), strings.Join(values, ", "), from)
+}
+
+// table of the bucket, if any
+func (s *SQLiteStore) table() (Table, bool) {
+	s.tables.lock.RLock()
+	defer s.tables.lock.RUnlock()
+	t, ok := s.tables.tables[s.bucket]
+	return t, ok
+}
+
+// writeRow of a value, in its table
+func (s *SQLiteStore) writeRow(tx *sql.Tx, key, value string) error {
+	t, ok := s.table()
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(insertRows(t, `(SELECT ? AS key, ? AS value)`), key, value)
+	return err
+}
+
+// deleteRow of a value, from its table
+func (s *SQLiteStore) deleteRow(tx *sql.Tx, key string) error {
+	t, ok := s.table()
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM "%s" WHERE "%s" = ?`, t.Name, t.Key), key)
+	return err
+}
+
+func (s *SQLiteStore) Get(key []byte) ([]byte, error) {
+	var value string
+	err := s.Db.QueryRow(`SELECT value FROM kv WHERE bucket = ? AND key = ?`,
+		s.bucket, string(key)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+func (s *SQLiteStore) Put(key []byte, value []byte) error {
+	return s.PutIndexed(key, value, Index{})
+}
+
+// PutIndexed puts a value, and its index, in one transaction, an empty index is no index
+func (s *SQLiteStore) PutIndexed(key []byte, value []byte, index Index) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	k := string(key)
+	err = s.unindex(tx, k)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)`,
+		s.bucket, k, string(value))
+	if err != nil {
+		return err
+	}
+	err = s.writeRow(tx, k, string(value))
+	if err != nil {
+		return err
+	}
+	if index.Mtime.IsZero() && index.Terms == nil {
+		return tx.Commit()
+	}
+	_, err = tx.Exec(`INSERT INTO kv_index (bucket, key, mtime) VALUES (?, ?, ?)`,
+		s.bucket, k, unixNano(index.Mtime))
+	if err != nil {
+		return err
+	}
+	for name, values := range index.Terms {
+		for _, value := range values {
+			_, err = tx.Exec(`INSERT OR IGNORE INTO kv_terms (bucket, key, name, value) VALUES (?, ?, ?, ?)`,
+				s.bucket, k, name, value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *SQLiteStore) unindex(tx *sql.Tx, key string) error {
+	_, err := tx.Exec(`DELETE FROM kv_index WHERE bucket = ? AND key = ?`, s.bucket, key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM kv_terms WHERE bucket = ? AND key = ?`, s.bucket, key)
+	return err
+}
+
+// Query indexed keys
+func (s *SQLiteStore) Query(q Query) ([][]byte, error) {
+	where := []string{"bucket = ?"}
+	args := []interface{}{s.bucket}
+	if !q.Since.IsZero() {
+		where = append(where, "mtime >= ?")
+		args = append(args, unixNano(q.Since))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "mtime < ?")
+		args = append(args, unixNano(q.Until))
+	}
+	for name, values := range q.Terms {
+		if len(values) == 0 {
+			return [][]byte{}, nil
+		}
+		where = append(where, fmt.Sprintf(
+			"key IN (SELECT key FROM kv_terms WHERE bucket = ? AND name = ? AND value IN (%s))",
+			strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")))
+		args = append(args, s.bucket, name)
+		for _, value := range values {
+			args = append(args, value)
+		}
+	}
+	rows, err := s.Db.Query(fmt.Sprintf("SELECT key FROM kv_index WHERE %s ORDER BY mtime, key",
+		strings.Join(where, " AND ")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([][]byte, 0)
+	for rows.Next() {
+		var key string
+		err = rows.Scan(&key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, []byte(key))
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(key []byte) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = s.unindex(tx, string(key))
+	if err != nil {
+		return err
+	}
+	err = s.deleteRow(tx, string(key))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM kv WHERE bucket = ? AND key = ?`, s.bucket, string(key))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Length() int {
+	var l int
+	s.Db.QueryRow(`SELECT COUNT(*) FROM kv WHERE bucket = ?`, s.bucket).Scan(&l)
+	return l
+}
+
+func (s *SQLiteStore) Sync() error {
+	// each transaction is already on disk
+	return nil
+}
+
+// all key values of the bucket, starting with prefix
+func (s *SQLiteStore) all(prefix string) ([][2][]byte, error) {
+	rows, err := s.Db.Query(`SELECT key, value FROM kv WHERE bucket = ? AND substr(key, 1, ?) = ? ORDER BY key`,
+		s.bucket, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	kvs := make([][2][]byte, 0)
+	for rows.Next() {
+		var k, v string
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, [2][]byte{[]byte(k), []byte(v)})
+	}
+	return kvs, rows.Err()
+}
+
+func (s *SQLiteStore) ForEach(fn func(k, v []byte) error) error {
+	return s.ForEachPrefix(nil, fn)
+}
+
+// ForEachPrefix loops over the keys starting with prefix, in order
+func (s *SQLiteStore) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	kvs, err := s.all(string(prefix))
+	if err != nil {
+		return err
+	}
+	for _, kv := range kvs {
+		err = fn(kv[0], kv[1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) DeleteWithClause(fn func(k, v []byte) bool) error {
+	kvs, err := s.all("")
+	if err != nil {
+		return err
+	}
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, kv := range kvs {
+		if !fn(kv[0], kv[1]) {
+			continue
+		}
+		err = s.unindex(tx, string(kv[0]))
+		if err != nil {
+			return err
+		}
+		err = s.deleteRow(tx, string(kv[0]))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM kv WHERE bucket = ? AND key = ?`, s.bucket, string(kv[0]))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Backup writes a copy of the whole database
+func (s *SQLiteStore) Backup(w io.Writer) (int64, error) {
+	dir, err := ioutil.TempDir(os.TempDir(), "density-backup-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/backup.sqlite"
+	_, err = s.Db.Exec(`VACUUM INTO ?`, path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// Close the database
+func (s *SQLiteStore) Close() error {
+	return s.Db.Close()
+}
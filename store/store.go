@@ -1,5 +1,7 @@
 package store
 
+import "io"
+
 // Store kv stuff
 type Store interface {
 	Get([]byte) ([]byte, error)
@@ -10,3 +12,38 @@ type Store interface {
 	ForEach(func(k, v []byte) error) error
 	DeleteWithClause(fn func(k, v []byte) bool) error
 }
+
+// Bucketed stores hold other stores, side by side
+type Bucketed interface {
+	Bucket(name string) (Store, error)
+}
+
+// Backuper writes a consistent copy of a live store
+type Backuper interface {
+	Backup(w io.Writer) (int64, error)
+}
+
+// Column of a table, read from the JSON value
+type Column struct {
+	Name string
+	Type string // SQL type
+	Path string // JSON path, like $.owner
+}
+
+// Table of a bucket, a row by value, for reporting. The key is its primary key.
+type Table struct {
+	Name    string
+	Bucket  string
+	Key     string // Column of the key
+	Columns []Column
+}
+
+// Tabler writes the values of a bucket in a table too, with them
+type Tabler interface {
+	UseTable(t Table) error
+}
+
+// Ranger iterates over the keys sharing a prefix, in key order
+type Ranger interface {
+	ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,7 +17,7 @@ func TestStore(t *testing.T) {
 	defer os.Remove(f.Name())
 	store, err := NewBoltStore(f.Name())
 	assert.NoError(t, err)
-	stores := []Store{NewMemoryStore(), store}
+	stores := []Store{NewMemoryStore(), store, newSQLite(t)}
 	for _, m := range stores {
 		fmt.Println(m)
 		assert.Equal(t, 0, m.Length())
@@ -53,3 +54,188 @@ func TestStore(t *testing.T) {
 		assert.Equal(t, 2, m.Length())
 	}
 }
+
+func TestIndexedStore(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	store, err := NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	now := time.Now()
+	for _, m := range []IndexedStore{NewMemoryStore(), store, newSQLite(t)} {
+		for i, name := range []string{"pim", "pam", "poum"} {
+			err = m.PutIndexed([]byte(name), []byte{}, Index{
+				Mtime: now.Add(time.Duration(i) * time.Minute),
+				Terms: map[string][]string{
+					"owner":  {"bob"},
+					"status": {[]string{"done", "running", "done"}[i]},
+					"empty":  {""},
+				},
+			})
+			assert.NoError(t, err)
+		}
+		keys, err := m.Query(Query{})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pim"), []byte("pam"), []byte("poum")}, keys)
+
+		keys, err = m.Query(Query{Terms: map[string][]string{"status": {"done"}}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pim"), []byte("poum")}, keys)
+
+		keys, err = m.Query(Query{
+			Terms: map[string][]string{
+				"owner":  {"bob"},
+				"status": {"done", "running"},
+			},
+			Since: now.Add(time.Minute),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pam"), []byte("poum")}, keys)
+
+		keys, err = m.Query(Query{Until: now.Add(time.Minute)})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pim")}, keys)
+
+		keys, err = m.Query(Query{Terms: map[string][]string{"owner": {"alice"}}})
+		assert.NoError(t, err)
+		assert.Len(t, keys, 0)
+
+		// a new index replaces the old one
+		err = m.PutIndexed([]byte("pam"), []byte{}, Index{
+			Mtime: now.Add(time.Hour),
+			Terms: map[string][]string{"status": {"done"}},
+		})
+		assert.NoError(t, err)
+		keys, err = m.Query(Query{Terms: map[string][]string{"status": {"done"}}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pim"), []byte("poum"), []byte("pam")}, keys)
+		keys, err = m.Query(Query{Terms: map[string][]string{"status": {"running"}}})
+		assert.NoError(t, err)
+		assert.Len(t, keys, 0)
+
+		err = m.Delete([]byte("pim"))
+		assert.NoError(t, err)
+		err = m.DeleteWithClause(func(k, v []byte) bool {
+			return string(k) == "poum"
+		})
+		assert.NoError(t, err)
+		keys, err = m.Query(Query{})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("pam")}, keys)
+	}
+}
+
+func TestBucketed(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	store, err := NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	for _, m := range []Store{NewMemoryStore(), store, newSQLite(t)} {
+		err = m.Put([]byte("name"), []byte("Bob"))
+		assert.NoError(t, err)
+		b, err := m.(Bucketed).Bucket("other")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, b.Length())
+		err = b.Put([]byte("name"), []byte("Alice"))
+		assert.NoError(t, err)
+		v, err := m.Get([]byte("name"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Bob", string(v))
+		// the same bucket, from a sibling
+		again, err := b.(Bucketed).Bucket("other")
+		assert.NoError(t, err)
+		v, err = again.Get([]byte("name"))
+		assert.NoError(t, err)
+		assert.Equal(t, "Alice", string(v))
+		_, err = m.(Bucketed).Bucket("")
+		assert.Error(t, err)
+	}
+	_, err = store.Bucket("index")
+	assert.Error(t, err)
+}
+
+func newSQLite(t *testing.T) *SQLiteStore {
+	dir, err := ioutil.TempDir(os.TempDir(), "sqlite-")
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	s, err := NewSQLiteStore(dir + "/store.sqlite")
+	assert.NoError(t, err)
+	return s
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s := newSQLite(t)
+	err := s.Put([]byte("bob"), []byte(`{"name": "Bob", "age": 42}`))
+	assert.NoError(t, err)
+	people := Table{
+		Name:    "people",
+		Bucket:  "default",
+		Key:     "name",
+		Columns: []Column{{Name: "age", Type: "INTEGER", Path: "$.age"}},
+	}
+	// the table is filled with the existing values
+	err = s.UseTable(people)
+	assert.NoError(t, err)
+	var age int
+	err = s.Db.QueryRow(`SELECT age FROM people WHERE name = 'bob'`).Scan(&age)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, age)
+	// then written with the values, by the sibling stores too
+	err = s.Put([]byte("bob"), []byte(`{"name": "Bob", "age": 43}`))
+	assert.NoError(t, err)
+	err = s.Db.QueryRow(`SELECT age FROM people WHERE name = 'bob'`).Scan(&age)
+	assert.NoError(t, err)
+	assert.Equal(t, 43, age)
+	other, err := s.Bucket("other")
+	assert.NoError(t, err)
+	err = other.Put([]byte("alice"), []byte(`{"age": 12}`))
+	assert.NoError(t, err)
+	sibling, err := other.(Bucketed).Bucket("default")
+	assert.NoError(t, err)
+	err = sibling.Put([]byte("carol"), []byte(`{"age": 33}`))
+	assert.NoError(t, err)
+	err = sibling.Delete([]byte("bob"))
+	assert.NoError(t, err)
+	var names string
+	err = s.Db.QueryRow(`SELECT group_concat(name) FROM people`).Scan(&names)
+	assert.NoError(t, err)
+	assert.Equal(t, "carol", names)
+	// a table can be replaced
+	err = s.UseTable(people)
+	assert.NoError(t, err)
+
+	f, err := ioutil.TempFile(os.TempDir(), "sqlite-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = s.Backup(f)
+	assert.NoError(t, err)
+	f.Close()
+	restored, err := NewSQLiteStore(f.Name())
+	assert.NoError(t, err)
+	v, err := restored.Get([]byte("carol"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(v), "33")
+}
+
+func TestRanger(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "bolt-")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	store, err := NewBoltStore(f.Name())
+	assert.NoError(t, err)
+	for _, m := range []Store{NewMemoryStore(), store, newSQLite(t)} {
+		for _, k := range []string{"a/2", "b/1", "a/1", "ab"} {
+			assert.NoError(t, m.Put([]byte(k), []byte(k)))
+		}
+		keys := make([]string, 0)
+		err = m.(Ranger).ForEachPrefix([]byte("a/"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a/1", "a/2"}, keys)
+	}
+}
@@ -11,8 +11,8 @@ import (
 type Action interface {
 	// Validate if attributes are correct
 	Validate() error
-	// Run with a context, a working directory and environments variables.
-	Up(pwd string, environments map[string]string, runID int) (run.Run, error)
+	// Run as a project, named after the task, with a working directory and environments variables.
+	Up(project, pwd string, environments map[string]string, runID int) (run.Run, error)
 	// RegisteredName is registered name
 	RegisteredName() string
 }
@@ -32,11 +32,12 @@ type ComposeActionValidator struct {
 	*compose.ComposeValidator
 }
 
-func (cv *ComposeActionValidator) ValidateAction(a task.Action) []error {
+// ValidateAction validates the compose resolved with the environments of the run
+func (cv *ComposeActionValidator) ValidateAction(a task.Action, environments map[string]string) []error {
 	c, ok := a.(*compose.Compose)
 	if !ok {
 		// FIXME nil or error?
 		return nil
 	}
-	return cv.Validate(c)
+	return cv.Validate(c, environments)
 }
@@ -57,7 +57,7 @@ func TestCompose(t *testing.T) {
 			"the build config is not available",
 		},
 	} {
-		errs := v.ValidateAction(a.action)
+		errs := v.ValidateAction(a.action, nil)
 		if a.err == "" {
 			assert.Len(t, errs, 0)
 		} else {
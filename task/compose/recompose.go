@@ -12,26 +12,29 @@ func init() {
 	task.ActionRecomposatorRegistry["compose"] = ComposeActionRecomposatorFactory
 }
 
-func ComposeActionRecomposatorFactory(docker *client.Client, projet string, cfg map[string]interface{}) (task.ActionRecomposator, error) {
+func ComposeActionRecomposatorFactory(docker *client.Client, cfg map[string]interface{}) (task.ActionRecomposator, error) {
 	r, err := compose.NewRecomposator(docker, cfg)
 	if err != nil {
 		return nil, err
 	}
 	return &ComposeActionRecompose{
 		r,
-		projet,
 	}, nil
 }
 
 type ComposeActionRecompose struct {
 	*compose.Recomposator
-	projet string
 }
 
-func (r *ComposeActionRecompose) RecomposeAction(a task.Action) (task.Action, error) {
+// RecomposeAction resolves the compose with the environments, then recomposes it
+func (r *ComposeActionRecompose) RecomposeAction(project string, environments map[string]string, a task.Action) (task.Action, error) {
 	cmp, ok := a.(*compose.Compose)
 	if !ok {
 		return nil, fmt.Errorf("Not o compose: %v", a)
 	}
-	return r.Recompose(r.projet, cmp)
+	resolved, err := cmp.Resolve(environments)
+	if err != nil {
+		return nil, err
+	}
+	return r.Recompose(project, environments["DENSITY_OWNER"], resolved)
 }
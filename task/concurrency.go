@@ -0,0 +1,44 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// ConcurrencyGroup renders the concurrency key, labels can be used as template values.
+// `deploy-{{ .Labels.env }}` for a task labeled env=prod is "deploy-prod".
+// An empty string means that the task is not in a group.
+func (t *Task) ConcurrencyGroup() (string, error) {
+	if t.ConcurrencyKey == "" {
+		return "", nil
+	}
+	tpl, err := template.New("concurrency_key").Option("missingkey=error").Parse(t.ConcurrencyKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid concurrency key %s : %v", t.ConcurrencyKey, err)
+	}
+	labels := t.Labels
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	var out bytes.Buffer
+	err = tpl.Execute(&out, struct {
+		Owner  string
+		Labels map[string]string
+	}{
+		Owner:  t.Owner,
+		Labels: labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't render concurrency key %s : %v", t.ConcurrencyKey, err)
+	}
+	return out.String(), nil
+}
+
+// ConcurrencyLimit is the max number of running tasks in the same group
+func (t *Task) ConcurrencyLimit() int {
+	if t.Concurrency <= 0 {
+		return 1
+	}
+	return t.Concurrency
+}
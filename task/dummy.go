@@ -2,8 +2,9 @@ package task
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"sync/atomic"
+	"sync"
 	"time"
 
 	"github.com/factorysh/density/task/action"
@@ -21,6 +22,19 @@ type DummyAction struct {
 	Counter  int64         `json:"counter"`
 	ExitCode int           `json:"exit_code"`
 	waiters  []chan interface{}
+	lock     sync.Mutex // the runs update the counter and the waiters
+}
+
+// MarshalJSON while the runs update it
+func (da *DummyAction) MarshalJSON() ([]byte, error) {
+	da.lock.Lock()
+	defer da.lock.Unlock()
+	return json.Marshal(struct {
+		Name     string        `json:"name"`
+		Wait     time.Duration `json:"wait"`
+		Counter  int64         `json:"counter"`
+		ExitCode int           `json:"exit_code"`
+	}{da.Name, da.Wait, da.Counter, da.ExitCode})
 }
 
 func (da *DummyAction) RegisteredName() string {
@@ -54,7 +68,9 @@ func (r *DummyRun) RegisteredName() string {
 
 func (r *DummyRun) Wait(ctx context.Context) (_status.Status, error) {
 	waiter := make(chan interface{})
+	r.da.lock.Lock()
 	r.da.waiters = append(r.da.waiters, waiter)
+	r.da.lock.Unlock()
 	var status _status.Status
 	select {
 	case <-waiter:
@@ -78,21 +94,27 @@ func (r DummyRun) Down() error {
 }
 
 // Run action interface implementation
-func (da *DummyAction) Up(pwd string, environments map[string]string, runID int) (run.Run, error) {
+func (da *DummyAction) Up(project, pwd string, environments map[string]string, runID int) (run.Run, error) {
 	// Print name
 	fmt.Println("DummyAction.Up :", da.Name)
+	da.lock.Lock()
 	if da.waiters == nil {
 		da.waiters = make([]chan interface{}, 0)
 	}
 	if da.Wait == 0 {
 		da.Wait = 100 * time.Microsecond
 	}
+	wait := da.Wait
+	da.lock.Unlock()
 	go func() {
 		// Sleep
-		time.Sleep(da.Wait)
+		time.Sleep(wait)
+		da.lock.Lock()
 		// Add to dedicated counter
-		atomic.AddInt64(&da.Counter, 1)
-		for _, waiter := range da.waiters {
+		da.Counter++
+		waiters := da.waiters
+		da.lock.Unlock()
+		for _, waiter := range waiters {
 			waiter <- new(interface{})
 		}
 	}()
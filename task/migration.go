@@ -0,0 +1,110 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_run "github.com/factorysh/density/task/run"
+	"github.com/google/uuid"
+)
+
+// SchemaVersion of the stored tasks, MarshalJSON writes it
+const SchemaVersion = 2
+
+// Outside stores what a migration moves out of a task
+type Outside interface {
+	// MoveRuns stores the runs of a task, latest first
+	MoveRuns(task uuid.UUID, runs []_run.Data) error
+}
+
+// Migration upgrades a raw task from version From to From+1
+type Migration struct {
+	From int
+	Name string
+	Up   func(doc map[string]interface{}, out Outside) error
+}
+
+// Migrations, in order, one per version
+var Migrations = []Migration{
+	{
+		From: 0,
+		Name: "stamp the schema version",
+		Up: func(doc map[string]interface{}, out Outside) error {
+			// version 0 is version 1, without its number
+			return nil
+		},
+	},
+	{
+		From: 1,
+		Name: "move the runs out of the task",
+		Up: func(doc map[string]interface{}, out Outside) error {
+			raw, ok := doc["runs"]
+			delete(doc, "runs")
+			if !ok || raw == nil {
+				return nil
+			}
+			// the raw runs are read again as runs
+			value, err := json.Marshal(raw)
+			if err != nil {
+				return err
+			}
+			var runs []_run.Data
+			err = json.Unmarshal(value, &runs)
+			if err != nil {
+				return fmt.Errorf("runs : %v", err)
+			}
+			if len(runs) == 0 {
+				return nil
+			}
+			if out == nil {
+				return errors.New("nowhere to move the runs")
+			}
+			id, err := uuid.Parse(fmt.Sprint(doc["id"]))
+			if err != nil {
+				return fmt.Errorf("runs of a task without id : %v", err)
+			}
+			return out.MoveRuns(id, runs)
+		},
+	},
+}
+
+// Migrate a raw task to SchemaVersion, the boolean is true when something was changed.
+// What is moved out of the task goes to out.
+func Migrate(raw []byte, out Outside) ([]byte, bool, error) {
+	var doc map[string]interface{}
+	err := json.Unmarshal(raw, &doc)
+	if err != nil {
+		return nil, false, err
+	}
+	version := 0
+	if v, ok := doc["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) {
+			return nil, false, fmt.Errorf("invalid schema version %v", v)
+		}
+		version = int(f)
+	}
+	if version > SchemaVersion {
+		return nil, false, fmt.Errorf("schema version %d is newer than %d", version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return raw, false, nil
+	}
+	for _, m := range Migrations[version:] {
+		if m.From != version {
+			return nil, false, fmt.Errorf("migration %s is from version %d, not %d", m.Name, m.From, version)
+		}
+		err = m.Up(doc, out)
+		if err != nil {
+			return nil, false, fmt.Errorf("migration %s : %v", m.Name, err)
+		}
+		version++
+	}
+	doc["version"] = version
+	raw, err = json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	return raw, true, nil
+}
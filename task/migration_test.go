@@ -0,0 +1,77 @@
+package task
+
+import (
+	"encoding/json"
+	"testing"
+
+	_run "github.com/factorysh/density/task/run"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	raw, changed, err := Migrate([]byte(`{"owner": "bob", "status": "Done"}`), nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	var doc map[string]interface{}
+	err = json.Unmarshal(raw, &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(SchemaVersion), doc["version"])
+	assert.Equal(t, "bob", doc["owner"])
+
+	_, changed, err = Migrate(raw, nil)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+
+	_, _, err = Migrate([]byte(`{"version": 42}`), nil)
+	assert.Error(t, err)
+	_, _, err = Migrate([]byte(`{"version": "one"}`), nil)
+	assert.Error(t, err)
+	_, _, err = Migrate([]byte(`plop`), nil)
+	assert.Error(t, err)
+}
+
+type outside map[uuid.UUID][]_run.Data
+
+func (o outside) MoveRuns(task uuid.UUID, runs []_run.Data) error {
+	o[task] = runs
+	return nil
+}
+
+func TestMigrateRuns(t *testing.T) {
+	id := uuid.New()
+	legacy := []byte(`{"version": 1, "id": "` + id.String() + `", "owner": "bob",
+		"runs": [{"id": 2, "exit_code": 1}, {"id": 1}]}`)
+	_, _, err := Migrate(legacy, nil)
+	assert.Error(t, err)
+
+	out := make(outside)
+	raw, changed, err := Migrate(legacy, out)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	var doc map[string]interface{}
+	err = json.Unmarshal(raw, &doc)
+	assert.NoError(t, err)
+	assert.NotContains(t, doc, "runs")
+	assert.Len(t, out[id], 2)
+	assert.Equal(t, 2, out[id][0].ID)
+	assert.Equal(t, 1, out[id][0].ExitCode)
+
+	// nothing to move
+	_, changed, err = Migrate([]byte(`{"version": 1, "owner": "bob"}`), nil)
+	assert.NoError(t, err)
+	assert.True(t, changed)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	raw, err := json.Marshal(&Task{Owner: "bob"})
+	assert.NoError(t, err)
+	var doc map[string]interface{}
+	err = json.Unmarshal(raw, &doc)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(SchemaVersion), doc["version"])
+
+	var task Task
+	err = json.Unmarshal([]byte(`{"version": 42, "owner": "bob"}`), &task)
+	assert.Error(t, err)
+}
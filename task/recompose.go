@@ -6,16 +6,18 @@ import (
 	"github.com/docker/docker/client"
 )
 
-var ActionRecomposatorRegistry map[string]func(docker *client.Client, project string, cfg map[string]interface{}) (ActionRecomposator, error)
+var ActionRecomposatorRegistry map[string]func(docker *client.Client, cfg map[string]interface{}) (ActionRecomposator, error)
 
 func init() {
 	if ActionRecomposatorRegistry == nil {
-		ActionRecomposatorRegistry = make(map[string]func(*client.Client, string, map[string]interface{}) (ActionRecomposator, error))
+		ActionRecomposatorRegistry = make(map[string]func(*client.Client, map[string]interface{}) (ActionRecomposator, error))
 	}
 }
 
+// ActionRecomposator rewrites an action for a project, each task is its own project.
+// The environments are the ones of the run.
 type ActionRecomposator interface {
-	RecomposeAction(a Action) (Action, error)
+	RecomposeAction(project string, environments map[string]string, a Action) (Action, error)
 }
 
 type Recomposator struct {
@@ -23,7 +25,7 @@ type Recomposator struct {
 	myRecomposators map[string]ActionRecomposator
 }
 
-func (r *Recomposator) Register(docker *client.Client, projet string) error {
+func (r *Recomposator) Register(docker *client.Client) error {
 	r.myRecomposators = make(map[string]ActionRecomposator)
 	for k, v := range r.Recomposators {
 		recomposator, ok := ActionRecomposatorRegistry[k]
@@ -31,7 +33,7 @@ func (r *Recomposator) Register(docker *client.Client, projet string) error {
 			return fmt.Errorf("No config recomposator for %s", k)
 		}
 		var err error
-		r.myRecomposators[k], err = recomposator(docker, projet, v)
+		r.myRecomposators[k], err = recomposator(docker, v)
 		if err != nil {
 			return err
 		}
@@ -39,10 +41,16 @@ func (r *Recomposator) Register(docker *client.Client, projet string) error {
 	return nil
 }
 
-func (r *Recomposator) RecomposeAction(a Action) (Action, error) {
+// Get the recomposator of an action, once registered
+func (r *Recomposator) Get(name string) (ActionRecomposator, bool) {
+	c, ok := r.myRecomposators[name]
+	return c, ok
+}
+
+func (r *Recomposator) RecomposeAction(project string, environments map[string]string, a Action) (Action, error) {
 	c, ok := r.myRecomposators[a.RegisteredName()]
 	if !ok {
 		return nil, fmt.Errorf("Unknow recompositor name : %s", a.RegisteredName())
 	}
-	return c.RecomposeAction(a)
+	return c.RecomposeAction(project, environments, a)
 }
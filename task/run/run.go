@@ -15,6 +15,7 @@ type Data struct {
 	ExitCode int       `json:"exit_code"`
 	Runner   string    `json:"runner"`
 	Running  bool      `json:"running"`
+	Errors   []string  `json:"errors,omitempty"`
 }
 
 type Run interface {
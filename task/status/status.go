@@ -27,14 +27,23 @@ func (s *Status) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	status, err := Parse(raw)
+	if err != nil {
+		return err
+	}
+	*s = status
+	return nil
+}
+
+// Parse a status name
+func Parse(raw string) (Status, error) {
 	var start uint8
 	for i, end := range _Status_index[1:] {
 		m := _Status_name[start:end]
 		if m == raw {
-			*s = Status(i)
-			return nil
+			return Status(i), nil
 		}
 		start = end
 	}
-	return fmt.Errorf("Not a known status: %s", raw)
+	return 0, fmt.Errorf("Not a known status: %s", raw)
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/factorysh/density/task/action"
 	_run "github.com/factorysh/density/task/run"
 	"github.com/factorysh/density/task/status"
+	"github.com/factorysh/density/task/window"
 	"github.com/google/uuid"
 	"github.com/robfig/cron"
 	log "github.com/sirupsen/logrus"
@@ -71,8 +72,18 @@ type Task struct {
 	resourceCancel  context.CancelFunc `json:"-"`
 	Run             _run.Run           `json:"run"`
 	RunCounter      int                `json:"run_counter"`
-	Runs            []_run.Data        `json:"runs"`
 	Labels          map[string]string  `json:"labels"`
+	ConcurrencyKey  string             `json:"concurrency_key,omitempty"`   // Tasks sharing this key are mutually exclusive, can be templated with labels
+	Concurrency     int                `json:"concurrency_limit,omitempty"` // Max running tasks sharing ConcurrencyKey
+	Calendar        *window.Calendar   `json:"calendar,omitempty"`          // Allowed run windows
+	Shutdown        *Shutdown          `json:"shutdown,omitempty"`          // What happened to it, when density stopped
+}
+
+// Shutdown is the decision taken for a running task, when density stopped
+type Shutdown struct {
+	Policy string    `json:"policy"` // drain, stop or detach
+	Action string    `json:"action"` // drained, stopped or detached
+	Date   time.Time `json:"date"`
 }
 
 // Resp represent a task that can be send directly on the wire
@@ -91,9 +102,13 @@ type Resp struct {
 	Cron            string            `json:"cron"`               // Cron definition. Exclusive with Every
 	Environments    map[string]string `json:"environments,omitempty"`
 	Run             _run.Data         `json:"run"`
+	Runs            []_run.Data       `json:"runs,omitempty"` // Latest runs, only for a single task
 	RunCounter      int               `json:"run_counter"`
-	Runs            []_run.Data       `json:"runs"`
 	Labels          map[string]string `json:"labels"`
+	ConcurrencyKey  string            `json:"concurrency_key,omitempty"`
+	Concurrency     int               `json:"concurrency_limit,omitempty"`
+	Calendar        *window.Calendar  `json:"calendar,omitempty"`
+	Shutdown        *Shutdown         `json:"shutdown,omitempty"`
 }
 
 // ToTaskResp will Convert a Task to TaskResp
@@ -115,8 +130,11 @@ func (t *Task) ToTaskResp() Resp {
 		Environments:    t.Environments,
 		Run:             t.Run.Data(),
 		RunCounter:      t.RunCounter,
-		Runs:            t.Runs,
 		Labels:          t.Labels,
+		ConcurrencyKey:  t.ConcurrencyKey,
+		Concurrency:     t.Concurrency,
+		Calendar:        t.Calendar,
+		Shutdown:        t.Shutdown,
 	}
 
 }
@@ -150,6 +168,7 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 }
 
 type RawTask struct {
+	Version         int                        `json:"version"`            // Schema version
 	Start           time.Time                  `json:"start"`              // Start time
 	MaxWaitTime     Duration                   `json:"max_wait_time"`      // Max wait time before starting Action
 	MaxExectionTime Duration                   `json:"max_execution_time"` // Max execution time
@@ -166,8 +185,11 @@ type RawTask struct {
 	Environments    map[string]string          `json:"environments,omitempty"`
 	Run             map[string]json.RawMessage `json:"run"`
 	RunCounter      int                        `json:"run_counter"`
-	Runs            []_run.Data                `json:"runs"`
 	Labels          map[string]string          `json:"labels"`
+	ConcurrencyKey  string                     `json:"concurrency_key,omitempty"`
+	Concurrency     int                        `json:"concurrency_limit,omitempty"`
+	Calendar        *window.Calendar           `json:"calendar,omitempty"`
+	Shutdown        *Shutdown                  `json:"shutdown,omitempty"`
 }
 
 func (t *Task) UnmarshalJSON(b []byte) error {
@@ -176,6 +198,9 @@ func (t *Task) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
+	if raw.Version > SchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d", raw.Version, SchemaVersion)
+	}
 	l := len(raw.Action)
 	switch {
 	case l == 0:
@@ -222,6 +247,12 @@ func (t *Task) UnmarshalJSON(b []byte) error {
 		}
 
 	}
+	if raw.Calendar != nil {
+		err = raw.Calendar.Validate()
+		if err != nil {
+			return fmt.Errorf("error when parsing calendar: %v", err)
+		}
+	}
 	t.Start = raw.Start
 	t.MaxWaitTime = time.Duration(raw.MaxWaitTime)
 	t.MaxExectionTime = time.Duration(raw.MaxExectionTime)
@@ -236,14 +267,18 @@ func (t *Task) UnmarshalJSON(b []byte) error {
 	t.Cron = raw.Cron
 	t.Environments = raw.Environments
 	t.RunCounter = raw.RunCounter
-	t.Runs = raw.Runs
 	t.Labels = raw.Labels
+	t.ConcurrencyKey = raw.ConcurrencyKey
+	t.Concurrency = raw.Concurrency
+	t.Calendar = raw.Calendar
+	t.Shutdown = raw.Shutdown
 
 	return nil
 }
 
 func (t *Task) MarshalJSON() ([]byte, error) {
 	raw := RawTask{
+		Version:         SchemaVersion,
 		Start:           t.Start,
 		MaxWaitTime:     Duration(t.MaxWaitTime),
 		MaxExectionTime: Duration(t.MaxExectionTime),
@@ -260,8 +295,11 @@ func (t *Task) MarshalJSON() ([]byte, error) {
 		Action:          make(map[string]json.RawMessage),
 		Run:             make(map[string]json.RawMessage),
 		RunCounter:      t.RunCounter,
-		Runs:            t.Runs,
 		Labels:          t.Labels,
+		ConcurrencyKey:  t.ConcurrencyKey,
+		Concurrency:     t.Concurrency,
+		Calendar:        t.Calendar,
+		Shutdown:        t.Shutdown,
 	}
 	if t.Action != nil {
 		rawAction, err := json.Marshal(t.Action)
@@ -314,29 +352,28 @@ const defaultCachePath = "/density/cache"
 
 // InjectPredefinedEnv is used to inject or modifiy Density predefined env variables
 func (t *Task) InjectPredefinedEnv() {
+	t.Environments = t.RunEnvironments()
+}
 
-	now := time.Now()
-
-	if t.Environments == nil {
-		t.Environments = make(map[string]string)
-	}
-	t.Environments["DENSITY_STARTED_AT_DATE"] = now.Format("2006/01/02")
-	t.Environments["DENSITY_STARTED_AT_TIME"] = now.Format("11:49:02")
-	t.Environments["DENSITY_TASK_ID"] = t.Id.String()
-	t.Environments["DENSITY"] = "true"
-	t.Environments["XDG_CACHE_HOME"] = defaultCachePath
-	t.Environments["DENSITY_RUNNER"] = t.Action.RegisteredName()
-	t.Environments["DENSITY_MAX_EXECUTION_TIME"] = t.MaxExectionTime.String()
+// RunEnvironments are the environments of a run, with the predefined ones, the task is untouched
+func (t *Task) RunEnvironments() map[string]string {
 
-}
+	now := time.Now()
 
-// AddRunToHistory adds run to history by prepending it
-func (t *Task) AddRunToHistory(r _run.Run) {
-	if r == nil {
-		return
+	environments := make(map[string]string, len(t.Environments)+8)
+	for k, v := range t.Environments {
+		environments[k] = v
 	}
-
-	t.Runs = append([]_run.Data{r.Data()}, t.Runs...)
+	environments["DENSITY_STARTED_AT_DATE"] = now.Format("2006/01/02")
+	environments["DENSITY_STARTED_AT_TIME"] = now.Format("11:49:02")
+	environments["DENSITY_TASK_ID"] = t.Id.String()
+	environments["DENSITY_OWNER"] = t.Owner
+	environments["DENSITY"] = "true"
+	environments["XDG_CACHE_HOME"] = defaultCachePath
+	environments["DENSITY_RUNNER"] = t.Action.RegisteredName()
+	environments["DENSITY_MAX_EXECUTION_TIME"] = t.MaxExectionTime.String()
+
+	return environments
 }
 
 // NewTask init a new task
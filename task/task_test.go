@@ -78,3 +78,25 @@ func TestValidateLabel(t *testing.T) {
 	}
 
 }
+
+func TestConcurrencyGroup(t *testing.T) {
+	task := &Task{
+		ConcurrencyKey: "deploy-{{ .Labels.env }}",
+		Labels: map[string]string{
+			"env": "prod",
+		},
+	}
+	group, err := task.ConcurrencyGroup()
+	assert.NoError(t, err)
+	assert.Equal(t, "deploy-prod", group)
+	assert.Equal(t, 1, task.ConcurrencyLimit())
+
+	task.Labels = nil
+	_, err = task.ConcurrencyGroup()
+	assert.Error(t, err)
+
+	task.ConcurrencyKey = ""
+	group, err = task.ConcurrencyGroup()
+	assert.NoError(t, err)
+	assert.Equal(t, "", group)
+}
@@ -15,13 +15,14 @@ func init() {
 	}
 }
 
+// ActionValidator validates an action as it will run, with the environments of the run
 type ActionValidator interface {
-	ValidateAction(a Action) []error
+	ValidateAction(a Action, environments map[string]string) []error
 }
 
 type DummyActionValidator struct{}
 
-func (d *DummyActionValidator) ValidateAction(a Action) []error {
+func (d *DummyActionValidator) ValidateAction(a Action, environments map[string]string) []error {
 	return nil
 }
 
@@ -46,7 +47,13 @@ func (val *Validator) Register() error {
 	return nil
 }
 
-func (v *Validator) ValidateAction(a Action) []error {
+// Get the validator of an action, once registered
+func (v *Validator) Get(name string) (ActionValidator, bool) {
+	validator, ok := v.myValidators[name]
+	return validator, ok
+}
+
+func (v *Validator) ValidateAction(a Action, environments map[string]string) []error {
 	errs := make([]error, 0)
 	validator, ok := v.myValidators[a.RegisteredName()]
 	if !ok {
@@ -54,7 +61,7 @@ func (v *Validator) ValidateAction(a Action) []error {
 		return errs
 	}
 
-	errz := validator.ValidateAction(a)
+	errz := validator.ValidateAction(a, environments)
 	if errz != nil {
 		for _, err := range errz {
 			errs = append(errs, err)
@@ -21,6 +21,6 @@ validators:
 	errs := v.ValidateAction(&DummyAction{
 		Name: "Action A",
 		Wait: 10,
-	})
+	}, nil)
 	assert.Len(t, errs, 0)
 }
@@ -0,0 +1,230 @@
+package window
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how far Next looks for an opening
+const horizon = 366
+
+var days = map[string][]time.Weekday{
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"sun":      {time.Sunday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekend":  {time.Saturday, time.Sunday},
+	"*": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday,
+		time.Saturday, time.Sunday},
+}
+
+// Window is a daily time range, starting on some days of the week.
+// When End is before Start, the window ends the next day.
+type Window struct {
+	Days  []string `json:"days,omitempty" yaml:"days"` // mon, tue … weekdays, weekend, empty is every day
+	Start string   `json:"start" yaml:"start"`         // 22:00
+	End   string   `json:"end" yaml:"end"`             // 06:00
+}
+
+// Calendar is a set of allowed windows, and blackout dates
+type Calendar struct {
+	Location  string   `json:"location,omitempty" yaml:"location"`   // Europe/Paris, default is local time
+	Windows   []Window `json:"windows,omitempty" yaml:"windows"`     // Allowed windows, empty is always
+	Blackouts []string `json:"blackouts,omitempty" yaml:"blackouts"` // Forbidden days, 2006-01-02
+}
+
+func parseClock(clock string) (time.Duration, error) {
+	if clock == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	c, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock %s : %v", clock, err)
+	}
+	return time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute, nil
+}
+
+func (w Window) weekdays() (map[time.Weekday]bool, error) {
+	wd := make(map[time.Weekday]bool)
+	if len(w.Days) == 0 {
+		for _, d := range days["*"] {
+			wd[d] = true
+		}
+		return wd, nil
+	}
+	for _, day := range w.Days {
+		dd, ok := days[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %s", day)
+		}
+		for _, d := range dd {
+			wd[d] = true
+		}
+	}
+	return wd, nil
+}
+
+// bounds return start and end offset from midnight, end can be the next day
+func (w Window) bounds() (time.Duration, time.Duration, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end <= start {
+		end += 24 * time.Hour
+	}
+	return start, end, nil
+}
+
+// Validate the calendar
+func (c *Calendar) Validate() error {
+	_, err := c.location()
+	if err != nil {
+		return err
+	}
+	for _, w := range c.Windows {
+		_, err = w.weekdays()
+		if err != nil {
+			return err
+		}
+		_, _, err = w.bounds()
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range c.Blackouts {
+		_, err = time.Parse("2006-01-02", b)
+		if err != nil {
+			return fmt.Errorf("invalid blackout date %s : %v", b, err)
+		}
+	}
+	return nil
+}
+
+func (c *Calendar) location() (*time.Location, error) {
+	if c.Location == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Location)
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// clockOn returns the wall clock offset of a day, DST safe
+func clockOn(day time.Time, offset time.Duration) time.Time {
+	y, m, d := day.Date()
+	return time.Date(y, m, d, 0, int(offset/time.Minute), 0, 0, day.Location())
+}
+
+func (c *Calendar) isBlackout(t time.Time) bool {
+	day := t.Format("2006-01-02")
+	for _, b := range c.Blackouts {
+		if b == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if t is in a window, and not a blackout date
+func (c *Calendar) Allows(t time.Time) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	loc, err := c.location()
+	if err != nil {
+		return false, err
+	}
+	t = t.In(loc)
+	if c.isBlackout(t) {
+		return false, nil
+	}
+	if len(c.Windows) == 0 {
+		return true, nil
+	}
+	today := midnight(t)
+	for _, w := range c.Windows {
+		wd, err := w.weekdays()
+		if err != nil {
+			return false, err
+		}
+		start, end, err := w.bounds()
+		if err != nil {
+			return false, err
+		}
+		// the window may have started yesterday
+		for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+			if !wd[day.Weekday()] {
+				continue
+			}
+			if !t.Before(clockOn(day, start)) && t.Before(clockOn(day, end)) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Next returns the first allowed moment, from t
+func (c *Calendar) Next(t time.Time) (time.Time, error) {
+	ok, err := c.Allows(t)
+	if err != nil {
+		return t, err
+	}
+	if ok {
+		return t, nil
+	}
+	loc, err := c.location()
+	if err != nil {
+		return t, err
+	}
+	day := midnight(t.In(loc))
+	for i := 0; i < horizon; i++ {
+		// window openings, and midnight, for blackouts ending
+		candidates := []time.Time{day}
+		for _, w := range c.Windows {
+			wd, err := w.weekdays()
+			if err != nil {
+				return t, err
+			}
+			if !wd[day.Weekday()] {
+				continue
+			}
+			start, _, err := w.bounds()
+			if err != nil {
+				return t, err
+			}
+			candidates = append(candidates, clockOn(day, start))
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			return candidates[a].Before(candidates[b])
+		})
+		for _, candidate := range candidates {
+			if candidate.Before(t) {
+				continue
+			}
+			ok, err := c.Allows(candidate)
+			if err != nil {
+				return t, err
+			}
+			if ok {
+				return candidate, nil
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return t, fmt.Errorf("no opening in the next %d days", horizon)
+}
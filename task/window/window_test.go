@@ -0,0 +1,95 @@
+package window
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllows(t *testing.T) {
+	c := &Calendar{
+		Location: "Europe/Paris",
+		Windows: []Window{
+			{
+				Days:  []string{"weekdays"},
+				Start: "22:00",
+				End:   "06:00",
+			},
+		},
+		Blackouts: []string{"2021-12-24"},
+	}
+	assert.NoError(t, c.Validate())
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		when  time.Time
+		allow bool
+	}{
+		{"monday night", time.Date(2021, 12, 13, 23, 0, 0, 0, paris), true},
+		{"tuesday morning", time.Date(2021, 12, 14, 5, 59, 0, 0, paris), true},
+		{"tuesday noon", time.Date(2021, 12, 14, 12, 0, 0, 0, paris), false},
+		{"saturday night", time.Date(2021, 12, 18, 23, 0, 0, 0, paris), false},
+		{"saturday morning, friday window", time.Date(2021, 12, 18, 1, 0, 0, 0, paris), true},
+		{"blackout", time.Date(2021, 12, 24, 23, 0, 0, 0, paris), false},
+		{"utc", time.Date(2021, 12, 13, 21, 30, 0, 0, time.UTC), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := c.Allows(tc.when)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.allow, ok)
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	c := &Calendar{
+		Location: "Europe/Paris",
+		Windows: []Window{
+			{
+				Days:  []string{"weekdays"},
+				Start: "22:00",
+				End:   "06:00",
+			},
+		},
+		Blackouts: []string{"2021-12-14"},
+	}
+	paris, err := time.LoadLocation("Europe/Paris")
+	assert.NoError(t, err)
+
+	// Monday noon, opening is monday night
+	next, err := c.Next(time.Date(2021, 12, 13, 12, 0, 0, 0, paris))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 12, 13, 22, 0, 0, 0, paris), next)
+
+	// Tuesday is a blackout, monday night window is over at midnight
+	next, err = c.Next(time.Date(2021, 12, 14, 1, 0, 0, 0, paris))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 12, 15, 0, 0, 0, 0, paris), next)
+
+	// Saturday afternoon, waiting for monday
+	next, err = c.Next(time.Date(2021, 12, 18, 15, 0, 0, 0, paris))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 12, 20, 22, 0, 0, 0, paris), next)
+
+	// Already open
+	now := time.Date(2021, 12, 13, 23, 0, 0, 0, paris)
+	next, err = c.Next(now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, next)
+
+	// No calendar, no constraint
+	var empty *Calendar
+	next, err = empty.Next(now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, next)
+}
+
+func TestValidate(t *testing.T) {
+	assert.Error(t, (&Calendar{Location: "Mars/Olympus"}).Validate())
+	assert.Error(t, (&Calendar{Windows: []Window{{Start: "25:00", End: "01:00"}}}).Validate())
+	assert.Error(t, (&Calendar{Windows: []Window{{Days: []string{"someday"}, Start: "10:00", End: "11:00"}}}).Validate())
+	assert.Error(t, (&Calendar{Blackouts: []string{"christmas"}}).Validate())
+}